@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
+	"github.com/urfave/cli/v2"
+)
+
+func newHealthcheckCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "healthcheck",
+		Usage: "exit non-zero if a loop of the running plugin stalled, for the liveness probe",
+		Before: func(c *cli.Context) error {
+			flag.Set("alsologtostderr", "false")
+			return nil
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "socket",
+				Usage: "health socket of the running plugin",
+				Value: config.HealthSocket,
+			},
+			&cli.DurationFlag{
+				Name:  "threshold",
+				Usage: "time without progress after which a loop is stalled",
+				Value: time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "time to wait for the plugin to answer",
+				Value: 5 * time.Second,
+			},
+		},
+		Action: healthcheck,
+	}
+}
+
+func healthcheck(c *cli.Context) error {
+	status, err := health.Query(c.String("socket"), c.Duration("timeout"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("plugin did not answer: %v", err), 1)
+	}
+
+	if problems := status.Problems(c.Duration("threshold")); len(problems) > 0 {
+		return cli.Exit(strings.Join(problems, "\n"), 1)
+	}
+
+	var names []string
+	for name := range status.Loops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("ok: %s\n", strings.Join(names, ", "))
+	return nil
+}
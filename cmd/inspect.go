@@ -0,0 +1,298 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ecc"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+func outputFlag(value string) cli.Flag {
+	return &cli.StringFlag{
+		Name:    "output",
+		Aliases: []string{"o"},
+		Usage:   "output format:\n\t\t[table, json, yaml]",
+		Value:   value,
+	}
+}
+
+func newInspectCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "inspect",
+		Usage: "print what the plugin discovers on this node, without registering with kubelet",
+		Before: func(c *cli.Context) error {
+			// keep stdout and stderr for the output, the log file still has everything
+			flag.Set("alsologtostderr", "false")
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:   "devices",
+				Usage:  "print the chips, boards and replicas advertised to kubelet",
+				Flags:  []cli.Flag{outputFlag(outputTable)},
+				Action: inspectDevices,
+			},
+			{
+				Name:   "topology",
+				Usage:  "print the P2P link matrix of the devices",
+				Flags:  []cli.Flag{outputFlag(outputTable)},
+				Action: inspectTopology,
+			},
+			{
+				Name:   "config",
+				Usage:  "print the config after the command line flags are applied",
+				Flags:  []cli.Flag{outputFlag(outputYAML)},
+				Action: inspectConfig,
+			},
+		},
+	}
+}
+
+// loadDeviceSet discovers the devices the same way the plugin does, the
+// returned function shuts IXML down.
+func loadDeviceSet(c *cli.Context) (*gpuallocator.DeviceSet, func(), error) {
+	cfg, err := config.LoadConfig(c, c.App.Flags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load config: %v", err)
+	}
+	if err := ixml.Init(); err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize IXML: %v", err)
+	}
+
+	devSet := gpuallocator.BuildDeviceSet(cfg, ixml.Library)
+	if devSet == nil {
+		ixml.Shutdown()
+		return nil, nil, fmt.Errorf("failed to discover devices")
+	}
+	return devSet, func() { ixml.Shutdown() }, nil
+}
+
+func writeStructured(w io.Writer, format string, v interface{}) error {
+	var data []byte
+	var err error
+	switch format {
+	case outputJSON:
+		data, err = json.MarshalIndent(v, "", "  ")
+		data = append(data, '\n')
+	case outputYAML:
+		data, err = yaml.Marshal(v)
+	default:
+		return fmt.Errorf("unsupported output format %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func sortedDevices(devSet *gpuallocator.DeviceSet) []*gpuallocator.Device {
+	var devs []*gpuallocator.Device
+	for _, dev := range devSet.Devices {
+		devs = append(devs, dev)
+	}
+	sort.Slice(devs, func(i, j int) bool {
+		ci, cj := devs[i].SortedChips(), devs[j].SortedChips()
+		if len(ci) == 0 || len(cj) == 0 {
+			return len(ci) > len(cj)
+		}
+		return ci[0].Index < cj[0].Index
+	})
+	return devs
+}
+
+func inspectDevices(c *cli.Context) error {
+	devSet, shutdown, err := loadDeviceSet(c)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	modes := devSet.ReadComputeModes()
+	eccErrors := readEccErrors(devSet)
+	format := c.String("output")
+	if format != outputTable {
+		info := devSet.NodeDeviceInfo(nil, (*gpuallocator.Device).HealthReason)
+		devSet.SetComputeModes(info, modes)
+		gpuallocator.SetEccErrors(info, eccErrors)
+		return writeStructured(os.Stdout, format, info)
+	}
+
+	var reasons, mismatches []string
+	expected := devSet.ExpectedComputeMode()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tNAME\tHEALTH\tREPLICAS\tCHIP\tINDEX\tMINOR\tBUS ID\tBOARD\tPOSITION\tNUMA\tMEMORY\tCOMPUTE MODE\tECC CORR/UNCORR\tCHIP HEALTH")
+	for _, dev := range sortedDevices(devSet) {
+		device := []string{dev.UUID, dev.Name, dev.Exposed[0].Health, fmt.Sprint(len(dev.Exposed))}
+		chips := dev.SortedChips()
+		if len(chips) == 0 {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\n", strings.Join(device, "\t"))
+		}
+		for _, chip := range chips {
+			mode := "-"
+			if m, ok := modes[chip.UUID]; ok {
+				mode = m.String()
+				if m != expected {
+					mode += " (!)"
+					mismatches = append(mismatches, fmt.Sprintf("%s: compute mode %s, expected %s", chip.UUID, m, expected))
+				}
+			}
+			errs := "-"
+			if e, ok := eccErrors[chip.UUID]; ok {
+				errs = fmt.Sprintf("%d/%d", e.Corrected, e.Uncorrected)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%d\t%d\t%d\t%dMiB\t%s\t%s\t%s\n", strings.Join(device, "\t"),
+				chip.UUID, chip.Index, chip.Minor, chip.BusID, chip.BoardID, chip.BoardPosition,
+				chip.NumaNode, chip.MemoryTotal, mode, errs, chip.Health)
+			// board columns only on the first chip
+			device = []string{"", "", "", ""}
+		}
+		if reason := dev.HealthReason(); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", dev.UUID, reason))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(reasons) > 0 {
+		fmt.Println()
+		fmt.Println(strings.Join(reasons, "\n"))
+	}
+	if len(mismatches) > 0 {
+		fmt.Println()
+		fmt.Println(strings.Join(mismatches, "\n"))
+	}
+	return nil
+}
+
+// readEccErrors reads the ECC errors of the chips with ECC enabled, added to
+// the ones the plugin counted before the driver was last loaded.
+func readEccErrors(devSet *gpuallocator.DeviceSet) map[string]deviceinfo.EccErrors {
+	store, err := ecc.Load(config.EccFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ignoring the ECC errors counted by the plugin: %v\n", err)
+	}
+	now := time.Now()
+	errs := map[string]deviceinfo.EccErrors{}
+	for uuid, counts := range devSet.ReadEccErrors() {
+		r := store.Peek(uuid, counts, now)
+		errs[uuid] = r.Errors()
+	}
+	return errs
+}
+
+// shortLinkType drops the common prefix of the link names for the matrix.
+func shortLinkType(linkType gpuallocator.P2PLinkType) string {
+	return strings.TrimPrefix(gpuallocator.P2PLinkTypeToString(linkType), "P2PLink")
+}
+
+func inspectTopology(c *cli.Context) error {
+	devSet, shutdown, err := loadDeviceSet(c)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	devs := sortedDevices(devSet)
+	format := c.String("output")
+	if format != outputTable {
+		// device uuid -> device uuid -> link types
+		links := map[string]map[string][]string{}
+		for _, dev := range devs {
+			links[dev.UUID] = map[string][]string{}
+			for uuid, l := range dev.Links {
+				for _, link := range l {
+					links[dev.UUID][uuid] = append(links[dev.UUID][uuid], gpuallocator.P2PLinkTypeToString(link.Type))
+				}
+			}
+		}
+		return writeStructured(os.Stdout, format, links)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := []string{""}
+	for i := range devs {
+		header = append(header, fmt.Sprintf("GPU%d", i))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for i, d1 := range devs {
+		row := []string{fmt.Sprintf("GPU%d", i)}
+		for _, d2 := range devs {
+			if d1 == d2 {
+				row = append(row, "X")
+				continue
+			}
+			var types []string
+			for _, link := range d1.Links[d2.UUID] {
+				types = append(types, shortLinkType(link.Type))
+			}
+			if len(types) == 0 {
+				types = append(types, shortLinkType(gpuallocator.P2PLinkUnknown))
+			}
+			row = append(row, strings.Join(types, ","))
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	for i, dev := range devs {
+		fmt.Printf("GPU%d: %s\n", i, dev.UUID)
+	}
+	return nil
+}
+
+func inspectConfig(c *cli.Context) error {
+	cfg, err := config.LoadConfig(c, c.App.Flags)
+	if err != nil {
+		return fmt.Errorf("unable to load config: %v", err)
+	}
+	if err := cfg.CheckConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+	}
+
+	format := c.String("output")
+	if format == outputTable {
+		format = outputYAML
+	}
+	return writeStructured(os.Stdout, format, cfg)
+}
@@ -37,6 +37,11 @@ func main() {
 	c.Action = func(ctx *cli.Context) error {
 		return manager.Run(ctx, c.Flags)
 	}
+	c.Commands = []*cli.Command{
+		newInspectCommand(),
+		newSimulateCommand(),
+		newHealthcheckCommand(),
+	}
 	c.Name = "Iluvatar Device Plugin"
 	c.Usage = "Iluvatar device plugin for Kubernetes"
 	c.Flags = []cli.Flag{
@@ -55,6 +60,26 @@ func main() {
 			Usage:   "enable reset gpu mode:\n\t\t[false, true]",
 			EnvVars: []string{"RESET_GPU"},
 		},
+		&cli.BoolFlag{
+			Name:    "maintenance",
+			Usage:   "enable gpu drain and reset requested by node annotations:\n\t\t[false, true]",
+			EnvVars: []string{"MAINTENANCE"},
+		},
+		&cli.BoolFlag{
+			Name:    "exclude_annotation",
+			Usage:   "let the exclude-devices node annotation override excludeDevices:\n\t\t[false, true]",
+			EnvVars: []string{"EXCLUDE_ANNOTATION"},
+		},
+		&cli.StringFlag{
+			Name:    "mode",
+			Usage:   "kubelet API served by the plugin:\n\t\t[deviceplugin, dra]",
+			EnvVars: []string{"PLUGIN_MODE"},
+		},
+		&cli.StringFlag{
+			Name:    "debug_addr",
+			Usage:   "serve the debug API on a localhost address or a unix:// socket:\n\t\t[127.0.0.1:9400, unix:///var/run/ix-device-plugin/debug.sock]",
+			EnvVars: []string{"DEBUG_ADDR"},
+		},
 	}
 
 	defer klog.Flush()
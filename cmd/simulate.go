@@ -0,0 +1,205 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"github.com/urfave/cli/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// simulatedRequest is an entry of the replay file.
+type simulatedRequest struct {
+	Size        int      `json:"size"`
+	MustInclude []string `json:"mustInclude,omitempty"`
+}
+
+func newSimulateCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "simulate",
+		Usage: "run the allocation policy offline against a node description",
+		Before: func(c *cli.Context) error {
+			flag.Set("alsologtostderr", "false")
+			return nil
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "node",
+				Usage:    "node description in the device-info schema, as printed by 'inspect devices -o json'",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "config file selecting the policy, time-slicing is inferred from the node otherwise",
+			},
+			&cli.StringSliceFlag{
+				Name:  "allocated",
+				Usage: "ids already allocated on the node",
+			},
+			&cli.IntFlag{
+				Name:  "size",
+				Usage: "number of ids requested",
+			},
+			&cli.StringSliceFlag{
+				Name:  "must-include",
+				Usage: "ids the allocation must include",
+			},
+			&cli.StringFlag{
+				Name:  "replay",
+				Usage: "yaml or json list of requests {size, mustInclude} allocated one after the other",
+			},
+		},
+		Action: simulate,
+	}
+}
+
+func loadNodeDescription(path string) (*deviceinfo.NodeDeviceInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", path, err)
+	}
+	return deviceinfo.Decode(string(data))
+}
+
+func simulationConfig(c *cli.Context, node *deviceinfo.NodeDeviceInfo) (*config.Config, error) {
+	if path := c.String("config"); path != "" {
+		return config.LoadConfigFile(path)
+	}
+
+	cfg := &config.Config{}
+	for _, dev := range node.Devices {
+		for _, id := range dev.Replicas {
+			if gpuallocator.Alias(id).HasAlias() {
+				cfg.Sharing.TimeSlicing.Replicas = len(dev.Replicas)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func simulate(c *cli.Context) error {
+	node, err := loadNodeDescription(c.String("node"))
+	if err != nil {
+		return fmt.Errorf("unable to load node description: %v", err)
+	}
+	cfg, err := simulationConfig(c, node)
+	if err != nil {
+		return err
+	}
+	devSet, err := gpuallocator.BuildDeviceSetFromInfo(cfg, node)
+	if err != nil {
+		return err
+	}
+
+	var requests []simulatedRequest
+	if path := c.String("replay"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &requests); err != nil {
+			return fmt.Errorf("parse %s failed: %v", path, err)
+		}
+	} else if c.Int("size") > 0 {
+		requests = append(requests, simulatedRequest{Size: c.Int("size"), MustInclude: c.StringSlice("must-include")})
+	} else {
+		return fmt.Errorf("either --size or --replay is required")
+	}
+
+	allocated := map[string]bool{}
+	for _, id := range c.StringSlice("allocated") {
+		allocated[id] = true
+	}
+
+	fmt.Printf("Initial: %s\n", describeFragmentation(devSet.GetFragmentation(allocated)))
+	for i, req := range requests {
+		fmt.Printf("\nRequest %d: size %d, must include %v\n", i+1, req.Size, req.MustInclude)
+
+		var available []string
+		for _, dev := range devSet.Devices {
+			for _, rdev := range dev.Exposed {
+				if rdev.Health == pluginapi.Healthy && !allocated[rdev.ID] {
+					available = append(available, rdev.ID)
+				}
+			}
+		}
+		sort.Strings(available)
+
+		chosen, err := devSet.PreferredAllocation(available, req.MustInclude, req.Size)
+		if err != nil {
+			fmt.Printf("  Failed: %v\n", err)
+			continue
+		}
+		if len(chosen) == 0 {
+			fmt.Printf("  Failed: no allocation of %d out of %d available\n", req.Size, len(available))
+			continue
+		}
+
+		sort.Strings(chosen)
+		fmt.Printf("  Chosen: %s\n", strings.Join(chosen, ", "))
+		printPairScores(devSet, chosen)
+
+		for _, id := range chosen {
+			allocated[id] = true
+		}
+		fmt.Printf("  After: %s\n", describeFragmentation(devSet.GetFragmentation(allocated)))
+	}
+	return nil
+}
+
+// printPairScores prints the score of every pair of devices the chosen ids
+// belong to, replicas of the same device are scored once.
+func printPairScores(devSet *gpuallocator.DeviceSet, chosen []string) {
+	var devs []*gpuallocator.Device
+	seen := map[string]bool{}
+	for _, id := range chosen {
+		uuid := gpuallocator.Alias(id).Prefix()
+		if dev, ok := devSet.Devices[uuid]; ok && !seen[uuid] {
+			seen[uuid] = true
+			devs = append(devs, dev)
+		}
+	}
+
+	total := 0
+	for i := 0; i < len(devs); i++ {
+		for j := i + 1; j < len(devs); j++ {
+			score := gpuallocator.PairScore(devs[i], devs[j])
+			total += score
+			fmt.Printf("    %s - %s: %d\n", devs[i].UUID, devs[j].UUID, score)
+		}
+	}
+	fmt.Printf("  Set score: %d\n", total)
+}
+
+func describeFragmentation(f gpuallocator.Fragmentation) string {
+	return fmt.Sprintf("%d/%d free, %d fragmented groups holding %d free, fragmentation %.0f%%",
+		f.Free, f.Total, f.FragmentedGroups, f.FreeInFragmented, f.Ratio()*100)
+}
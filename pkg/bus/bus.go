@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bus delivers the lifecycle events of the devices to the components
+// of the plugin which react to them.
+package bus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Type is the kind of an Event.
+type Type string
+
+const (
+	// DeviceAdded and DeviceRemoved are published when chips appear or
+	// leave the node, Chips lists them.
+	DeviceAdded   Type = "DeviceAdded"
+	DeviceRemoved Type = "DeviceRemoved"
+	// HealthChanged is published when the health advertised for a device
+	// changed, Health is the new one.
+	HealthChanged Type = "HealthChanged"
+	// Allocated and Released list the device ids handed out to or given
+	// back by a container in Replicas.
+	Allocated Type = "Allocated"
+	Released  Type = "Released"
+	// ResetStarted and ResetFinished surround the reset of Chips, Reason
+	// is the error of a failed reset.
+	ResetStarted  Type = "ResetStarted"
+	ResetFinished Type = "ResetFinished"
+	// ConfigReloaded is published when the settings the plugin runs with
+	// were changed without a restart.
+	ConfigReloaded Type = "ConfigReloaded"
+	// DegradationChanged is published when a device turned degraded, Reason
+	// lists why, or recovered.
+	DegradationChanged Type = "DegradationChanged"
+)
+
+// Event is a change of the devices of the node.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	// Device is the uuid of the device, empty when the event is not about
+	// a single device
+	Device   string   `json:"device,omitempty"`
+	Chips    []string `json:"chips,omitempty"`
+	Replicas []string `json:"replicas,omitempty"`
+	// Pod is the namespace/name of the pod the replicas were released by
+	Pod    string `json:"pod,omitempty"`
+	Health string `json:"health,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// BusID is the PCI address of the chip of a udev event
+	BusID string `json:"busID,omitempty"`
+	// Version is the device snapshot in which the change was published, it
+	// is not set for the events which did not change the devices
+	Version uint64 `json:"version,omitempty"`
+}
+
+// Subscription receives the events of the types it subscribed to on C.
+type Subscription struct {
+	C <-chan Event
+
+	name    string
+	ch      chan Event
+	types   map[Type]bool
+	bus     *Bus
+	dropped atomic.Uint64
+}
+
+// Bus delivers every published event to the subscriptions of its type. A
+// publisher never waits for a subscriber: an event which does not fit in the
+// buffer of a subscription is dropped for it. A nil Bus delivers nothing.
+type Bus struct {
+	lk   sync.Mutex
+	subs map[*Subscription]bool
+	now  func() time.Time
+}
+
+// New creates a Bus stamping the events with clock, time.Now if nil.
+func New(clock func() time.Time) *Bus {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Bus{
+		subs: map[*Subscription]bool{},
+		now:  clock,
+	}
+}
+
+// Subscribe subscribes to the events of types, all of them if none is given.
+// size is the number of events the subscriber may lag behind.
+func (b *Bus) Subscribe(name string, size int, types ...Type) *Subscription {
+	ch := make(chan Event, size)
+	s := &Subscription{C: ch, name: name, ch: ch, types: map[Type]bool{}, bus: b}
+	for _, t := range types {
+		s.types[t] = true
+	}
+	if b == nil {
+		return s
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.subs[s] = true
+	return s
+}
+
+// Close stops the delivery to s, and closes C.
+func (s *Subscription) Close() {
+	if s.bus == nil {
+		close(s.ch)
+		return
+	}
+
+	s.bus.lk.Lock()
+	defer s.bus.lk.Unlock()
+	if s.bus.subs[s] {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+}
+
+// Dropped is the number of events s did not have room for.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Publish delivers e to the subscriptions of its type.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if e.Time.IsZero() {
+		e.Time = b.now()
+	}
+	for s := range b.subs {
+		if len(s.types) > 0 && !s.types[e.Type] {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+			klog.Warningf("Subscriber %s lags behind, dropped %s event of %q", s.name, e.Type, e.Device)
+		}
+	}
+}
@@ -20,16 +20,28 @@ package config
 import (
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/urfave/cli/v2"
 	"sigs.k8s.io/yaml"
 )
 
 type Flags struct {
-	SplitBoard bool `json:"splitboard"                yaml:"splitboard"`
-	UseVolcano bool `json:"usevolcano"                yaml:"usevolcano"`
-	ResetGpu   bool `json:"reset_gpu"                 yaml:"reset_gpu"`
+	SplitBoard  bool `json:"splitboard"                yaml:"splitboard"`
+	UseVolcano  bool `json:"usevolcano"                yaml:"usevolcano"`
+	ResetGpu    bool `json:"reset_gpu"                 yaml:"reset_gpu"`
+	Maintenance bool `json:"maintenance"               yaml:"maintenance"`
+	// ExcludeAnnotation lets the exclude-devices node annotation override
+	// ExcludeDevices
+	ExcludeAnnotation bool `json:"exclude_annotation"        yaml:"exclude_annotation"`
+	// Mode is either ModeDevicePlugin, the default, or ModeDRA
+	Mode string `json:"mode,omitempty"            yaml:"mode,omitempty"`
+	// DebugAddr is the host:port or unix:// socket the debug API listens on,
+	// empty disables it
+	DebugAddr string `json:"debug_addr,omitempty"      yaml:"debug_addr,omitempty"`
 }
 
 type ReplicatedResources struct {
@@ -44,11 +56,125 @@ type Sharing struct {
 	MPS *ReplicatedResources `json:"mps,omitempty"         yaml:"mps,omitempty"`
 }
 
+// DeviceInfo configures the device-info ConfigMap.
+type DeviceInfo struct {
+	// DisableLegacy stops writing the unversioned DeviceInfoCfg key, once all
+	// consumers read the versioned DeviceInfo key.
+	DisableLegacy bool `json:"disableLegacy,omitempty" yaml:"disableLegacy,omitempty"`
+}
+
+// PreStart configures the checks kubelet has the plugin run before a container
+// starts on its devices.
+type PreStart struct {
+	// Enabled makes kubelet call PreStartContainer, a container whose devices
+	// fail the checks is not started
+	Enabled bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// ComputeMode is applied to the devices, ComputeModeDefault or
+	// ComputeModeExclusiveProcess, empty keeps the current one
+	ComputeMode string `json:"computeMode,omitempty" yaml:"computeMode,omitempty"`
+	// ApplicationClocks are the "<memory MHz>,<SM MHz>" clocks applied to the
+	// devices, empty keeps the current ones
+	ApplicationClocks string `json:"applicationClocks,omitempty" yaml:"applicationClocks,omitempty"`
+}
+
+// Clocks parses ApplicationClocks, ok is false if it is not set.
+func (p *PreStart) Clocks() (mem, sm uint, ok bool, err error) {
+	if p.ApplicationClocks == "" {
+		return 0, 0, false, nil
+	}
+	if _, err := fmt.Sscanf(p.ApplicationClocks, "%d,%d", &mem, &sm); err != nil {
+		return 0, 0, false, fmt.Errorf("preStart.applicationClocks must be <memory MHz>,<SM MHz>, got %s.", p.ApplicationClocks)
+	}
+	return mem, sm, true, nil
+}
+
+// ComputeModePolicy configures the compute mode of the devices, which follows
+// the sharing: ComputeModeExclusiveProcess for the gpus allocated whole, and
+// ComputeModeDefault for the time-slicing replicas.
+type ComputeModePolicy struct {
+	// Enforce sets the compute mode of the devices when they are allocated or
+	// free, otherwise a mismatch is only reported
+	Enforce bool `json:"enforce,omitempty" yaml:"enforce,omitempty"`
+}
+
+// Degraded configures the checks of the devices which work below their
+// capabilities: a PCIe link slower than the device supports, a climbing PCIe
+// replay counter, or persistent thermal or power throttling.
+type Degraded struct {
+	// Enabled runs the checks
+	Enabled bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// Action is DegradedActionReport, the default, which lists the degraded
+	// devices in the device-info ConfigMap, or DegradedActionUnhealthy
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+	// ReplaysPerMinute is the PCIe replay rate from which a device is
+	// degraded, DefaultReplaysPerMinute if 0
+	ReplaysPerMinute int `json:"replaysPerMinute,omitempty" yaml:"replaysPerMinute,omitempty"`
+	// ThrottleSeconds is how long a device is throttled before it is
+	// degraded, DefaultThrottleSeconds if 0
+	ThrottleSeconds int `json:"throttleSeconds,omitempty" yaml:"throttleSeconds,omitempty"`
+}
+
+// LeakedProcesses configures the audit of the processes left running on the
+// devices no pod holds.
+type LeakedProcesses struct {
+	// Action is taken on a device running leaked processes until they are
+	// gone, LeakActionReport, the default, LeakActionUnhealthy or
+	// LeakActionReset
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+// Ecc configures when the ECC errors counted on a chip make its device
+// unhealthy. With no limit set, a chip is unhealthy while the driver reports
+// an ECC error in its health.
+type Ecc struct {
+	// UncorrectedLimit is the number of uncorrected errors, over the life of
+	// the chip, from which it is unhealthy, not checked if 0
+	UncorrectedLimit int `json:"uncorrectedLimit,omitempty" yaml:"uncorrectedLimit,omitempty"`
+	// CorrectedPerHour is the number of corrected errors in an hour from which
+	// the chip is unhealthy, not checked if 0
+	CorrectedPerHour int `json:"correctedPerHour,omitempty" yaml:"correctedPerHour,omitempty"`
+}
+
+// Limited tells if any limit is set.
+func (e Ecc) Limited() bool {
+	return e.UncorrectedLimit > 0 || e.CorrectedPerHour > 0
+}
+
+// Gpm configures the profiling metrics sampled with GPM on the devices which
+// support it.
+type Gpm struct {
+	// Enabled runs the sampler
+	Enabled bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// Metrics are the names of the metrics computed, such as GpmSmOccupancy,
+	// DefaultGpmMetrics if empty
+	Metrics []string `json:"metrics,omitempty" yaml:"metrics,omitempty"`
+	// IntervalSeconds between two samples, DefaultGpmIntervalSeconds if 0
+	IntervalSeconds int `json:"intervalSeconds,omitempty" yaml:"intervalSeconds,omitempty"`
+}
+
 // Config is a versioned struct used to hold configuration information.
 type Config struct {
 	ResourceName string  `json:"resourceName"         yaml:"resourceName"`
 	Flags        Flags   `json:"flags,omitempty"     yaml:"flags,omitempty"`
 	Sharing      Sharing `json:"sharing,omitempty"   yaml:"sharing,omitempty"`
+	// ExcludeDevices lists gpus kept out of scheduling, matched by uuid, index,
+	// PCI bus id or serial number.
+	ExcludeDevices []string `json:"excludeDevices,omitempty" yaml:"excludeDevices,omitempty"`
+	// DeviceInfo configures the device-info ConfigMap written for the scheduler.
+	DeviceInfo DeviceInfo `json:"deviceInfo,omitempty" yaml:"deviceInfo,omitempty"`
+	// PreStart configures the checks run before a container starts.
+	PreStart PreStart `json:"preStart,omitempty" yaml:"preStart,omitempty"`
+	// ComputeMode configures the compute mode of the devices.
+	ComputeMode ComputeModePolicy `json:"computeMode,omitempty" yaml:"computeMode,omitempty"`
+	// Degraded configures the checks of the devices working below their
+	// capabilities.
+	Degraded Degraded `json:"degraded,omitempty" yaml:"degraded,omitempty"`
+	// LeakedProcesses configures the audit of the processes of no pod.
+	LeakedProcesses LeakedProcesses `json:"leakedProcesses,omitempty" yaml:"leakedProcesses,omitempty"`
+	// Ecc configures the limits of the ECC errors of the chips.
+	Ecc Ecc `json:"ecc,omitempty" yaml:"ecc,omitempty"`
+	// Gpm configures the profiling metrics of the chips.
+	Gpm Gpm `json:"gpm,omitempty" yaml:"gpm,omitempty"`
 }
 
 func parseConfigFrom(reader io.Reader) (*Config, error) {
@@ -83,6 +209,14 @@ func (f *Flags) UpdateFromCLIFlags(c *cli.Context, flags []cli.Flag) {
 				f.UseVolcano = c.Bool(n)
 			case "reset_gpu":
 				f.ResetGpu = c.Bool(n)
+			case "maintenance":
+				f.Maintenance = c.Bool(n)
+			case "exclude_annotation":
+				f.ExcludeAnnotation = c.Bool(n)
+			case "mode":
+				f.Mode = c.String(n)
+			case "debug_addr":
+				f.DebugAddr = c.String(n)
 			default:
 				panic(fmt.Errorf("unsupported flag type for %v", n))
 			}
@@ -95,12 +229,88 @@ func (c *Config) CheckConfig() error {
 	if c.Sharing.TimeSlicing.Replicas < 0 {
 		return fmt.Errorf("timeSlicing.replicas must be > 0, got %d.", c.Sharing.TimeSlicing.Replicas)
 	}
-	if c.Flags.ResetGpu && c.Sharing.TimeSlicing.Replicas > 0 {
-		return fmt.Errorf("reset_gpu and timeSlicing.replicas cannot be used together.")
+	switch c.Flags.Mode {
+	case "", ModeDevicePlugin:
+	case ModeDRA:
+		if c.Sharing.TimeSlicing.Replicas > 0 {
+			return fmt.Errorf("timeSlicing is not supported in %s mode.", ModeDRA)
+		}
+	default:
+		return fmt.Errorf("mode must be %s or %s, got %s.", ModeDevicePlugin, ModeDRA, c.Flags.Mode)
+	}
+	switch c.PreStart.ComputeMode {
+	case "", ComputeModeDefault, ComputeModeExclusiveProcess:
+	default:
+		return fmt.Errorf("preStart.computeMode must be %s or %s, got %s.", ComputeModeDefault,
+			ComputeModeExclusiveProcess, c.PreStart.ComputeMode)
+	}
+	if c.ComputeMode.Enforce && c.PreStart.ComputeMode != "" {
+		return fmt.Errorf("preStart.computeMode can not be set with computeMode.enforce.")
+	}
+	// the replicas of a gpu run in processes of several containers
+	if c.PreStart.ComputeMode == ComputeModeExclusiveProcess && c.Sharing.TimeSlicing.Replicas > 0 {
+		return fmt.Errorf("preStart.computeMode can not be %s with timeSlicing.replicas.", ComputeModeExclusiveProcess)
+	}
+	if _, _, _, err := c.PreStart.Clocks(); err != nil {
+		return err
+	}
+	switch c.Degraded.Action {
+	case "", DegradedActionReport, DegradedActionUnhealthy:
+	default:
+		return fmt.Errorf("degraded.action must be %s or %s, got %s.", DegradedActionReport,
+			DegradedActionUnhealthy, c.Degraded.Action)
+	}
+	if c.Degraded.ReplaysPerMinute < 0 || c.Degraded.ThrottleSeconds < 0 {
+		return fmt.Errorf("degraded.replaysPerMinute and degraded.throttleSeconds must be >= 0.")
+	}
+	switch c.LeakedProcesses.Action {
+	case "", LeakActionReport, LeakActionUnhealthy:
+	case LeakActionReset:
+		if !c.Flags.ResetGpu {
+			return fmt.Errorf("leakedProcesses.action %s requires flags.reset_gpu.", LeakActionReset)
+		}
+	default:
+		return fmt.Errorf("leakedProcesses.action must be %s, %s or %s, got %s.", LeakActionReport,
+			LeakActionUnhealthy, LeakActionReset, c.LeakedProcesses.Action)
+	}
+	if c.Ecc.UncorrectedLimit < 0 || c.Ecc.CorrectedPerHour < 0 {
+		return fmt.Errorf("ecc.uncorrectedLimit and ecc.correctedPerHour must be >= 0.")
+	}
+	for _, m := range c.Gpm.Metrics {
+		if !slices.Contains(GpmMetrics, m) {
+			return fmt.Errorf("gpm.metrics must be of %s, got %s.", strings.Join(GpmMetrics, ", "), m)
+		}
+	}
+	if c.Gpm.IntervalSeconds < 0 {
+		return fmt.Errorf("gpm.intervalSeconds must be >= 0.")
+	}
+	if c.Flags.DebugAddr != "" && !strings.HasPrefix(c.Flags.DebugAddr, "unix://") {
+		host, _, err := net.SplitHostPort(c.Flags.DebugAddr)
+		if err != nil {
+			return fmt.Errorf("debug_addr must be host:port or unix://path, got %s.", c.Flags.DebugAddr)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("debug_addr must listen on localhost, got %s.", c.Flags.DebugAddr)
+		}
 	}
 	return nil
 }
 
+// LoadConfigFile parses a config file without applying any CLI flag.
+func LoadConfigFile(path string) (*Config, error) {
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	defer reader.Close()
+
+	config, err := parseConfigFrom(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	return config, nil
+}
+
 func LoadConfig(c *cli.Context, flags []cli.Flag) (*Config, error) {
 	reader, err := os.Open(ConfigDirectory)
 	if err != nil {
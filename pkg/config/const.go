@@ -21,3 +21,70 @@ const HostPathPrefix = "/dev/"
 const ContainerPathPrefix = "/dev/"
 const UdevWatcherSubsystem = "iluvatar-sys"
 const ConfigDirectory = "/ixconfig/ix-config"
+
+// HealthSocket is where the plugin answers the healthcheck subcommand
+const HealthSocket = "/var/run/ix-device-plugin/health.sock"
+
+// LedgerFile is where the allocations are recorded, it outlives the plugin
+// and kubelet restarts
+const LedgerFile = "/var/lib/ix-device-plugin/allocations.json"
+
+// EccFile is where the ECC errors counted on the chips are kept, so that a
+// reboot resetting the counters of the driver does not hide a bad chip
+const EccFile = "/var/lib/ix-device-plugin/ecc.json"
+
+const (
+	// ModeDevicePlugin serves the kubelet device plugin API
+	ModeDevicePlugin = "deviceplugin"
+	// ModeDRA serves the kubelet Dynamic Resource Allocation API
+	ModeDRA = "dra"
+)
+
+const (
+	// ComputeModeDefault lets any number of processes share a device
+	ComputeModeDefault = "Default"
+	// ComputeModeExclusiveProcess lets a single process use a device
+	ComputeModeExclusiveProcess = "ExclusiveProcess"
+)
+
+const (
+	// DegradedActionReport lists the degraded devices in the device info
+	DegradedActionReport = "report"
+	// DegradedActionUnhealthy also advertises them unhealthy
+	DegradedActionUnhealthy = "unhealthy"
+
+	DefaultReplaysPerMinute = 100
+	DefaultThrottleSeconds  = 300
+)
+
+const (
+	// LeakActionReport reports the leaked processes of a device
+	LeakActionReport = "report"
+	// LeakActionUnhealthy also keeps the device unhealthy while they run
+	LeakActionUnhealthy = "unhealthy"
+	// LeakActionReset also resets the device
+	LeakActionReset = "reset"
+)
+
+// Names of the GPM metrics, the utilizations are in percent and the PCIe
+// throughputs in MiB per second.
+const (
+	GpmSmUtil       = "sm_util"
+	GpmSmOccupancy  = "sm_occupancy"
+	GpmTensorUtil   = "tensor_util"
+	GpmDramBwUtil   = "dram_bw_util"
+	GpmFp64Util     = "fp64_util"
+	GpmFp32Util     = "fp32_util"
+	GpmFp16Util     = "fp16_util"
+	GpmPcieTxPerSec = "pcie_tx_per_sec"
+	GpmPcieRxPerSec = "pcie_rx_per_sec"
+
+	DefaultGpmIntervalSeconds = 10
+)
+
+// GpmMetrics are all the GPM metrics.
+var GpmMetrics = []string{GpmSmUtil, GpmSmOccupancy, GpmTensorUtil, GpmDramBwUtil, GpmFp64Util, GpmFp32Util,
+	GpmFp16Util, GpmPcieTxPerSec, GpmPcieRxPerSec}
+
+// DefaultGpmMetrics are the GPM metrics computed unless configured.
+var DefaultGpmMetrics = []string{GpmSmOccupancy, GpmTensorUtil, GpmDramBwUtil, GpmPcieTxPerSec, GpmPcieRxPerSec}
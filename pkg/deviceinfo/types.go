@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deviceinfo defines the schema of the device-info ConfigMap written
+// by the device plugin on every node, so that schedulers and other consumers
+// can decode it without depending on the plugin internals.
+package deviceinfo
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// SchemaVersion is the version of NodeDeviceInfo written by the plugin.
+	// Fields are only added within a version, a breaking change bumps it.
+	SchemaVersion = "v1"
+
+	// DataKey is the ConfigMap data key holding the json encoded NodeDeviceInfo.
+	DataKey = "DeviceInfo"
+)
+
+// NodeDeviceInfo describes the gpus of a node.
+type NodeDeviceInfo struct {
+	SchemaVersion string `json:"schemaVersion"`
+	NodeName      string `json:"nodeName"`
+	// UpdateTime is the unix time the info was written
+	UpdateTime int64 `json:"updateTime"`
+	// Devices are the gpus advertised to kubelet, sorted by uuid
+	Devices []Device `json:"devices"`
+	// DegradedDevices work below their capabilities, sorted by uuid. They
+	// are still advertised unless the plugin is configured otherwise.
+	DegradedDevices []DegradedDevice `json:"degradedDevices,omitempty"`
+}
+
+// DegradedDevice is a gpu working below its capabilities.
+type DegradedDevice struct {
+	UUID string `json:"uuid"`
+	// Reasons tell why, such as a PCIe link slower than supported
+	Reasons []string `json:"reasons"`
+}
+
+// Device is a gpu advertised to kubelet, a board with one or more chips.
+type Device struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+	// BoardID is shared by the chips on the same board
+	BoardID uint32 `json:"boardId"`
+	// ChipCount is the number of chips expected on the board
+	ChipCount int `json:"chipCount"`
+	// MemoryTotal of all chips, in MiB
+	MemoryTotal uint64 `json:"memoryTotal"`
+	// NumaNode of the first chip, -1 if not attached to a NUMA node
+	NumaNode int    `json:"numaNode"`
+	Health   Health `json:"health"`
+	// Replicas are the ids advertised to kubelet, one per time-slicing replica
+	Replicas []string `json:"replicas"`
+	// UsedReplicas are the replica ids allocated to active pods
+	UsedReplicas []string `json:"usedReplicas"`
+	Chips        []Chip   `json:"chips"`
+	Links        []Link   `json:"links,omitempty"`
+}
+
+// Chip is a single gpu chip of a board.
+type Chip struct {
+	UUID  string `json:"uuid"`
+	Index uint   `json:"index"`
+	Minor uint   `json:"minor"`
+	// BusID is the PCI bus id in the domain:bus:device.function form
+	BusID string `json:"busId"`
+	// BoardPosition of the chip on its board, -1 if not reported
+	BoardPosition int `json:"boardPosition"`
+	// MemoryTotal in MiB
+	MemoryTotal uint64 `json:"memoryTotal"`
+	// NumaNode is -1 if the chip is not attached to a NUMA node
+	NumaNode int    `json:"numaNode"`
+	Health   Health `json:"health"`
+	// ComputeMode is the compute mode last read from the chip, such as
+	// "ExclusiveProcess", empty if unknown
+	ComputeMode string `json:"computeMode,omitempty"`
+	// ExpectedComputeMode is set when ComputeMode does not match the sharing
+	// of the device
+	ExpectedComputeMode string `json:"expectedComputeMode,omitempty"`
+	// Ecc are the ECC errors counted on the chip, nil if ECC is disabled
+	Ecc *EccErrors `json:"ecc,omitempty"`
+}
+
+// EccErrors counted on a chip since it was first seen by the plugin, across
+// reboots.
+type EccErrors struct {
+	Corrected   uint64 `json:"corrected"`
+	Uncorrected uint64 `json:"uncorrected"`
+	// CorrectedPerHour is the highest of the current and the last hour
+	CorrectedPerHour uint64 `json:"correctedPerHour"`
+}
+
+// Health of a device or chip, Reason is empty while it is healthy.
+type Health struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Link is the P2P link between a device and another device of the node.
+type Link struct {
+	// Target is the uuid of the other device
+	Target string `json:"target"`
+	// Type is the name of the link type, such as "P2PLinkSameBoard"
+	Type      string `json:"type"`
+	TypeIndex int    `json:"typeIndex"`
+}
+
+// Decode parses the value of DataKey, it fails on an unknown schema version.
+func Decode(data string) (*NodeDeviceInfo, error) {
+	var info NodeDeviceInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return nil, fmt.Errorf("unmarshal device info failed: %v", err)
+	}
+	if info.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf("unsupported device info schema version %q", info.SchemaVersion)
+	}
+	return &info, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+const computeModeCheckPeriod = 30 * time.Second
+
+// computeModes keeps the compute mode last read from every chip.
+type computeModes struct {
+	lk      sync.Mutex
+	enforce bool
+	// chip uuid -> compute mode
+	observed map[string]ixml.ComputeMode
+
+	mismatch *metrics.Vec
+}
+
+func newComputeModes(enforce bool, reg *metrics.Registry) *computeModes {
+	return &computeModes{
+		enforce:  enforce,
+		observed: map[string]ixml.ComputeMode{},
+		mismatch: reg.Gauge("compute_mode_mismatch",
+			"Set for a chip whose compute mode does not match the sharing of its device.",
+			"device", "chip", "mode", "expected"),
+	}
+}
+
+// update records the modes read from the chips of devSet. It returns the
+// chips which turned mismatched.
+func (m *computeModes) update(devSet *gpuallocator.DeviceSet, modes map[string]ixml.ComputeMode) []string {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	expected := devSet.ExpectedComputeMode()
+	var mismatched []string
+	m.mismatch.Reset()
+	for _, dev := range devSet.Devices {
+		for uuid := range dev.Chips {
+			mode, ok := modes[uuid]
+			if !ok || mode == expected {
+				continue
+			}
+			m.mismatch.Set(1, dev.UUID, uuid, mode.String(), expected.String())
+			if last, seen := m.observed[uuid]; !seen || last != mode {
+				mismatched = append(mismatched, uuid)
+			}
+		}
+	}
+	m.observed = modes
+	sort.Strings(mismatched)
+	return mismatched
+}
+
+// fill sets the compute modes in the device info.
+func (m *computeModes) fill(devSet *gpuallocator.DeviceSet, info *deviceinfo.NodeDeviceInfo) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	devSet.SetComputeModes(info, m.observed)
+}
+
+// setComputeMode sets the expected compute mode on the chips which are not in
+// it, through backend. The driver may not support changing it, the chips are
+// then left as they are.
+func setComputeMode(backend ixml.Backend, devSet *gpuallocator.DeviceSet, chips []string) {
+	expected := devSet.ExpectedComputeMode()
+	for _, uuid := range chips {
+		_, chip := devSet.FindChip(uuid)
+		if chip == nil {
+			continue
+		}
+		if mode, err := chip.Operations.DeviceGetComputeMode(); err == nil && mode == expected {
+			continue
+		}
+		if err := backend.SetComputeMode(uuid, expected); err != nil {
+			klog.Warningf("Failed to set compute mode %s on chip %s: %v", expected, uuid, err)
+			continue
+		}
+		klog.Infof("Compute mode of chip %s set to %s", uuid, expected)
+	}
+}
+
+func (d *iluvatarDevice) checkComputeModes(ctx context.Context) {
+	klog.Infof("Start to check compute modes, enforce: %v", d.computeModes.enforce)
+
+	ticker := time.NewTicker(computeModeCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		d.checkComputeModesOnce()
+		select {
+		case <-ctx.Done():
+			klog.Info("Stoping compute mode checking")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkComputeModesOnce reads the compute mode of every chip, and with
+// enforcement sets it on the devices no pod holds, the others got theirs when
+// they were allocated.
+func (d *iluvatarDevice) checkComputeModesOnce() {
+	devSet := d.devices.Load()
+	if d.computeModes.enforce {
+		held := d.heldDevices(devSet)
+		var free []string
+		for _, dev := range devSet.Devices {
+			if !held[dev.UUID] {
+				free = append(free, dev.GenerateIDS()...)
+			}
+		}
+		setComputeMode(d.devices.Backend(), devSet, free)
+	}
+
+	modes := devSet.ReadComputeModes()
+	for _, uuid := range d.computeModes.update(devSet, modes) {
+		klog.Warningf("Chip %s runs in compute mode %s, expected %s", uuid, modes[uuid], devSet.ExpectedComputeMode())
+	}
+}
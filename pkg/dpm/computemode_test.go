@@ -0,0 +1,56 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"errors"
+	"testing"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+)
+
+func TestSetComputeMode(t *testing.T) {
+	cfg := &config.Config{}
+	backend := fakeBackend(2)
+	devSet := gpuallocator.BuildDeviceSet(cfg, backend)
+	gpu0, gpu1 := backend.Devices[0].UUID, backend.Devices[1].UUID
+
+	// the driver refuses: the chips are left as they are
+	backend.SetErr = errors.New("not permitted")
+	setComputeMode(backend, devSet, []string{gpu0})
+	if mode, _ := backend.Devices[0].DeviceGetComputeMode(); mode != ixml.ComputeModeDefault {
+		t.Errorf("chip %s in compute mode %s after a failed set", gpu0, mode)
+	}
+
+	backend.SetErr = nil
+	setComputeMode(backend, devSet, []string{gpu0})
+	if mode, _ := backend.Devices[0].DeviceGetComputeMode(); mode != ixml.ComputeModeExclusiveProcess {
+		t.Errorf("chip %s in compute mode %s, want %s", gpu0, mode, ixml.ComputeModeExclusiveProcess)
+	}
+	if mode, _ := backend.Devices[1].DeviceGetComputeMode(); mode != ixml.ComputeModeDefault {
+		t.Errorf("chip %s not asked for in compute mode %s", gpu1, mode)
+	}
+
+	// once set, it reads back as expected
+	modes := devSet.ReadComputeModes()
+	if modes[gpu0] != ixml.ComputeModeExclusiveProcess {
+		t.Errorf("compute mode of chip %s read as %s", gpu0, modes[gpu0])
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	"k8s.io/klog/v2"
+)
+
+// allocation is the devices kubelet allocated to a pod, and the ones Volcano
+// chose for it when they differ.
+type allocation struct {
+	Pod            string   `json:"pod"`
+	Devices        []string `json:"devices"`
+	KubeletDevices []string `json:"kubeletDevices,omitempty"`
+}
+
+// listenDebug listens on a host:port or on a unix:// socket path.
+func listenDebug(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix://")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+// serveDebug starts the debug API, it keeps serving across restarts of the
+// device plugin server until it is closed.
+func (s *server) serveDebug(addr string) (*http.Server, error) {
+	sock, err := listenDebug(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", s.serveDevices)
+	mux.HandleFunc("/allocations", s.serveAllocations)
+	mux.HandleFunc("/ledger", s.serveLedger)
+	mux.HandleFunc("/config", s.serveConfig)
+	mux.Handle("/metrics", s.metrics)
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/readyz", s.serveReadyz)
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		klog.Infof("Starting debug API on %s", addr)
+		if err := srv.Serve(sock); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Debug API on %s failed: %v", addr, err)
+		}
+	}()
+	return srv, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		klog.Warningf("Failed to write debug response: %v", err)
+	}
+}
+
+// hasPodCache tells whether the pods of the node are cached, the debug API
+// falls back to the ledger otherwise.
+func (s *server) hasPodCache() bool {
+	return s.kubeclient != nil && s.kubeclient.HasPodCache()
+}
+
+func (s *server) serveDevices(w http.ResponseWriter, r *http.Request) {
+	var allocated map[string]bool
+	if s.hasPodCache() {
+		allocated = s.GetAllocatedDevicesFromPodCache(false)
+	} else {
+		allocated = s.ledger.heldReplicas()
+	}
+	writeJSON(w, s.nodeDeviceInfo(s.devices.Load(), allocated))
+}
+
+func (s *server) serveAllocations(w http.ResponseWriter, r *http.Request) {
+	podDevice, err := kube.NewPodResource().GetPodResource()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("get pod resource failed: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	// namespace_name -> devices Volcano chose
+	volcano := map[string][]string{}
+	if s.hasPodCache() {
+		for _, pod := range s.kubeclient.GetActivePodListCache() {
+			if devStr, ok := pod.Annotations[kube.ResourceNamePrefix+kube.PodDevRealAlloc]; ok {
+				volcano[pod.Namespace+"_"+pod.Name] = strings.Split(devStr, kube.CommaSepDev)
+			}
+		}
+	} else {
+		for _, e := range s.ledger.snapshot() {
+			if e.Pod != "" && !slices.Equal(e.Replicas, e.KubeletReplicas) {
+				key := strings.Replace(e.Pod, "/", "_", 1)
+				volcano[key] = append(volcano[key], e.Replicas...)
+			}
+		}
+	}
+
+	allocations := []allocation{}
+	for key, dev := range podDevice {
+		if len(dev.DeviceIds) == 0 {
+			continue
+		}
+		// namespaces can not contain an underscore
+		a := allocation{Pod: strings.Replace(key, "_", "/", 1), Devices: dev.DeviceIds}
+		if devs, ok := volcano[key]; ok {
+			a.Devices, a.KubeletDevices = devs, dev.DeviceIds
+		}
+		allocations = append(allocations, a)
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].Pod < allocations[j].Pod
+	})
+	writeJSON(w, allocations)
+}
+
+func (s *server) serveLedger(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.ledger.snapshot())
+}
+
+func (s *server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.devices.Cfg)
+}
+
+func (s *server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if !s.serving.Load() {
+		http.Error(w, "grpc server is not serving", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if !s.serving.Load() {
+		http.Error(w, "grpc server is not serving", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.registered.Load() {
+		http.Error(w, "not registered with kubelet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
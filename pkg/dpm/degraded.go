@@ -0,0 +1,316 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const degradedCheckPeriod = 10 * time.Second
+
+// The replay counter is compared over this window.
+const replayWindow = time.Minute
+
+// Names of the degraded checks, in the check label of the metric.
+const (
+	checkPcieLink        = "pcie_link"
+	checkPcieReplay      = "pcie_replay"
+	checkThermalThrottle = "thermal_throttle"
+	checkPowerThrottle   = "power_throttle"
+)
+
+// chipSample is what a chip reported for the degraded checks, a field is nil
+// when the chip does not report it.
+type chipSample struct {
+	curr, max *ixml.PcieLink
+	replays   *uint
+	throttle  *ixml.ThrottleReasons
+}
+
+func sampleChip(dev ixml.Device) chipSample {
+	var s chipSample
+	if link, err := dev.DeviceGetCurrPcieLink(); err == nil {
+		s.curr = &link
+	}
+	if link, err := dev.DeviceGetMaxPcieLink(); err == nil {
+		s.max = &link
+	}
+	if replays, err := dev.DeviceGetPcieReplayCounter(); err == nil {
+		s.replays = &replays
+	}
+	if reasons, err := dev.DeviceGetCurrentClocksThrottleReasons(); err == nil {
+		s.throttle = &reasons
+	}
+	return s
+}
+
+// chipDegradation is the state of the degraded checks of a chip.
+type chipDegradation struct {
+	device string
+	// replay counter at the start of the window
+	replays   uint
+	replaysAt time.Time
+	// replays counted in the last complete window
+	replayRate uint
+
+	thermalSince time.Time
+	powerSince   time.Time
+
+	// check -> reason, of the failed checks
+	failed map[string]string
+}
+
+// degradation tracks the devices working below their capabilities.
+type degradation struct {
+	lk       sync.Mutex
+	action   string
+	replays  uint
+	throttle time.Duration
+	// chip uuid -> state
+	chips map[string]*chipDegradation
+
+	degraded *metrics.Vec
+}
+
+func newDegradation(cfg config.Degraded, reg *metrics.Registry) *degradation {
+	d := &degradation{
+		action:   cfg.Action,
+		replays:  uint(cfg.ReplaysPerMinute),
+		throttle: time.Duration(cfg.ThrottleSeconds) * time.Second,
+		chips:    map[string]*chipDegradation{},
+		degraded: reg.Gauge("degraded",
+			"Set for a chip failing a degraded check.", "device", "chip", "check"),
+	}
+	if d.action == "" {
+		d.action = config.DegradedActionReport
+	}
+	if d.replays == 0 {
+		d.replays = config.DefaultReplaysPerMinute
+	}
+	if d.throttle == 0 {
+		d.throttle = config.DefaultThrottleSeconds * time.Second
+	}
+	return d
+}
+
+// observe applies the samples of the chips, by uuid. It returns the devices
+// whose degradation changed.
+func (g *degradation) observe(devSet *gpuallocator.DeviceSet, samples map[string]chipSample, now time.Time) []string {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	before := map[string]string{}
+	for _, dev := range devSet.Devices {
+		before[dev.UUID] = g.failedChecksLocked(dev)
+	}
+
+	for uuid := range g.chips {
+		if _, ok := samples[uuid]; !ok {
+			delete(g.chips, uuid)
+		}
+	}
+	for uuid, s := range samples {
+		dev, _ := devSet.FindChip(uuid)
+		if dev == nil {
+			continue
+		}
+		c, ok := g.chips[uuid]
+		if !ok {
+			c = &chipDegradation{}
+			g.chips[uuid] = c
+		}
+		c.device = dev.UUID
+		g.check(c, s, now)
+	}
+
+	g.degraded.Reset()
+	for uuid, c := range g.chips {
+		for check := range c.failed {
+			g.degraded.Set(1, c.device, uuid, check)
+		}
+	}
+
+	var changed []string
+	for _, dev := range devSet.Devices {
+		if g.failedChecksLocked(dev) != before[dev.UUID] {
+			changed = append(changed, dev.UUID)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func (g *degradation) check(c *chipDegradation, s chipSample, now time.Time) {
+	c.failed = map[string]string{}
+
+	// an idle gpu may lower its link generation to save power, not its width
+	idle := s.throttle != nil && *s.throttle&ixml.ThrottleGpuIdle != 0
+	if s.curr != nil && s.max != nil && ((!idle && s.curr.Generation < s.max.Generation) || s.curr.Width < s.max.Width) {
+		c.failed[checkPcieLink] = fmt.Sprintf("PCIe link trained at Gen%d x%d, supports Gen%d x%d",
+			s.curr.Generation, s.curr.Width, s.max.Generation, s.max.Width)
+	}
+
+	if s.replays != nil {
+		switch {
+		case c.replaysAt.IsZero() || *s.replays < c.replays:
+			// first sample, or the driver was reloaded
+			c.replays, c.replaysAt, c.replayRate = *s.replays, now, 0
+		case now.Sub(c.replaysAt) >= replayWindow:
+			c.replayRate = uint(float64(*s.replays-c.replays) / now.Sub(c.replaysAt).Minutes())
+			c.replays, c.replaysAt = *s.replays, now
+		}
+		if c.replayRate >= g.replays {
+			c.failed[checkPcieReplay] = fmt.Sprintf("PCIe replay counter climbs by %d per minute", c.replayRate)
+		}
+	}
+
+	if s.throttle != nil {
+		c.thermalSince = throttledSince(c.thermalSince, *s.throttle&ixml.ThrottleThermal != 0, now)
+		c.powerSince = throttledSince(c.powerSince, *s.throttle&ixml.ThrottlePower != 0, now)
+	}
+	if !c.thermalSince.IsZero() && now.Sub(c.thermalSince) >= g.throttle {
+		c.failed[checkThermalThrottle] = fmt.Sprintf("thermally throttled for %s", now.Sub(c.thermalSince).Round(time.Second))
+	}
+	if !c.powerSince.IsZero() && now.Sub(c.powerSince) >= g.throttle {
+		c.failed[checkPowerThrottle] = fmt.Sprintf("power throttled for %s", now.Sub(c.powerSince).Round(time.Second))
+	}
+}
+
+func throttledSince(since time.Time, throttled bool, now time.Time) time.Time {
+	if !throttled {
+		return time.Time{}
+	}
+	if since.IsZero() {
+		return now
+	}
+	return since
+}
+
+// reasons returns why the chips of dev are degraded, sorted.
+func (g *degradation) reasons(dev *gpuallocator.Device) []string {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	var reasons []string
+	for uuid := range dev.Chips {
+		c, ok := g.chips[uuid]
+		if !ok {
+			continue
+		}
+		for _, reason := range c.failed {
+			reasons = append(reasons, fmt.Sprintf("chip %s: %s", uuid, reason))
+		}
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// failedChecksLocked lists the failed checks of the chips of dev, unlike the
+// reasons they do not change at every sample.
+func (g *degradation) failedChecksLocked(dev *gpuallocator.Device) string {
+	var checks []string
+	for uuid := range dev.Chips {
+		if c, ok := g.chips[uuid]; ok {
+			for check := range c.failed {
+				checks = append(checks, uuid+"/"+check)
+			}
+		}
+	}
+	sort.Strings(checks)
+	return strings.Join(checks, ",")
+}
+
+// keepsUnhealthy tells if dev is kept unhealthy for being degraded.
+func (g *degradation) keepsUnhealthy(dev *gpuallocator.Device) bool {
+	return g.action == config.DegradedActionUnhealthy && len(g.reasons(dev)) > 0
+}
+
+// fill lists the degraded devices in the device info.
+func (g *degradation) fill(devSet *gpuallocator.DeviceSet, info *deviceinfo.NodeDeviceInfo) {
+	for _, dev := range devSet.Devices {
+		if reasons := g.reasons(dev); len(reasons) > 0 {
+			info.DegradedDevices = append(info.DegradedDevices, deviceinfo.DegradedDevice{UUID: dev.UUID, Reasons: reasons})
+		}
+	}
+	sort.Slice(info.DegradedDevices, func(i, j int) bool {
+		return info.DegradedDevices[i].UUID < info.DegradedDevices[j].UUID
+	})
+}
+
+func (d *iluvatarDevice) checkDegraded(ctx context.Context) {
+	klog.Infof("Start to check degraded devices, action: %s", d.degradation.action)
+
+	ticker := time.NewTicker(degradedCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Info("Stoping degraded devices checking")
+			return
+		case <-ticker.C:
+			d.checkDegradedOnce()
+		}
+	}
+}
+
+func (d *iluvatarDevice) checkDegradedOnce() {
+	devSet := d.devices.Load()
+	samples := map[string]chipSample{}
+	for _, dev := range devSet.Devices {
+		for uuid, c := range dev.Chips {
+			samples[uuid] = sampleChip(c.Operations)
+		}
+	}
+
+	changed := d.degradation.observe(devSet, samples, time.Now())
+	if len(changed) == 0 {
+		return
+	}
+
+	for _, uuid := range changed {
+		dev := devSet.Devices[uuid]
+		reasons := d.degradation.reasons(dev)
+		if len(reasons) == 0 {
+			klog.Infof("Device %s is no longer degraded", uuid)
+			d.recordNodeEvent(v1.EventTypeNormal, "GPUNotDegraded", fmt.Sprintf("Device %s is no longer degraded", uuid))
+		} else {
+			message := fmt.Sprintf("Device %s is degraded, %s", uuid, strings.Join(reasons, "; "))
+			klog.Warning(message)
+			d.recordNodeEvent(v1.EventTypeWarning, "GPUDegraded", message)
+		}
+		d.events.Publish(bus.Event{Type: bus.DegradationChanged, Device: uuid, Reason: strings.Join(reasons, "; ")})
+	}
+	if d.degradation.action == config.DegradedActionUnhealthy {
+		d.refreshHealth()
+	}
+}
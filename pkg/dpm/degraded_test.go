@@ -0,0 +1,150 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+)
+
+func TestDegradationCheck(t *testing.T) {
+	link := func(gen, width uint) *ixml.PcieLink {
+		return &ixml.PcieLink{Generation: gen, Width: width}
+	}
+	count := func(n uint) *uint {
+		return &n
+	}
+	reasons := func(r ixml.ThrottleReasons) *ixml.ThrottleReasons {
+		return &r
+	}
+	linkSample := func(curr *ixml.PcieLink, throttle *ixml.ThrottleReasons) chipSample {
+		return chipSample{curr: curr, max: link(4, 16), throttle: throttle}
+	}
+
+	// a sample taken after the first one, and the checks failed from then on
+	type step struct {
+		after  time.Duration
+		sample chipSample
+		failed []string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "link at its capabilities",
+			steps: []step{{sample: linkSample(link(4, 16), reasons(0))}},
+		},
+		{
+			name:  "lower generation while idle",
+			steps: []step{{sample: linkSample(link(3, 16), reasons(ixml.ThrottleGpuIdle))}},
+		},
+		{
+			name:  "lower generation under load",
+			steps: []step{{sample: linkSample(link(3, 16), reasons(0)), failed: []string{checkPcieLink}}},
+		},
+		{
+			name:  "lower generation without throttle reasons",
+			steps: []step{{sample: linkSample(link(3, 16), nil), failed: []string{checkPcieLink}}},
+		},
+		{
+			name: "lower width while idle",
+			steps: []step{{sample: linkSample(link(4, 8), reasons(ixml.ThrottleGpuIdle)),
+				failed: []string{checkPcieLink}}},
+		},
+		{
+			name: "replays over a window",
+			steps: []step{
+				{sample: chipSample{replays: count(100)}},
+				// the window is not over yet
+				{after: 30 * time.Second, sample: chipSample{replays: count(140)}},
+				{after: time.Minute, sample: chipSample{replays: count(112)}, failed: []string{checkPcieReplay}},
+				{after: 90 * time.Second, sample: chipSample{replays: count(113)}, failed: []string{checkPcieReplay}},
+				{after: 2 * time.Minute, sample: chipSample{replays: count(115)}},
+			},
+		},
+		{
+			name: "replays below the rate",
+			steps: []step{
+				{sample: chipSample{replays: count(0)}},
+				{after: time.Minute, sample: chipSample{replays: count(9)}},
+			},
+		},
+		{
+			name: "replay counter reset",
+			steps: []step{
+				{sample: chipSample{replays: count(100)}},
+				{after: time.Minute, sample: chipSample{replays: count(130)}, failed: []string{checkPcieReplay}},
+				// the driver was reloaded, the window starts over
+				{after: 90 * time.Second, sample: chipSample{replays: count(5)}},
+				{after: 150 * time.Second, sample: chipSample{replays: count(12)}},
+			},
+		},
+		{
+			name: "thermal throttle",
+			steps: []step{
+				{sample: chipSample{throttle: reasons(ixml.ThrottleHwThermalSlowdown)}},
+				{after: 30 * time.Second, sample: chipSample{throttle: reasons(ixml.ThrottleSwThermalSlowdown)}},
+				{after: time.Minute, sample: chipSample{throttle: reasons(ixml.ThrottleHwThermalSlowdown)},
+					failed: []string{checkThermalThrottle}},
+				{after: 70 * time.Second, sample: chipSample{throttle: reasons(0)}},
+				// throttled again, counted from now
+				{after: 80 * time.Second, sample: chipSample{throttle: reasons(ixml.ThrottleHwThermalSlowdown)}},
+				{after: 130 * time.Second, sample: chipSample{throttle: reasons(ixml.ThrottleHwThermalSlowdown)}},
+				{after: 140 * time.Second, sample: chipSample{throttle: reasons(ixml.ThrottleHwThermalSlowdown)},
+					failed: []string{checkThermalThrottle}},
+			},
+		},
+		{
+			name: "power throttle",
+			steps: []step{
+				{sample: chipSample{throttle: reasons(ixml.ThrottleSwPowerCap)}},
+				{after: 59 * time.Second, sample: chipSample{throttle: reasons(ixml.ThrottleSwPowerCap)}},
+				{after: time.Minute, sample: chipSample{throttle: reasons(ixml.ThrottleHwPowerBrakeSlowdown | ixml.ThrottleHwThermalSlowdown)},
+					failed: []string{checkPowerThrottle}},
+				{after: 2 * time.Minute, sample: chipSample{throttle: reasons(ixml.ThrottleHwThermalSlowdown)},
+					failed: []string{checkThermalThrottle}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newDegradation(config.Degraded{ReplaysPerMinute: 10, ThrottleSeconds: 60}, metrics.NewRegistry())
+			c := &chipDegradation{}
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			for _, s := range tt.steps {
+				g.check(c, s.sample, start.Add(s.after))
+				var failed []string
+				for check := range c.failed {
+					failed = append(failed, check)
+				}
+				sort.Strings(failed)
+				if !reflect.DeepEqual(failed, s.failed) {
+					t.Errorf("after %s: failed %v, want %v (%v)", s.after, failed, s.failed, c.failed)
+				}
+			}
+		})
+	}
+}
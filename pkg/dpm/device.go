@@ -18,14 +18,19 @@ limitations under the License.
 package dpm
 
 import (
-	"math"
-	"strconv"
+	"fmt"
 	"strings"
 	"time"
 
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -33,120 +38,270 @@ import (
 const deviceName string = "iluvatar"
 const updatePeriod = 5
 
-type iluvatarDevice struct {
-	devSet *gpuallocator.DeviceSet
+// eventBuffer is the number of events a subscriber of the device events may
+// lag behind.
+const eventBuffer = 16
+
+// The driver needs some time after a reset before IXML lists the gpus again.
+var resetSettleTime = 3 * time.Second
 
-	stopCheckHeal chan struct{}
+// gpuResetter resets gpus, the ResetClient does through the reset pod of the
+// node.
+type gpuResetter interface {
+	InitCmInformer()
+	ResetGpus(uuids []string) error
+}
 
-	// kubelet device update notification
-	deviceCh chan *gpuallocator.Device
+type iluvatarDevice struct {
+	// snapshots of the devices, Load one per operation
+	devices *gpuallocator.DeviceStore
 
-	// volcano pod annotation and cm update notification
-	volcanoUpdateCh chan struct{}
+	// changes of the devices, for kubelet, the device info cm and the node
+	// events
+	events *bus.Bus
 
 	kubeclient *kube.KubeClient
 	// reset gpu config
-	resetClient *kube.ResetClient
+	resetClient gpuResetter
+
+	// operator requested drain and reset
+	maintenance *maintenance
+	// replica usage, to reset a shared gpu once all replicas are released
+	occupancy *replicaOccupancy
+	// which container and pod got which devices
+	ledger *allocationLedger
+	// administratively disabled devices
+	exclusion *exclusion
+	// processes running on the devices no pod holds
+	leaks *leakAuditor
+	// compute mode of the chips
+	computeModes *computeModes
+	// devices working below their capabilities, nil unless checked
+	degradation *degradation
+	// ECC errors of the chips
+	ecc *eccCounter
+	// profiling metrics of the chips, nil unless sampled
+	gpm *gpmSampler
+
+	// node condition last published, or found on the node before the first
+	// publication
+	lastCondition *v1.NodeCondition
+
+	// progress of the long-running loops, for the healthcheck subcommand
+	health *health.Tracker
+	// served by the debug API
+	metrics *metrics.Registry
 }
 
 func (d *iluvatarDevice) resetGpusAndDeviceSet(uuids []string) {
-	if d.devSet.Cfg.Flags.ResetGpu && d.resetClient != nil {
-		err := d.resetClient.ResetGpus(uuids)
-		if err != nil {
-			klog.Errorf("Reset gpus failed: %v", err)
-		} else {
-			klog.Infof("Reset gpus success")
-		}
-		// Wait for GPU reset to fully complete before rebuilding DeviceSet
-		time.Sleep(3 * time.Second)
-		d.devSet = gpuallocator.BuildDeviceSet(d.devSet.Cfg)
-		d.notifyNodeResourceUpdate(nil)
+	if d.devices.Cfg.Flags.ResetGpu && d.resetClient != nil {
+		d.resetGpus(uuids)
+	}
+}
+
+func (d *iluvatarDevice) resetGpus(uuids []string) error {
+	d.events.Publish(bus.Event{Type: bus.ResetStarted, Chips: uuids})
+	finished := bus.Event{Type: bus.ResetFinished, Chips: uuids}
+
+	err := d.resetClient.ResetGpus(uuids)
+	if err != nil {
+		klog.Errorf("Reset gpus failed: %v", err)
+		finished.Reason = err.Error()
+	} else {
+		klog.Infof("Reset gpus success")
+	}
+	// Wait for GPU reset to fully complete before rebuilding DeviceSet
+	time.Sleep(resetSettleTime)
+	if rerr := d.devices.Rescan(); rerr != nil {
+		klog.Errorf("Rebuild devices after reset failed: %v", rerr)
+	}
+	finished.Version = d.devices.Load().Version
+	d.events.Publish(finished)
+
+	return err
+}
+
+func (d *iluvatarDevice) onNodeUpdate(node *v1.Node) {
+	if d.exclusion.onNodeUpdate(node) {
+		d.events.Publish(bus.Event{Type: bus.ConfigReloaded, Reason: "exclude-devices node annotation changed"})
+	}
+	if d.maintenance != nil {
+		d.maintenance.onNodeUpdate(node)
 	}
 }
 
-func (d *iluvatarDevice) notifyVolcanoUpdate() {
+func (d *iluvatarDevice) recordNodeEvent(eventType, reason, message string) {
 	if d.kubeclient != nil {
-		d.volcanoUpdateCh <- struct{}{}
+		d.kubeclient.RecordNodeEvent(eventType, reason, message)
 	}
 }
 
-func (d *iluvatarDevice) notifyNodeResourceUpdate(dev *gpuallocator.Device) {
-	if dev == nil {
-		// full update
-		d.deviceCh <- &gpuallocator.Device{Replicas: -1}
-	} else {
-		d.deviceCh <- dev
+// adminUnhealthy keeps devices unhealthy which are excluded, drained, running
+// leaked processes or degraded, whatever their chips report. It is the
+// override of the device store. A device pending reset only gets no new
+// allocation, its replicas still in use stay healthy.
+func (d *iluvatarDevice) adminUnhealthy(dev *gpuallocator.Device) bool {
+	excluded := d.updateExclusion(dev)
+	drained := d.maintenance != nil && d.maintenance.isDrained(dev)
+	leaking := d.leaks != nil && d.leaks.keepsUnhealthy(dev)
+	degraded := d.degradation != nil && d.degradation.keepsUnhealthy(dev)
+	failing := d.ecc != nil && d.ecc.exceeds(dev) != ""
+	return excluded || drained || leaking || degraded || failing
+}
+
+// refreshHealth applies a change of the operator decisions to the devices.
+func (d *iluvatarDevice) refreshHealth() {
+	for _, dev := range d.devices.ApplyHealth(nil) {
+		klog.Infof("Device %s is %s: %s", dev.UUID, dev.Exposed[0].Health, d.healthReason(dev))
 	}
 }
 
-func (d *iluvatarDevice) checkHealth() {
-	klog.Infof("Start to GPU health checking.")
+// healthReason tells why dev is not advertised as healthy, the operator
+// decisions first and then the errors reported by its chips.
+func (d *iluvatarDevice) healthReason(dev *gpuallocator.Device) string {
+	if reason := d.exclusion.excludeReason(dev.UUID); reason != "" {
+		return reason
+	}
+	if d.maintenance != nil && d.maintenance.isDrained(dev) {
+		return "drained by operator request"
+	}
+	if d.leaks != nil && d.leaks.keepsUnhealthy(dev) {
+		return "runs leaked processes, " + d.leaks.leakReason(dev)
+	}
+	if d.degradation != nil && d.degradation.keepsUnhealthy(dev) {
+		return "degraded, " + strings.Join(d.degradation.reasons(dev), "; ")
+	}
+	if d.ecc != nil {
+		if reason := d.ecc.exceeds(dev); reason != "" {
+			return reason
+		}
+	}
+	return dev.HealthReason()
+}
 
-	d.devSet.Lk.Lock()
-	LastCount := d.devSet.Count
-	CurrentCount := d.devSet.Count
-	d.devSet.Lk.Unlock()
+func (d *iluvatarDevice) checkHealth(ctx context.Context) {
+	klog.Infof("Start to GPU health checking.")
 
+	// uuids of the chips fallen off the bus at the last check
+	lost := map[string]bool{}
 	for {
+		d.health.Beat("checkHealth")
 		select {
-		case <-d.stopCheckHeal:
+		case <-ctx.Done():
 			klog.Info("Stoping GPU health checking")
+			d.health.Forget("checkHealth")
 
 			return
-		default:
+		case <-time.After(5 * time.Second):
 		}
-		time.Sleep(5 * time.Second)
-		for _, dev := range d.devSet.Devices {
-			for _, c := range dev.Chips {
-				health, err := c.Operations.DeviceGetHealth()
-				herr := ixml.CheckDeviceError(health)
-				if err != nil {
-					klog.Warningf("Unhealthy: dev:%v   err:%v\n", c.Device.ID, err)
-					c.Health = pluginapi.Unhealthy
-				} else if len(herr) > 0 {
-					c.Health = pluginapi.Unhealthy
-					klog.Warningf("Unhealthy Error Collection: dev:%v\n", c.Device.ID)
-					for i, e := range herr {
-						klog.Warningf("  Error(%d): %v\n", i, e)
-					}
-				} else {
-					c.Health = pluginapi.Healthy
+		lost = d.checkChips(lost)
+	}
+}
+
+// checkChips reads the health of every chip and applies it to the devices.
+// The devices are rescanned when a chip not lost at the last check, in lost,
+// is lost; it returns the chips lost now.
+func (d *iluvatarDevice) checkChips(lost map[string]bool) map[string]bool {
+	// chip uuid -> reason, of all unhealthy chips
+	unhealthy := map[string]string{}
+	event := gpuallocator.HealthEvent{}
+	devSet := d.devices.Load()
+	d.ecc.observe(devSet, devSet.ReadEccErrors(), time.Now())
+	nowLost := map[string]bool{}
+	for _, dev := range devSet.Devices {
+		for _, c := range dev.Chips {
+			health, err := c.Operations.DeviceGetHealth()
+			if ixml.IsNotSupported(err) {
+				// a driver without health reporting holds nothing
+				// against the chip
+				health, err = 0, nil
+			}
+			herr := d.ecc.healthErrors(c.UUID, ixml.CheckDeviceError(health))
+			if err != nil {
+				klog.Warningf("Unhealthy: dev:%v   err:%v\n", c.Device.ID, err)
+				if ixml.IsGPULost(err) {
+					nowLost[c.UUID] = true
+				}
+				event[c.UUID] = gpuallocator.ChipHealth{Health: pluginapi.Unhealthy, Reason: err.Error()}
+				unhealthy[c.UUID] = err.Error()
+			} else if len(herr) > 0 {
+				klog.Warningf("Unhealthy Error Collection: dev:%v\n", c.Device.ID)
+				for i, e := range herr {
+					klog.Warningf("  Error(%d): %v\n", i, e)
 				}
+				reason := ixml.JoinDeviceErrors(herr)
+				event[c.UUID] = gpuallocator.ChipHealth{Health: pluginapi.Unhealthy, Reason: reason}
+				unhealthy[c.UUID] = reason
+			} else {
+				event[c.UUID] = gpuallocator.ChipHealth{Health: pluginapi.Healthy}
 			}
-			if dev.UpdateHealth() {
-				d.notifyNodeResourceUpdate(dev)
-				d.notifyVolcanoUpdate()
+		}
+	}
+	// excluded or drained devices stay unhealthy through the store override
+	for _, dev := range d.devices.ApplyHealth(event) {
+		d.reportHealthTransition(dev, unhealthy)
+	}
+	d.updateHealthCondition(unhealthy)
+
+	// the handles of a lost chip are stale, even if it comes back
+	for uuid := range nowLost {
+		if !lost[uuid] {
+			klog.Warningf("Chip %s is lost, rescan the devices", uuid)
+			if err := d.devices.Rescan(); err != nil {
+				klog.Errorf("Rescan devices failed: %v", err)
 			}
+			break
 		}
+	}
+	return nowLost
+}
 
-		d.devSet.Lk.Lock()
-		CurrentCount = d.devSet.Count
-		d.devSet.Lk.Unlock()
-		if CurrentCount != LastCount {
-			d.notifyNodeResourceUpdate(nil)
-			d.notifyVolcanoUpdate()
-			LastCount = CurrentCount
+// reportDeviceEvents records the devices added to or removed from the node.
+func (d *iluvatarDevice) reportDeviceEvents(ctx context.Context) {
+	sub := d.events.Subscribe("node events", eventBuffer, bus.DeviceAdded, bus.DeviceRemoved)
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-sub.C:
+			d.reportHotplug(event)
 		}
 	}
 }
 
-func (d *iluvatarDevice) updateDeviceinfo() {
+func (d *iluvatarDevice) updateDeviceinfo(ctx context.Context) {
 	klog.Infof("Start to update deviceinfo.")
 
 	ticker := time.NewTicker(updatePeriod * time.Second)
 	defer ticker.Stop()
 
+	sub := d.events.Subscribe("device info", eventBuffer, bus.DeviceAdded, bus.DeviceRemoved,
+		bus.HealthChanged, bus.Allocated, bus.Released, bus.ResetFinished, bus.ConfigReloaded,
+		bus.DegradationChanged)
+	defer sub.Close()
+
+	d.updatingDeviceinfo(true)
+	d.health.Beat("updateDeviceinfo")
 	for {
 		select {
-		case <-d.stopCheckHeal:
+		case <-ctx.Done():
 			klog.Info("Stoping update deviceinfo")
+			d.health.Forget("updateDeviceinfo")
 
 			return
 		case <-ticker.C:
 			d.updatingDevicelist(false)
-		case <-d.volcanoUpdateCh:
+		case <-sub.C:
+			// the cm is written from the latest state, once for all the
+			// pending events
+			for len(sub.C) > 0 {
+				<-sub.C
+			}
 			d.updatingDeviceinfo(true)
 		}
+		d.health.Beat("updateDeviceinfo")
 	}
 }
 
@@ -193,7 +348,7 @@ func (d *iluvatarDevice) updatingDevicelist(verbose bool) {
 	devices := []string{}
 	allocated := d.GetAllocatedDevicesFromPodCache(verbose)
 
-	for _, dev := range d.devSet.Devices {
+	for _, dev := range d.devices.Load().Devices {
 		for _, rdev := range dev.Exposed {
 			if !allocated[rdev.ID] && rdev.Health == pluginapi.Healthy {
 				devices = append(devices, rdev.ID)
@@ -206,6 +361,17 @@ func (d *iluvatarDevice) updatingDevicelist(verbose bool) {
 	}
 }
 
+// nodeDeviceInfo describes the devices with what the plugin observed of them.
+func (d *iluvatarDevice) nodeDeviceInfo(devSet *gpuallocator.DeviceSet, allocated map[string]bool) *deviceinfo.NodeDeviceInfo {
+	info := devSet.NodeDeviceInfo(allocated, d.healthReason)
+	d.computeModes.fill(devSet, info)
+	d.ecc.fill(info)
+	if d.degradation != nil {
+		d.degradation.fill(devSet, info)
+	}
+	return info
+}
+
 func (d *iluvatarDevice) updatingDeviceinfo(verbose bool) {
 
 	d.updatePodAnnotation(verbose)
@@ -213,8 +379,10 @@ func (d *iluvatarDevice) updatingDeviceinfo(verbose bool) {
 	deviceinfomap := map[string]kube.DeviceInfo{}
 	devices := []string{}
 	allocated := d.GetAllocatedDevicesFromPodCache(verbose)
+	devSet := d.devices.Load()
+	info := d.nodeDeviceInfo(devSet, allocated)
 
-	for _, dev := range d.devSet.Devices {
+	for _, dev := range devSet.Devices {
 		for _, rdev := range dev.Exposed {
 			if !allocated[rdev.ID] && rdev.Health == pluginapi.Healthy {
 				devices = append(devices, rdev.ID)
@@ -222,9 +390,10 @@ func (d *iluvatarDevice) updatingDeviceinfo(verbose bool) {
 		}
 
 		deviceinfo := kube.DeviceInfo{
-			Name:  dev.Name,
-			UUID:  dev.UUID,
-			Links: map[string][]kube.P2PLink{},
+			Name:          dev.Name,
+			UUID:          dev.UUID,
+			Links:         map[string][]kube.P2PLink{},
+			ExcludeReason: d.exclusion.excludeReason(dev.UUID),
 		}
 
 		for uuid, links := range dev.Links {
@@ -238,7 +407,10 @@ func (d *iluvatarDevice) updatingDeviceinfo(verbose bool) {
 		}
 		deviceinfomap[dev.UUID] = deviceinfo
 	}
-	err := d.kubeclient.WriteDeviceInfoDataIntoCM(devices, deviceinfomap, verbose)
+	if d.devices.Cfg.DeviceInfo.DisableLegacy {
+		deviceinfomap = nil
+	}
+	err := d.kubeclient.WriteDeviceInfoDataIntoCM(devices, info, deviceinfomap, verbose)
 	if err != nil {
 		klog.Errorf("failed to write deviceinfo to configmap: %v", err)
 	}
@@ -271,23 +443,28 @@ func (d *iluvatarDevice) GetAllocatedDevicesFromPodCache(verbose bool) map[strin
 	return allocated
 }
 
-func (d *iluvatarDevice) UseVolcano(devices []string) ([]string, bool) {
-	pod, err := d.kubeclient.GetMatchedPod(devices)
+// UseVolcano returns the binding of the Volcano container kubelet allocates
+// devices to. It fails if the request can not be matched to exactly one
+// Volcano pod. The pod is left untouched, see BindVolcano.
+func (d *iluvatarDevice) UseVolcano(devices []string) (*kube.VolcanoBinding, error) {
+	binding, err := d.kubeclient.MatchVolcanoPod(v1.ResourceName(ResourceName), devices)
 	if err != nil {
-		klog.Errorf("Failed to get matched pod: %v", err)
-		return devices, false
-	} else {
-		annotations := map[string]string{
-			kube.PodPredicateTime: strconv.FormatUint(math.MaxUint64, 10),
-		}
-		d.kubeclient.TryUpdatePodCacheAnnotation(pod, annotations)
-
-		vDevs, ok := pod.Annotations[kube.ResourceNamePrefix+kube.PodDevVolcano]
-		if ok {
-			return strings.Split(vDevs, kube.CommaSepDev), true
-		} else {
-			klog.Errorf("Failed to get volcano devices from pod %s", pod.Name)
-			return devices, false
+		return nil, fmt.Errorf("failed to match volcano pod: %v", err)
+	}
+
+	klog.Infof("Devices %v matched volcano pod %s/%s(%s) container %s, volcano devices %v", devices,
+		binding.Pod.Namespace, binding.Pod.Name, binding.Pod.UID, binding.Container, binding.Devices)
+	return binding, nil
+}
+
+// BindVolcano records the containers of bindings as allocated, once the
+// allocation can no longer fail: a bound pod is not matched again.
+func (d *iluvatarDevice) BindVolcano(bindings []*kube.VolcanoBinding) error {
+	for _, binding := range bindings {
+		if err := d.kubeclient.BindVolcanoContainer(binding); err != nil {
+			return fmt.Errorf("failed to bind volcano pod %s/%s: %v", binding.Pod.Namespace,
+				binding.Pod.Name, err)
 		}
 	}
+	return nil
 }
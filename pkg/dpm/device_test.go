@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	goixml "gitee.com/deep-spark/go-ixml/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestCheckChips(t *testing.T) {
+	dir := t.TempDir()
+	backend := fakeBackend(3)
+	gpu0, gpu1, gpu2 := backend.Devices[0].UUID, backend.Devices[1].UUID, backend.Devices[2].UUID
+	// a driver without health reporting
+	backend.Devices[0].HealthErr = &ixml.Error{Op: "get health of gpu", Return: goixml.ERROR_NOT_SUPPORTED}
+	s := newServerFor(&config.Config{}, health.NewTracker(nil), backend,
+		filepath.Join(dir, "allocations.json"), filepath.Join(dir, "ecc.json"))
+
+	lost := s.checkChips(map[string]bool{})
+	set := s.devices.Load()
+	for _, uuid := range []string{gpu0, gpu1, gpu2} {
+		if dev := set.Devices[uuid]; dev == nil || dev.Exposed[0].Health != pluginapi.Healthy {
+			t.Errorf("device %s is not healthy: %+v", uuid, dev)
+		}
+	}
+	if len(lost) != 0 {
+		t.Errorf("lost %v, want none", lost)
+	}
+
+	// the chip falls off the bus: its handle is stale, the devices are
+	// rescanned without it
+	backend.Devices[1].Err = &ixml.Error{Op: "get health of gpu", Return: goixml.ERROR_GPU_IS_LOST}
+	lost = s.checkChips(lost)
+	if want := map[string]bool{gpu1: true}; !reflect.DeepEqual(lost, want) {
+		t.Errorf("lost %v, want %v", lost, want)
+	}
+	set = s.devices.Load()
+	if dev := set.Devices[gpu1]; dev != nil {
+		t.Errorf("lost device %s not rescanned: %+v", gpu1, dev)
+	}
+	for _, uuid := range []string{gpu0, gpu2} {
+		if dev := set.Devices[uuid]; dev == nil || dev.Exposed[0].Health != pluginapi.Healthy {
+			t.Errorf("device %s is not healthy after the rescan: %+v", uuid, dev)
+		}
+	}
+
+	// back on the bus, the next rescan finds it
+	backend.Devices[1].Err = nil
+	if err := s.devices.Rescan(); err != nil {
+		t.Fatalf("rescan failed: %v", err)
+	}
+	if lost = s.checkChips(lost); len(lost) != 0 {
+		t.Errorf("lost %v, want none", lost)
+	}
+	if dev := s.devices.Load().Devices[gpu1]; dev == nil || dev.Exposed[0].Health != pluginapi.Healthy {
+		t.Errorf("device %s is not healthy once back: %+v", gpu1, dev)
+	}
+}
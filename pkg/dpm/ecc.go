@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ecc"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+	"k8s.io/klog/v2"
+)
+
+// eccCounter counts the ECC errors of the chips, and checks them against the
+// limits.
+type eccCounter struct {
+	store  *ecc.Store
+	limits config.Ecc
+
+	corrected   *metrics.Vec
+	uncorrected *metrics.Vec
+	perHour     *metrics.Vec
+}
+
+func newEccCounter(store *ecc.Store, limits config.Ecc, reg *metrics.Registry) *eccCounter {
+	return &eccCounter{
+		store:  store,
+		limits: limits,
+		corrected: reg.Counter("ecc_corrected_errors_total",
+			"Corrected ECC errors counted on a chip, across reboots.", "device", "chip"),
+		uncorrected: reg.Counter("ecc_uncorrected_errors_total",
+			"Uncorrected ECC errors counted on a chip, across reboots.", "device", "chip"),
+		perHour: reg.Gauge("ecc_corrected_errors_per_hour",
+			"Corrected ECC errors counted on a chip in the current or the last hour, the highest.",
+			"device", "chip"),
+	}
+}
+
+// observe counts the ECC errors read from the chips of devSet, by chip uuid.
+func (e *eccCounter) observe(devSet *gpuallocator.DeviceSet, counts map[string]ixml.EccCounts, now time.Time) {
+	e.corrected.Reset()
+	e.uncorrected.Reset()
+	e.perHour.Reset()
+	for _, dev := range devSet.Devices {
+		for uuid := range dev.Chips {
+			c, ok := counts[uuid]
+			if !ok {
+				continue
+			}
+			r := e.store.Observe(uuid, c, now)
+			e.corrected.Set(float64(r.Corrected), dev.UUID, uuid)
+			e.uncorrected.Set(float64(r.Uncorrected), dev.UUID, uuid)
+			e.perHour.Set(float64(r.CorrectedPerHour()), dev.UUID, uuid)
+		}
+	}
+	if err := e.store.Save(); err != nil {
+		klog.Errorf("Failed to save the ECC errors: %v", err)
+	}
+}
+
+// healthErrors replaces the ECC error bit of the health of a chip by the
+// limits, when any is set.
+func (e *eccCounter) healthErrors(uuid string, herr []error) []error {
+	if !e.limits.Limited() {
+		return herr
+	}
+
+	var errs []error
+	for _, err := range herr {
+		if err != ixml.HealthECCError {
+			errs = append(errs, err)
+		}
+	}
+	if r, ok := e.store.Get(uuid); ok {
+		reason := r.Exceeds(uint64(e.limits.UncorrectedLimit), uint64(e.limits.CorrectedPerHour))
+		if reason != "" {
+			errs = append(errs, errors.New(reason))
+		}
+	}
+	return errs
+}
+
+// exceeds tells which chips of dev exceed the limits with the errors counted
+// so far, empty if none does. It keeps the device unhealthy in every snapshot,
+// from the first one after a restart or a rescan to the next health check.
+func (e *eccCounter) exceeds(dev *gpuallocator.Device) string {
+	if !e.limits.Limited() {
+		return ""
+	}
+
+	var reasons []string
+	for uuid := range dev.Chips {
+		r, ok := e.store.Get(uuid)
+		if !ok {
+			continue
+		}
+		if reason := r.Exceeds(uint64(e.limits.UncorrectedLimit), uint64(e.limits.CorrectedPerHour)); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("chip %s: %s", uuid, reason))
+		}
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
+
+// fill sets the ECC errors of the chips in the device info.
+func (e *eccCounter) fill(info *deviceinfo.NodeDeviceInfo) {
+	errs := map[string]deviceinfo.EccErrors{}
+	for i := range info.Devices {
+		for _, chip := range info.Devices[i].Chips {
+			if r, ok := e.store.Get(chip.UUID); ok {
+				errs[chip.UUID] = r.Errors()
+			}
+		}
+	}
+	gpuallocator.SetEccErrors(info, errs)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestEccLimitsSurviveRestartAndRescan(t *testing.T) {
+	dir := t.TempDir()
+	gpu0 := "GPU-00000000-0000-0000-0000-000000000000"
+	gpu1 := "GPU-00000000-0000-0000-0000-000000000001"
+	eccFile := filepath.Join(dir, "ecc.json")
+	if err := os.WriteFile(eccFile, []byte(`{"`+gpu0+`": {"uncorrected": 3}}`), 0644); err != nil {
+		t.Fatalf("write ECC records failed: %v", err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Ecc.UncorrectedLimit = 2
+	s := newServerFor(cfg, health.NewTracker(nil), fakeBackend(2), filepath.Join(dir, "allocations.json"), eccFile)
+
+	check := func(when string) {
+		devs := s.devices.Load().Devices
+		if got := devs[gpu0].Exposed[0].Health; got != pluginapi.Unhealthy {
+			t.Errorf("%s: %s over the uncorrected limit is %s", when, gpu0, got)
+		}
+		if reason := s.healthReason(devs[gpu0]); !strings.Contains(reason, "uncorrected ECC errors") {
+			t.Errorf("%s: %s unhealthy for %q", when, gpu0, reason)
+		}
+		if got := devs[gpu1].Exposed[0].Health; got != pluginapi.Healthy {
+			t.Errorf("%s: %s is %s", when, gpu1, got)
+		}
+	}
+	check("first snapshot")
+	if err := s.devices.Rescan(); err != nil {
+		t.Fatalf("rescan failed: %v", err)
+	}
+	check("after a rescan")
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// podsUsingDevice returns the pods the ledger binds to any replica of dev.
+func (d *iluvatarDevice) podsUsingDevice(dev *gpuallocator.Device) []v1.Pod {
+	ids := map[string]bool{}
+	for _, rdev := range dev.Exposed {
+		ids[rdev.ID] = true
+	}
+
+	seen := map[string]bool{}
+	var pods []v1.Pod
+	for _, e := range d.ledger.snapshot() {
+		if e.Pod == "" || seen[e.Pod] {
+			continue
+		}
+		uses := false
+		for _, id := range e.Replicas {
+			uses = uses || ids[id]
+		}
+		if !uses {
+			continue
+		}
+		seen[e.Pod] = true
+		namespace, name, _ := strings.Cut(e.Pod, "/")
+		pods = append(pods, v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			UID:       types.UID(e.PodUID),
+		}})
+	}
+	return pods
+}
+
+// reportHotplug records the chips added to or removed from the node.
+func (d *iluvatarDevice) reportHotplug(event bus.Event) {
+	if d.kubeclient == nil {
+		return
+	}
+
+	chips := strings.Join(event.Chips, ", ")
+	if event.Type == bus.DeviceAdded {
+		d.kubeclient.RecordNodeEvent(v1.EventTypeNormal, "GPUAdded",
+			fmt.Sprintf("Chips %s of device %s were added", chips, event.Device))
+		return
+	}
+	d.kubeclient.RecordNodeEvent(v1.EventTypeWarning, "GPURemoved",
+		fmt.Sprintf("Chips %s of device %s were removed", chips, event.Device))
+}
+
+// reportHealthTransition records events against the node, and against the
+// pods using dev when it turned unhealthy, with the reasons of its chips.
+// Devices disabled by an operator are reported where they are disabled.
+func (d *iluvatarDevice) reportHealthTransition(dev *gpuallocator.Device, unhealthy map[string]string) {
+	if d.kubeclient == nil {
+		return
+	}
+
+	if dev.Exposed[0].Health == pluginapi.Healthy {
+		d.kubeclient.RecordNodeEvent(v1.EventTypeNormal, "GPUHealthy",
+			fmt.Sprintf("Device %s is healthy", dev.UUID))
+		return
+	}
+
+	var reasons []string
+	for uuid := range dev.Chips {
+		if reason, ok := unhealthy[uuid]; ok {
+			reasons = append(reasons, fmt.Sprintf("chip %s: %s", uuid, reason))
+		}
+	}
+	if len(reasons) == 0 {
+		if dev.IsMulChip && len(dev.Chips) != 2 {
+			reasons = append(reasons, "chips of the board are missing")
+		} else {
+			return
+		}
+	}
+	sort.Strings(reasons)
+
+	message := fmt.Sprintf("Device %s is unhealthy, %s", dev.UUID, strings.Join(reasons, "; "))
+	d.kubeclient.RecordNodeEvent(v1.EventTypeWarning, "GPUUnhealthy", message)
+
+	for _, pod := range d.podsUsingDevice(dev) {
+		klog.Warningf("Pod %s/%s uses unhealthy device %s", pod.Namespace, pod.Name, dev.UUID)
+		d.kubeclient.RecordPodEvent(&pod, v1.EventTypeWarning, "GPUUnhealthy", message)
+	}
+}
+
+// updateHealthCondition publishes the unhealthy chips in the node condition,
+// the node is only patched when the list changed.
+func (d *iluvatarDevice) updateHealthCondition(unhealthy map[string]string) {
+	if d.kubeclient == nil {
+		return
+	}
+
+	var uuids []string
+	for uuid := range unhealthy {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	current := strings.Join(uuids, kube.CommaSepDev)
+
+	now := metav1.Now()
+	condition := v1.NodeCondition{
+		Type:               kube.NodeConditionGPUHealthy,
+		Status:             v1.ConditionTrue,
+		Reason:             "GPUsHealthy",
+		Message:            "All iluvatar GPUs are healthy",
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+	}
+	if len(uuids) > 0 {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = "GPUsUnhealthy"
+		condition.Message = "Unhealthy iluvatar GPUs: " + current
+	}
+
+	last := d.lastCondition
+	if last == nil {
+		// keep the transition time of the condition set before a restart
+		var err error
+		if last, err = d.kubeclient.GetNodeCondition(kube.NodeConditionGPUHealthy); err != nil {
+			klog.Warningf("Failed to get node condition: %v", err)
+		}
+	} else if last.Message == condition.Message {
+		return
+	}
+	if last != nil && last.Status == condition.Status {
+		condition.LastTransitionTime = last.LastTransitionTime
+	}
+
+	if err := d.kubeclient.TryUpdateNodeCondition(condition); err != nil {
+		klog.Errorf("Failed to update node condition: %v", err)
+		return
+	}
+	d.lastCondition = &condition
+}
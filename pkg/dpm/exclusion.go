@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// exclusion keeps administratively disabled devices out of scheduling. The
+// list comes from the config, and is replaced by the iluvatar.com/exclude-devices
+// node annotation while the annotation is present.
+type exclusion struct {
+	lk sync.Mutex
+
+	configured  []string
+	override    []string
+	hasOverride bool
+
+	// device uuid -> reason, of the devices currently excluded
+	excluded map[string]string
+}
+
+func newExclusion(configured []string) *exclusion {
+	return &exclusion{
+		configured: configured,
+		excluded:   map[string]string{},
+	}
+}
+
+// onNodeUpdate reads the annotation of node, and returns true if the list of
+// excluded devices changed.
+func (e *exclusion) onNodeUpdate(node *v1.Node) bool {
+	value, ok := node.Annotations[kube.ResourceNamePrefix+kube.NodeExcludeDevices]
+
+	var override []string
+	for _, id := range strings.Split(value, kube.CommaSepDev) {
+		if id = strings.TrimSpace(id); id != "" {
+			override = append(override, id)
+		}
+	}
+
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	changed := ok != e.hasOverride || !reflect.DeepEqual(override, e.override)
+	e.hasOverride = ok
+	e.override = override
+	return changed
+}
+
+// reason returns why dev is excluded, or an empty string if it is not.
+func (e *exclusion) reason(dev *gpuallocator.Device) string {
+	e.lk.Lock()
+	ids, source := e.configured, "config"
+	if e.hasOverride {
+		ids, source = e.override, "node annotation"
+	}
+	e.lk.Unlock()
+
+	for _, id := range ids {
+		for _, c := range dev.Chips {
+			if attr, ok := c.MatchID(id); ok {
+				return fmt.Sprintf("excluded by %s, %s %s matches chip %s", source, attr, id, c.UUID)
+			}
+		}
+	}
+	return ""
+}
+
+func (e *exclusion) excludeReason(uuid string) string {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	return e.excluded[uuid]
+}
+
+// updateExclusion records whether dev is excluded, and returns true if it is.
+// The chip health is not able to recover an excluded device.
+func (d *iluvatarDevice) updateExclusion(dev *gpuallocator.Device) bool {
+	e := d.exclusion
+	reason := e.reason(dev)
+
+	e.lk.Lock()
+	old, wasExcluded := e.excluded[dev.UUID]
+	if reason == "" {
+		delete(e.excluded, dev.UUID)
+	} else {
+		e.excluded[dev.UUID] = reason
+	}
+	e.lk.Unlock()
+
+	if reason == "" {
+		if wasExcluded {
+			klog.Infof("Device %s is no longer excluded", dev.UUID)
+			d.recordNodeEvent(v1.EventTypeNormal, "DeviceIncluded",
+				fmt.Sprintf("Device %s is no longer excluded", dev.UUID))
+		}
+		return false
+	}
+
+	if !wasExcluded || old != reason {
+		klog.Warningf("Device %s %s", dev.UUID, reason)
+		d.recordNodeEvent(v1.EventTypeWarning, "DeviceExcluded",
+			fmt.Sprintf("Device %s %s", dev.UUID, reason))
+	}
+	return true
+}
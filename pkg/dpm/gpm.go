@@ -0,0 +1,247 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+// gpmMetric is a GPM metric and the gauge it is exported by.
+type gpmMetric struct {
+	id   ixml.GpmMetric
+	name string
+	help string
+}
+
+// gpmMetrics by their name in the config.
+var gpmMetrics = map[string]gpmMetric{
+	config.GpmSmUtil:       {ixml.GpmSmUtil, "gpm_sm_util_percent", "Percentage of the time the SMs of a chip were busy."},
+	config.GpmSmOccupancy:  {ixml.GpmSmOccupancy, "gpm_sm_occupancy_percent", "Percentage of the warps the SMs of a chip could hold which were resident."},
+	config.GpmTensorUtil:   {ixml.GpmAnyTensorUtil, "gpm_tensor_util_percent", "Percentage of the time the tensor cores of a chip were busy."},
+	config.GpmDramBwUtil:   {ixml.GpmDramBwUtil, "gpm_dram_bw_util_percent", "Percentage of the DRAM bandwidth of a chip used."},
+	config.GpmFp64Util:     {ixml.GpmFp64Util, "gpm_fp64_util_percent", "Percentage of the FP64 throughput of a chip used."},
+	config.GpmFp32Util:     {ixml.GpmFp32Util, "gpm_fp32_util_percent", "Percentage of the FP32 throughput of a chip used."},
+	config.GpmFp16Util:     {ixml.GpmFp16Util, "gpm_fp16_util_percent", "Percentage of the FP16 throughput of a chip used."},
+	config.GpmPcieTxPerSec: {ixml.GpmPcieTxPerSec, "gpm_pcie_tx_mib_per_second", "PCIe throughput sent by a chip."},
+	config.GpmPcieRxPerSec: {ixml.GpmPcieRxPerSec, "gpm_pcie_rx_mib_per_second", "PCIe throughput received by a chip."},
+}
+
+// gpmSampler takes a GPM sample of every chip supporting it at each interval,
+// and exports the metrics between the last two, labeled by the pods holding
+// the chip. It is only used by the sampling loop.
+type gpmSampler struct {
+	interval time.Duration
+	metrics  []gpmMetric
+
+	// chip uuid -> GPM supported
+	supported map[string]bool
+	// chip uuid -> last sample
+	samples map[string]ixml.GpmSample
+
+	// metric id -> gauge
+	gauges map[ixml.GpmMetric]*metrics.Vec
+}
+
+func newGpmSampler(cfg config.Gpm, reg *metrics.Registry) *gpmSampler {
+	s := &gpmSampler{
+		interval:  time.Duration(cfg.IntervalSeconds) * time.Second,
+		supported: map[string]bool{},
+		samples:   map[string]ixml.GpmSample{},
+		gauges:    map[ixml.GpmMetric]*metrics.Vec{},
+	}
+	if s.interval == 0 {
+		s.interval = config.DefaultGpmIntervalSeconds * time.Second
+	}
+	names := cfg.Metrics
+	if len(names) == 0 {
+		names = config.DefaultGpmMetrics
+	}
+	for _, name := range names {
+		m := gpmMetrics[name]
+		if _, ok := s.gauges[m.id]; ok {
+			continue
+		}
+		s.metrics = append(s.metrics, m)
+		s.gauges[m.id] = reg.Gauge(m.name, m.help, "device", "chip", "namespace", "pod")
+	}
+	return s
+}
+
+// sample takes a sample of the chips of devSet, and returns the metrics of the
+// chips sampled before, by chip uuid.
+func (s *gpmSampler) sample(devSet *gpuallocator.DeviceSet) map[string]map[ixml.GpmMetric]float64 {
+	ids := make([]ixml.GpmMetric, 0, len(s.metrics))
+	for _, m := range s.metrics {
+		ids = append(ids, m.id)
+	}
+
+	values := map[string]map[ixml.GpmMetric]float64{}
+	seen := map[string]bool{}
+	for _, dev := range devSet.Devices {
+		for uuid, c := range dev.Chips {
+			seen[uuid] = true
+			supported, ok := s.supported[uuid]
+			if !ok {
+				var err error
+				if supported, err = c.Operations.DeviceGpmQueryDeviceSupport(); err != nil {
+					klog.Warningf("Failed to query GPM support of chip %s: %v", uuid, err)
+				} else if !supported {
+					klog.Infof("Chip %s does not support GPM", uuid)
+				}
+				s.supported[uuid] = supported
+			}
+			if !supported {
+				continue
+			}
+
+			sample, err := c.Operations.DeviceGpmSampleGet()
+			if err != nil {
+				klog.Warningf("Failed to take a GPM sample of chip %s: %v", uuid, err)
+				continue
+			}
+			if last, ok := s.samples[uuid]; ok {
+				if v, err := c.Operations.DeviceGpmMetricsGet(last, sample, ids); err != nil {
+					klog.Warningf("Failed to get the GPM metrics of chip %s: %v", uuid, err)
+				} else {
+					values[uuid] = v
+				}
+				last.Free()
+			}
+			s.samples[uuid] = sample
+		}
+	}
+
+	// chips removed, or rescanned after a reset
+	for uuid, sample := range s.samples {
+		if !seen[uuid] {
+			sample.Free()
+			delete(s.samples, uuid)
+			delete(s.supported, uuid)
+		}
+	}
+	return values
+}
+
+// export sets the gauges from the metrics of the chips, once per pod holding
+// the chip, or once without pod for a free chip.
+func (s *gpmSampler) export(devSet *gpuallocator.DeviceSet, values map[string]map[ixml.GpmMetric]float64,
+	owners map[string][]string) {
+	for _, g := range s.gauges {
+		g.Reset()
+	}
+	for _, dev := range devSet.Devices {
+		for uuid := range dev.Chips {
+			v, ok := values[uuid]
+			if !ok {
+				continue
+			}
+			pods := owners[uuid]
+			if len(pods) == 0 {
+				pods = []string{"/"}
+			}
+			for id, value := range v {
+				g, ok := s.gauges[id]
+				if !ok {
+					continue
+				}
+				for _, pod := range pods {
+					namespace, name, _ := strings.Cut(pod, "/")
+					g.Set(value, dev.UUID, uuid, namespace, name)
+				}
+			}
+		}
+	}
+}
+
+func (s *gpmSampler) free() {
+	for uuid, sample := range s.samples {
+		sample.Free()
+		delete(s.samples, uuid)
+	}
+}
+
+// chipOwners returns the pods holding every chip, by chip uuid, as recorded
+// in the ledger.
+func (d *iluvatarDevice) chipOwners(devSet *gpuallocator.DeviceSet) map[string][]string {
+	owners := map[string]map[string]bool{}
+	own := func(uuid, pod string) {
+		if owners[uuid] == nil {
+			owners[uuid] = map[string]bool{}
+		}
+		owners[uuid][pod] = true
+	}
+
+	for _, e := range d.ledger.snapshot() {
+		if e.Pod == "" {
+			continue
+		}
+		for _, uuid := range e.Devices {
+			own(uuid, e.Pod)
+		}
+		if len(e.Devices) > 0 {
+			continue
+		}
+		// adopted from kubelet, only the replicas are known
+		for _, id := range e.Replicas {
+			if _, chip := devSet.FindChip(id); chip != nil {
+				own(chip.UUID, e.Pod)
+			} else if dev, ok := devSet.Devices[gpuallocator.Alias(id).Prefix()]; ok {
+				for uuid := range dev.Chips {
+					own(uuid, e.Pod)
+				}
+			}
+		}
+	}
+
+	ret := map[string][]string{}
+	for uuid, pods := range owners {
+		for pod := range pods {
+			ret[uuid] = append(ret[uuid], pod)
+		}
+		sort.Strings(ret[uuid])
+	}
+	return ret
+}
+
+func (d *iluvatarDevice) sampleGpm(ctx context.Context) {
+	klog.Infof("Start to sample GPM metrics, interval: %s", d.gpm.interval)
+
+	ticker := time.NewTicker(d.gpm.interval)
+	defer ticker.Stop()
+	defer d.gpm.free()
+
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Info("Stoping GPM sampling")
+			return
+		case <-ticker.C:
+			devSet := d.devices.Load()
+			d.gpm.export(devSet, d.gpm.sample(devSet), d.chipOwners(devSet))
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const leakAuditPeriod = 30 * time.Second
+
+// The processes of a deleted container take a while to exit, they are leaked
+// once their device had no owner for that long.
+const leakGrace = time.Minute
+
+// A device is reset once per leak episode, again after a doubling backoff
+// while its leaked processes survive the resets, and given up after
+// leakResetAttempts.
+const (
+	leakResetBackoff  = 2 * time.Minute
+	leakResetAttempts = 3
+)
+
+// leakedChip is a chip of a device no pod holds, running processes.
+type leakedChip struct {
+	device string
+	procs  []ixml.ProcessInfo
+	since  time.Time
+	// reported once the processes outlived leakGrace
+	reported bool
+}
+
+// leakReset is the resets of a device during a leak episode.
+type leakReset struct {
+	attempts int
+	next     time.Time
+}
+
+// leakAuditor tracks the chips running processes of no pod.
+type leakAuditor struct {
+	lk     sync.Mutex
+	action string
+	// chip uuid -> processes found on it
+	chips map[string]*leakedChip
+	// device uuid -> resets since its processes leaked
+	resets map[string]*leakReset
+
+	processes *metrics.Vec
+	memory    *metrics.Vec
+	detected  *metrics.Vec
+}
+
+func newLeakAuditor(action string, reg *metrics.Registry) *leakAuditor {
+	if action == "" {
+		action = config.LeakActionReport
+	}
+	return &leakAuditor{
+		action: action,
+		chips:  map[string]*leakedChip{},
+		resets: map[string]*leakReset{},
+		processes: reg.Gauge("leaked_processes",
+			"Number of processes running on a chip no pod holds.", "device", "chip"),
+		memory: reg.Gauge("leaked_memory_mib",
+			"Device memory held by the processes running on a chip no pod holds.", "device", "chip"),
+		detected: reg.Counter("leaked_processes_detected_total",
+			"Number of times processes were found running on a chip no pod holds.", "device", "chip"),
+	}
+}
+
+// observe records the processes found on the chips no pod holds. It returns
+// the chips whose processes just outlived the grace period, and the reported
+// chips which are clean again.
+func (a *leakAuditor) observe(found map[string]*leakedChip, now time.Time) ([]string, []string) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	var leaked, cleared []string
+	for uuid, c := range a.chips {
+		if _, ok := found[uuid]; ok {
+			continue
+		}
+		delete(a.chips, uuid)
+		if c.reported {
+			cleared = append(cleared, uuid)
+		}
+	}
+	for uuid, f := range found {
+		c, ok := a.chips[uuid]
+		if !ok {
+			c = &leakedChip{device: f.device, since: now}
+			a.chips[uuid] = c
+		}
+		c.procs = f.procs
+		if !c.reported && now.Sub(c.since) >= leakGrace {
+			c.reported = true
+			leaked = append(leaked, uuid)
+			a.detected.Add(1, c.device, uuid)
+		}
+	}
+
+	// the episode of a device ends once none of its chips leaks
+	leaking := map[string]bool{}
+	for _, c := range a.chips {
+		leaking[c.device] = leaking[c.device] || c.reported
+	}
+	for device := range a.resets {
+		if !leaking[device] {
+			delete(a.resets, device)
+		}
+	}
+
+	a.processes.Reset()
+	a.memory.Reset()
+	for uuid, c := range a.chips {
+		if !c.reported {
+			continue
+		}
+		var mem uint64
+		for _, p := range c.procs {
+			mem += p.UsedMemory
+		}
+		a.processes.Set(float64(len(c.procs)), c.device, uuid)
+		a.memory.Set(float64(mem), c.device, uuid)
+	}
+	sort.Strings(leaked)
+	sort.Strings(cleared)
+	return leaked, cleared
+}
+
+// leakReason describes the leaked processes of dev, empty if none is.
+func (a *leakAuditor) leakReason(dev *gpuallocator.Device) string {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	var reasons []string
+	for uuid := range dev.Chips {
+		if c, ok := a.chips[uuid]; ok && c.reported {
+			reasons = append(reasons, fmt.Sprintf("chip %s: %s", uuid, describeProcesses(c.procs)))
+		}
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
+
+// nextReset tells if the leaking device is due for a reset at now, and
+// returns the attempt it is. giveUp is set once, when the last attempt did not
+// clear the leak either.
+func (a *leakAuditor) nextReset(device string, now time.Time) (attempt int, giveUp bool) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	r, ok := a.resets[device]
+	if !ok {
+		r = &leakReset{}
+		a.resets[device] = r
+	}
+	if now.Before(r.next) {
+		return 0, false
+	}
+	if r.attempts == leakResetAttempts {
+		// never due again during this episode
+		r.attempts++
+		return 0, true
+	}
+	if r.attempts > leakResetAttempts {
+		return 0, false
+	}
+	r.next = now.Add(leakResetBackoff << r.attempts)
+	r.attempts++
+	return r.attempts, false
+}
+
+// keepsUnhealthy tells if dev is kept unhealthy for its leaked processes.
+func (a *leakAuditor) keepsUnhealthy(dev *gpuallocator.Device) bool {
+	return a.action != config.LeakActionReport && a.leakReason(dev) != ""
+}
+
+// heldDevices returns the uuids of the devices held by a container of the
+// ledger, which adopts the allocations kubelet reports.
+func (d *iluvatarDevice) heldDevices(devSet *gpuallocator.DeviceSet) map[string]bool {
+	owners := map[string]string{}
+	for _, dev := range devSet.Devices {
+		for uuid := range dev.Chips {
+			owners[uuid] = dev.UUID
+		}
+	}
+	held := map[string]bool{}
+	hold := func(ids []string) {
+		for _, id := range ids {
+			if owner, ok := owners[id]; ok {
+				held[owner] = true
+			} else {
+				held[gpuallocator.Alias(id).Prefix()] = true
+			}
+		}
+	}
+
+	for _, e := range d.ledger.snapshot() {
+		hold(e.Replicas)
+		hold(e.Devices)
+	}
+	return held
+}
+
+// auditLeaks audits the devices periodically, and as soon as the ledger
+// releases some so that their grace period starts with the release.
+func (d *iluvatarDevice) auditLeaks(ctx context.Context) {
+	klog.Infof("Start to audit leaked processes, action: %s", d.leaks.action)
+
+	sub := d.events.Subscribe("leak audit", eventBuffer, bus.Released)
+	defer sub.Close()
+	ticker := time.NewTicker(leakAuditPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Info("Stoping leaked processes audit")
+			return
+		case <-sub.C:
+			d.auditLeakedProcesses()
+		case <-ticker.C:
+			d.auditLeakedProcesses()
+		}
+	}
+}
+
+func (d *iluvatarDevice) auditLeakedProcesses() {
+	devSet := d.devices.Load()
+	held := d.heldDevices(devSet)
+
+	found := map[string]*leakedChip{}
+	for _, dev := range devSet.Devices {
+		if held[dev.UUID] {
+			continue
+		}
+		for uuid, c := range dev.Chips {
+			procs, err := c.Operations.DeviceGetComputeRunningProcesses()
+			if err != nil {
+				klog.Warningf("Failed to list the processes of chip %s: %v", uuid, err)
+				continue
+			}
+			if len(procs) > 0 {
+				found[uuid] = &leakedChip{device: dev.UUID, procs: procs}
+			}
+		}
+	}
+
+	leaked, cleared := d.leaks.observe(found, time.Now())
+	for _, uuid := range leaked {
+		message := fmt.Sprintf("Chip %s of device %s runs processes of no pod: %s", uuid, found[uuid].device,
+			describeProcesses(found[uuid].procs))
+		klog.Warning(message)
+		d.recordNodeEvent(v1.EventTypeWarning, "GPULeakedProcesses", message)
+	}
+	for _, uuid := range cleared {
+		klog.Infof("Leaked processes of chip %s are gone", uuid)
+		d.recordNodeEvent(v1.EventTypeNormal, "GPULeakedProcessesCleared",
+			fmt.Sprintf("Leaked processes of chip %s are gone", uuid))
+	}
+	if d.leaks.action != config.LeakActionReport && len(leaked)+len(cleared) > 0 {
+		d.refreshHealth()
+	}
+
+	if d.leaks.action == config.LeakActionReset {
+		now := time.Now()
+		for _, dev := range devSet.Devices {
+			if d.leaks.leakReason(dev) == "" {
+				continue
+			}
+			attempt, giveUp := d.leaks.nextReset(dev.UUID, now)
+			if giveUp {
+				message := fmt.Sprintf("Leaked processes of device %s survived %d resets, giving up", dev.UUID,
+					leakResetAttempts)
+				klog.Warning(message)
+				d.recordNodeEvent(v1.EventTypeWarning, "GPULeakedProcessesResetFailed", message)
+			}
+			if attempt == 0 {
+				continue
+			}
+			klog.Infof("Reset device %s to kill its leaked processes, attempt %d/%d", dev.UUID, attempt,
+				leakResetAttempts)
+			d.resetGpusAndDeviceSet(dev.GenerateIDS())
+		}
+	}
+}
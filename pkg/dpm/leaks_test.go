@@ -0,0 +1,66 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
+)
+
+func TestLeakResetBackoff(t *testing.T) {
+	a := newLeakAuditor(config.LeakActionReset, metrics.NewRegistry())
+	start := time.Now()
+	leak := map[string]*leakedChip{"chip-0": {device: "gpu-0", procs: []ixml.ProcessInfo{{Pid: 42}}}}
+	a.observe(leak, start)
+	a.observe(leak, start.Add(leakGrace))
+
+	for _, step := range []struct {
+		after   time.Duration
+		attempt int
+		giveUp  bool
+	}{
+		{after: leakGrace, attempt: 1},
+		{after: leakGrace + time.Minute},
+		{after: leakGrace + leakResetBackoff, attempt: 2},
+		{after: leakGrace + 3*leakResetBackoff - time.Second},
+		{after: leakGrace + 3*leakResetBackoff, attempt: 3},
+		{after: leakGrace + 7*leakResetBackoff, giveUp: true},
+		{after: leakGrace + time.Hour},
+	} {
+		now := start.Add(step.after)
+		a.observe(leak, now)
+		attempt, giveUp := a.nextReset("gpu-0", now)
+		if attempt != step.attempt || giveUp != step.giveUp {
+			t.Errorf("after %v: attempt %d give up %v, want attempt %d give up %v", step.after, attempt, giveUp,
+				step.attempt, step.giveUp)
+		}
+	}
+
+	// a new episode starts over once the processes are gone
+	now := start.Add(2 * time.Hour)
+	a.observe(nil, now)
+	a.observe(leak, now)
+	a.observe(leak, now.Add(leakGrace))
+	if attempt, _ := a.nextReset("gpu-0", now.Add(leakGrace)); attempt != 1 {
+		t.Errorf("first reset of a new leak is attempt %d, want 1", attempt)
+	}
+}
@@ -0,0 +1,386 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// An entry not bound to a pod by then is dropped, kubelet did not start the
+// container it was allocated for.
+const ledgerBindTimeout = 5 * time.Minute
+
+// The allocations recorded meanwhile are saved together, Allocate does not
+// wait for the disk.
+const ledgerSaveDelay = time.Second
+
+// ledgerEntry is the devices handed out by an Allocate for one container.
+type ledgerEntry struct {
+	// RequestHash identifies the device ids kubelet asked for, it is empty
+	// for the allocations adopted from kubelet
+	RequestHash string `json:"requestHash"`
+	// KubeletReplicas are the device ids kubelet asked for, and reports in
+	// the PodResources API
+	KubeletReplicas []string `json:"kubeletReplicas"`
+	// Replicas are the device ids handed out, they differ from the kubelet
+	// ones when Volcano chose the devices
+	Replicas []string `json:"replicas"`
+	// Devices are the uuids of the chips handed out
+	Devices   []string  `json:"devices"`
+	Allocated time.Time `json:"allocated"`
+
+	// set once the container is found in the PodResources API
+	PodUID string    `json:"podUID,omitempty"`
+	Pod    string    `json:"pod,omitempty"`
+	Bound  time.Time `json:"bound,omitzero"`
+}
+
+// allocationLedger records which container got which devices, and the pod it
+// belongs to once kubelet started it. It is saved to a host path after every
+// change, so that it survives restarts of the plugin.
+type allocationLedger struct {
+	lk      sync.Mutex
+	path    string
+	entries []*ledgerEntry
+	// unsaved is set by the changes not yet saved, and saved signaled
+	unsaved bool
+	saved   chan struct{}
+}
+
+func requestHash(ids []string) string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadLedger reads the ledger saved at path, a missing file is an empty
+// ledger.
+func loadLedger(path string) (*allocationLedger, error) {
+	l := &allocationLedger{path: path, saved: make(chan struct{}, 1)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return l, fmt.Errorf("read ledger %s failed: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		l.entries = nil
+		return l, fmt.Errorf("decode ledger %s failed: %v", path, err)
+	}
+	return l, nil
+}
+
+// save writes the ledger with lk held, through a rename so that a crash never
+// leaves a partial file.
+func (l *allocationLedger) save() {
+	l.unsaved = false
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		klog.Errorf("Failed to encode allocation ledger: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		klog.Errorf("Failed to create allocation ledger directory: %v", err)
+		return
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		klog.Errorf("Failed to write allocation ledger: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		klog.Errorf("Failed to write allocation ledger: %v", err)
+	}
+}
+
+// record adds the allocation of a container, it is saved by persist.
+func (l *allocationLedger) record(kubeletIDs, replicaIDs, deviceIDs []string, now time.Time) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.entries = append(l.entries, &ledgerEntry{
+		RequestHash:     requestHash(kubeletIDs),
+		KubeletReplicas: append([]string(nil), kubeletIDs...),
+		Replicas:        append([]string(nil), replicaIDs...),
+		Devices:         append([]string(nil), deviceIDs...),
+		Allocated:       now,
+	})
+	l.unsaved = true
+	select {
+	case l.saved <- struct{}{}:
+	default:
+	}
+}
+
+// flush saves the changes not saved yet.
+func (l *allocationLedger) flush() {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.unsaved {
+		l.save()
+	}
+}
+
+// persist saves the recorded allocations, batched over ledgerSaveDelay, until
+// ctx is done.
+func (l *allocationLedger) persist(ctx context.Context) {
+	defer l.flush()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.saved:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ledgerSaveDelay):
+		}
+		l.flush()
+	}
+}
+
+// devicesOf returns the chips handed out by the last Allocate for the device
+// ids kubelet asked for.
+func (l *allocationLedger) devicesOf(kubeletIDs []string) ([]string, bool) {
+	hash := requestHash(kubeletIDs)
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if e := l.entries[i]; e.RequestHash == hash {
+			return append([]string(nil), e.Devices...), true
+		}
+	}
+	return nil, false
+}
+
+// heldReplicas returns the device ids handed out to the containers in the
+// ledger, the ones Volcano chose rather than the ones kubelet asked for.
+func (l *allocationLedger) heldReplicas() map[string]bool {
+	held := map[string]bool{}
+	for _, e := range l.snapshot() {
+		for _, id := range e.Replicas {
+			held[id] = true
+		}
+	}
+	return held
+}
+
+// snapshot returns a copy of the entries.
+func (l *allocationLedger) snapshot() []ledgerEntry {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	ret := make([]ledgerEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		ret = append(ret, *e)
+	}
+	return ret
+}
+
+// podRef is a pod holding devices, as reported by kubelet.
+type podRef struct {
+	key     string
+	uid     string
+	devices []string
+}
+
+// sync binds the entries to the pods kubelet reports them in, adopts the
+// devices of the pods not in the ledger, and releases the entries whose pod
+// is gone. It returns the released entries.
+func (l *allocationLedger) sync(pods map[string]podRef, gone func(e *ledgerEntry) bool,
+	now time.Time) []*ledgerEntry {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	changed := false
+	// pod key -> device ids covered by the entries bound to it
+	covered := map[string]map[string]bool{}
+	var kept, released []*ledgerEntry
+	for _, e := range l.entries {
+		if e.Pod == "" {
+			if pod, ok := findPod(pods, covered, e); ok {
+				e.Pod, e.PodUID, e.Bound = pod.key, pod.uid, now
+				changed = true
+				klog.Infof("Allocation %v bound to pod %s", e.Replicas, e.Pod)
+			} else if now.Sub(e.Allocated) > ledgerBindTimeout {
+				klog.Warningf("Allocation %v was never bound to a pod, dropped", e.Replicas)
+				changed = true
+				continue
+			}
+		}
+		if e.Pod != "" {
+			if pod, ok := pods[e.Pod]; ok && e.PodUID == "" && pod.uid != "" {
+				e.PodUID = pod.uid
+				changed = true
+			}
+			if gone(e) {
+				released = append(released, e)
+				changed = true
+				continue
+			}
+			if covered[e.Pod] == nil {
+				covered[e.Pod] = map[string]bool{}
+			}
+			for _, id := range e.KubeletReplicas {
+				covered[e.Pod][id] = true
+			}
+		}
+		kept = append(kept, e)
+	}
+
+	// pods allocated before the ledger was kept, or whose entry was lost
+	for key, pod := range pods {
+		var ids []string
+		for _, id := range pod.devices {
+			if !covered[key][id] {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		klog.Infof("Adopt allocation %v of pod %s", ids, key)
+		kept = append(kept, &ledgerEntry{
+			KubeletReplicas: ids,
+			Replicas:        ids,
+			Allocated:       now,
+			PodUID:          pod.uid,
+			Pod:             key,
+			Bound:           now,
+		})
+		changed = true
+	}
+
+	l.entries = kept
+	if changed {
+		l.save()
+	}
+	return released
+}
+
+// findPod returns the pod holding all the devices of the entry, which are not
+// yet covered by another entry of the pod.
+func findPod(pods map[string]podRef, covered map[string]map[string]bool, e *ledgerEntry) (podRef, bool) {
+	for key, pod := range pods {
+		held := map[string]bool{}
+		for _, id := range pod.devices {
+			held[id] = true
+		}
+		all := len(e.KubeletReplicas) > 0
+		for _, id := range e.KubeletReplicas {
+			all = all && held[id] && !covered[key][id]
+		}
+		if all {
+			return pod, true
+		}
+	}
+	return podRef{}, false
+}
+
+func (d *iluvatarDevice) trackAllocations(ctx context.Context) {
+	klog.Infof("Start to track allocations.")
+
+	ticker := time.NewTicker(updatePeriod * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Info("Stoping allocation tracking")
+			return
+		case <-ticker.C:
+			d.syncLedger()
+		}
+	}
+}
+
+func (d *iluvatarDevice) syncLedger() {
+	podDevice, err := kube.NewPodResource().GetPodResource()
+	if err != nil {
+		klog.Errorf("get pod resource failed, %v", err)
+		return
+	}
+
+	var active map[string]v1.Pod
+	if d.kubeclient != nil && d.kubeclient.HasPodCache() {
+		active = map[string]v1.Pod{}
+		for _, pod := range d.kubeclient.GetActivePodListCache() {
+			active[pod.Namespace+"/"+pod.Name] = pod
+		}
+	}
+
+	pods, gone := ledgerPods(podDevice, active)
+	d.release(d.ledger.sync(pods, gone, time.Now()))
+}
+
+// ledgerPods returns the pods holding devices from the PodResources ones, and
+// whether the pod of an entry is gone. active is the pod cache, nil without
+// the pod informer: a pod is then gone once kubelet no longer reports it.
+func ledgerPods(podDevice map[string]kube.PodDevice, active map[string]v1.Pod) (map[string]podRef,
+	func(e *ledgerEntry) bool) {
+	pods := map[string]podRef{}
+	for key, dev := range podDevice {
+		// namespaces can not contain an underscore
+		ref := podRef{key: strings.Replace(key, "_", "/", 1), devices: dev.DeviceIds}
+		if pod, ok := active[ref.key]; ok {
+			ref.uid = string(pod.UID)
+		}
+		pods[ref.key] = ref
+	}
+
+	gone := func(e *ledgerEntry) bool {
+		_, reported := pods[e.Pod]
+		if active == nil || e.PodUID == "" {
+			// bound before the informer saw the pod
+			return !reported && (active == nil || active[e.Pod].UID == "")
+		}
+		pod, ok := active[e.Pod]
+		return !ok || string(pod.UID) != e.PodUID
+	}
+
+	return pods, gone
+}
+
+// release hands the entries released by the ledger to the replica occupancy,
+// which must not miss any, and publishes them.
+func (d *iluvatarDevice) release(entries []*ledgerEntry) {
+	for _, e := range entries {
+		klog.Infof("Allocation %v of pod %s released", e.Replicas, e.Pod)
+		if d.occupancy != nil {
+			d.occupancy.release(e.Replicas)
+		}
+		d.events.Publish(bus.Event{Type: bus.Released, Replicas: e.Replicas, Chips: e.Devices, Pod: e.Pod})
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// describeEntries returns pod/uid=kubelet ids->replicas of every entry,
+// sorted.
+func describeEntries(entries []*ledgerEntry) []string {
+	var ret []string
+	for _, e := range entries {
+		ret = append(ret, fmt.Sprintf("%s/%s=%s->%s", e.Pod, e.PodUID, strings.Join(e.KubeletReplicas, ","),
+			strings.Join(e.Replicas, ",")))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func activePod(namespace, name, uid string) v1.Pod {
+	return v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(uid)}}
+}
+
+func TestLedgerSync(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := now.Add(-time.Minute)
+	expired := now.Add(-ledgerBindTimeout - time.Second)
+
+	tests := []struct {
+		name    string
+		entries []*ledgerEntry
+		// PodResources, keyed by namespace_name
+		podDevice map[string]kube.PodDevice
+		// the pod cache, nil without the pod informer
+		active   []v1.Pod
+		want     []string
+		released []string
+	}{
+		{
+			name: "bound by the kubelet replica ids",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu1::0"}, Allocated: recent},
+			},
+			podDevice: map[string]kube.PodDevice{"ns_a": {DeviceIds: []string{"gpu0::0"}}},
+			active:    []v1.Pod{activePod("ns", "a", "uid-a")},
+			want:      []string{"ns/a/uid-a=gpu0::0->gpu1::0"},
+		},
+		{
+			name: "bound without the informer",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: recent},
+			},
+			podDevice: map[string]kube.PodDevice{"ns_a": {DeviceIds: []string{"gpu0::0"}}},
+			want:      []string{"ns/a/=gpu0::0->gpu0::0"},
+		},
+		{
+			name: "two entries with the same ids in one pod",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: recent},
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: recent},
+			},
+			podDevice: map[string]kube.PodDevice{"ns_a": {DeviceIds: []string{"gpu0::0"}}},
+			want:      []string{"/=gpu0::0->gpu0::0", "ns/a/=gpu0::0->gpu0::0"},
+		},
+		{
+			name: "two containers of one pod",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: recent},
+				{KubeletReplicas: []string{"gpu1::0"}, Replicas: []string{"gpu1::0"}, Allocated: recent},
+			},
+			podDevice: map[string]kube.PodDevice{"ns_a": {DeviceIds: []string{"gpu0::0", "gpu1::0"}}},
+			want:      []string{"ns/a/=gpu0::0->gpu0::0", "ns/a/=gpu1::0->gpu1::0"},
+		},
+		{
+			name: "unknown devices of a pod adopted",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: recent},
+			},
+			podDevice: map[string]kube.PodDevice{
+				"ns_a": {DeviceIds: []string{"gpu0::0", "gpu0::1"}},
+				"ns_b": {DeviceIds: []string{"gpu1::0"}},
+			},
+			active: []v1.Pod{activePod("ns", "a", "uid-a"), activePod("ns", "b", "uid-b")},
+			want: []string{"ns/a/uid-a=gpu0::0->gpu0::0", "ns/a/uid-a=gpu0::1->gpu0::1",
+				"ns/b/uid-b=gpu1::0->gpu1::0"},
+		},
+		{
+			name: "never bound",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: expired},
+				{KubeletReplicas: []string{"gpu1::0"}, Replicas: []string{"gpu1::0"}, Allocated: recent},
+			},
+			want: []string{"/=gpu1::0->gpu1::0"},
+		},
+		{
+			name: "pod uid changed",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: expired,
+					Pod: "ns/a", PodUID: "uid-a", Bound: expired},
+			},
+			podDevice: map[string]kube.PodDevice{"ns_a": {DeviceIds: []string{"gpu1::0"}}},
+			active:    []v1.Pod{activePod("ns", "a", "uid-a2")},
+			want:      []string{"ns/a/uid-a2=gpu1::0->gpu1::0"},
+			released:  []string{"ns/a/uid-a=gpu0::0->gpu0::0"},
+		},
+		{
+			name: "pod gone with the informer",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: expired,
+					Pod: "ns/a", PodUID: "uid-a", Bound: expired},
+				{KubeletReplicas: []string{"gpu1::0"}, Replicas: []string{"gpu1::0"}, Allocated: expired,
+					Pod: "ns/b", PodUID: "uid-b", Bound: expired},
+			},
+			active:   []v1.Pod{activePod("ns", "b", "uid-b")},
+			want:     []string{"ns/b/uid-b=gpu1::0->gpu1::0"},
+			released: []string{"ns/a/uid-a=gpu0::0->gpu0::0"},
+		},
+		{
+			name: "pod bound before the informer saw it",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: expired,
+					Pod: "ns/a", Bound: expired},
+				{KubeletReplicas: []string{"gpu1::0"}, Replicas: []string{"gpu1::0"}, Allocated: expired,
+					Pod: "ns/b", Bound: expired},
+			},
+			active:   []v1.Pod{activePod("ns", "a", "uid-a")},
+			want:     []string{"ns/a/=gpu0::0->gpu0::0"},
+			released: []string{"ns/b/=gpu1::0->gpu1::0"},
+		},
+		{
+			name: "pod gone without the informer",
+			entries: []*ledgerEntry{
+				{KubeletReplicas: []string{"gpu0::0"}, Replicas: []string{"gpu0::0"}, Allocated: expired,
+					Pod: "ns/a", Bound: expired},
+				{KubeletReplicas: []string{"gpu1::0"}, Replicas: []string{"gpu1::0"}, Allocated: expired,
+					Pod: "ns/b", Bound: expired},
+			},
+			podDevice: map[string]kube.PodDevice{"ns_b": {DeviceIds: []string{"gpu1::0"}}},
+			want:      []string{"ns/b/=gpu1::0->gpu1::0"},
+			released:  []string{"ns/a/=gpu0::0->gpu0::0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := loadLedger(filepath.Join(t.TempDir(), "allocations.json"))
+			if err != nil {
+				t.Fatalf("load ledger failed: %v", err)
+			}
+			l.entries = tt.entries
+
+			var active map[string]v1.Pod
+			if tt.active != nil {
+				active = map[string]v1.Pod{}
+				for _, pod := range tt.active {
+					active[pod.Namespace+"/"+pod.Name] = pod
+				}
+			}
+			pods, gone := ledgerPods(tt.podDevice, active)
+			released := l.sync(pods, gone, now)
+
+			if got := describeEntries(l.entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries %v, want %v", got, tt.want)
+			}
+			if got := describeEntries(released); !reflect.DeepEqual(got, tt.released) {
+				t.Errorf("released %v, want %v", got, tt.released)
+			}
+		})
+	}
+}
+
+func TestLedgerSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger", "allocations.json")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l, err := loadLedger(path)
+	if err != nil || len(l.entries) != 0 {
+		t.Fatalf("load of a missing ledger = %v, %v, want an empty one", l.entries, err)
+	}
+	l.record([]string{"gpu0::0"}, []string{"gpu1::0"}, []string{"gpu1"}, now)
+	l.record([]string{"gpu0::1"}, []string{"gpu0::1"}, []string{"gpu0"}, now)
+	pods, gone := ledgerPods(map[string]kube.PodDevice{"ns_a": {DeviceIds: []string{"gpu0::0"}}}, nil)
+	l.sync(pods, gone, now.Add(time.Minute))
+	l.flush()
+
+	loaded, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load ledger failed: %v", err)
+	}
+	if got, want := loaded.snapshot(), l.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+	if devices, ok := loaded.devicesOf([]string{"gpu0::0"}); !ok || !reflect.DeepEqual(devices, []string{"gpu1"}) {
+		t.Errorf("devices of the loaded allocation = %v, %v, want [gpu1]", devices, ok)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := loadLedger(path); err == nil || len(l.entries) != 0 {
+		t.Errorf("load of a corrupt ledger = %v, %v, want an empty one and an error", l.entries, err)
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// maintenance holds the drain and reset requests an operator put on the node
+// through the iluvatar.com/drain-request and iluvatar.com/reset-request
+// annotations. Both take a comma separated list of device or chip uuids.
+type maintenance struct {
+	lk sync.Mutex
+
+	// uuids kept unhealthy as long as they are listed
+	drainRequest map[string]bool
+	// uuids to be drained, reset once free, then removed from the request
+	resetRequest map[string]bool
+	// uuids being reset, kept drained until the reset is over
+	resetting map[string]bool
+	// uuids reset but still listed in the request, they are not reset again
+	resetDone map[string]bool
+	// last reported result per requested uuid
+	status map[string]kube.GpuMaintenanceStatus
+
+	notify chan struct{}
+}
+
+func newMaintenance() *maintenance {
+	return &maintenance{
+		drainRequest: map[string]bool{},
+		resetRequest: map[string]bool{},
+		resetting:    map[string]bool{},
+		resetDone:    map[string]bool{},
+		status:       map[string]kube.GpuMaintenanceStatus{},
+		notify:       make(chan struct{}, 1),
+	}
+}
+
+func parseUUIDList(value string) map[string]bool {
+	ret := map[string]bool{}
+	for _, uuid := range strings.Split(value, kube.CommaSepDev) {
+		uuid = strings.TrimSpace(uuid)
+		if uuid != "" {
+			ret[uuid] = true
+		}
+	}
+	return ret
+}
+
+func (m *maintenance) onNodeUpdate(node *v1.Node) {
+	m.lk.Lock()
+	m.drainRequest = parseUUIDList(node.Annotations[kube.ResourceNamePrefix+kube.NodeDrainRequest])
+	m.resetRequest = parseUUIDList(node.Annotations[kube.ResourceNamePrefix+kube.NodeResetRequest])
+	for uuid := range m.resetDone {
+		if !m.resetRequest[uuid] {
+			delete(m.resetDone, uuid)
+		}
+	}
+	m.lk.Unlock()
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// isRequested reports whether dev or one of its chips is listed in requests.
+func isRequested(dev *gpuallocator.Device, requests map[string]bool) bool {
+	if requests[dev.UUID] {
+		return true
+	}
+	for uuid := range dev.Chips {
+		if requests[uuid] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *maintenance) isDrained(dev *gpuallocator.Device) bool {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return isRequested(dev, m.drainRequest) || isRequested(dev, m.resetRequest) || isRequested(dev, m.resetting)
+}
+
+func (d *iluvatarDevice) maintainDevices(ctx context.Context) {
+	klog.Infof("Start to watch gpu maintenance requests.")
+
+	ticker := time.NewTicker(updatePeriod * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Info("Stoping gpu maintenance")
+			return
+		case <-ticker.C:
+		case <-d.maintenance.notify:
+		}
+		d.processMaintenance()
+	}
+}
+
+func (d *iluvatarDevice) processMaintenance() {
+	m := d.maintenance
+
+	m.lk.Lock()
+	requested := map[string]bool{}
+	for uuid := range m.drainRequest {
+		requested[uuid] = true
+	}
+	resets := map[string]bool{}
+	// reset already, only their removal from the request is left
+	var done []string
+	for uuid := range m.resetRequest {
+		requested[uuid] = true
+		if m.resetDone[uuid] {
+			done = append(done, uuid)
+		} else {
+			resets[uuid] = true
+		}
+	}
+	m.lk.Unlock()
+
+	if len(requested) == 0 {
+		return
+	}
+
+	statusChanged := false
+	setStatus := func(uuid, phase, message string) {
+		m.lk.Lock()
+		defer m.lk.Unlock()
+		if old, ok := m.status[uuid]; ok && old.Phase == phase && old.Message == message {
+			return
+		}
+		m.status[uuid] = kube.GpuMaintenanceStatus{
+			Phase:      phase,
+			Message:    message,
+			UpdateTime: time.Now().Unix(),
+		}
+		statusChanged = true
+	}
+
+	// devices are matched by board or chip uuid, drain them before anything else
+	found := map[string]*gpuallocator.Device{}
+	d.refreshHealth()
+	for _, dev := range d.devices.Load().Devices {
+		for uuid := range requested {
+			if isRequested(dev, map[string]bool{uuid: true}) {
+				found[uuid] = dev
+			}
+		}
+	}
+
+	var resetUUIDs []string
+	var resetting []string
+	if len(resets) > 0 {
+		allocated := d.ledger.heldReplicas()
+
+		resetDevs := map[string]bool{}
+		for uuid := range resets {
+			dev, ok := found[uuid]
+			if !ok {
+				klog.Warningf("Reset requested for unknown device %s", uuid)
+				setStatus(uuid, kube.MaintenancePhaseFailed, "device not found")
+				done = append(done, uuid)
+				continue
+			}
+
+			busy := false
+			for _, rdev := range dev.Exposed {
+				if allocated[rdev.ID] {
+					busy = true
+					break
+				}
+			}
+			if busy {
+				setStatus(uuid, kube.MaintenancePhaseDraining, "waiting for pods to release the device")
+				continue
+			}
+
+			setStatus(uuid, kube.MaintenancePhaseResetting, "")
+			resetting = append(resetting, uuid)
+			if !resetDevs[dev.UUID] {
+				resetDevs[dev.UUID] = true
+				resetUUIDs = append(resetUUIDs, dev.GenerateIDS()...)
+			}
+		}
+	}
+
+	// The devices stay drained while they are reset, whatever the request
+	// says meanwhile. A reset whose status can not be published is not run,
+	// it would run again on every tick.
+	if len(resetUUIDs) > 0 {
+		m.lk.Lock()
+		for _, uuid := range resetting {
+			m.resetting[uuid] = true
+		}
+		m.lk.Unlock()
+
+		if err := d.writeMaintenanceStatus(nil); err != nil {
+			klog.Warningf("Skip the reset of gpus %v: %v", resetUUIDs, err)
+			m.lk.Lock()
+			for _, uuid := range resetting {
+				delete(m.resetting, uuid)
+			}
+			m.lk.Unlock()
+			return
+		}
+		statusChanged = false
+
+		klog.Infof("Reset gpus %v by operator request", resetUUIDs)
+		err := d.resetGpus(resetUUIDs)
+		for _, uuid := range resetting {
+			if err != nil {
+				setStatus(uuid, kube.MaintenancePhaseFailed, err.Error())
+			} else {
+				setStatus(uuid, kube.MaintenancePhaseSucceeded, "")
+			}
+		}
+
+		m.lk.Lock()
+		for _, uuid := range resetting {
+			m.resetDone[uuid] = true
+			delete(m.resetting, uuid)
+		}
+		m.lk.Unlock()
+		done = append(done, resetting...)
+	}
+
+	// Take the handled uuids off the request once reset, the informer then
+	// brings the local request in line with the node.
+	if len(done) > 0 {
+		handled := map[string]bool{}
+		for _, uuid := range done {
+			handled[uuid] = true
+		}
+		var remaining []string
+		m.lk.Lock()
+		for uuid := range m.resetRequest {
+			if !handled[uuid] {
+				remaining = append(remaining, uuid)
+			}
+		}
+		m.lk.Unlock()
+
+		var request *string
+		if len(remaining) > 0 {
+			value := strings.Join(remaining, kube.CommaSepDev)
+			request = &value
+		}
+		if err := d.writeMaintenanceStatus(map[string]*string{
+			kube.ResourceNamePrefix + kube.NodeResetRequest: request,
+		}); err == nil {
+			statusChanged = false
+		}
+	}
+
+	if statusChanged {
+		d.writeMaintenanceStatus(nil)
+	}
+}
+
+// writeMaintenanceStatus publishes the maintenance status on the node together
+// with the given extra annotations.
+func (d *iluvatarDevice) writeMaintenanceStatus(annotations map[string]*string) error {
+	m := d.maintenance
+
+	m.lk.Lock()
+	data, err := json.Marshal(m.status)
+	m.lk.Unlock()
+	if err != nil {
+		klog.Errorf("Failed to marshal maintenance status: %v", err)
+		return err
+	}
+
+	if annotations == nil {
+		annotations = map[string]*string{}
+	}
+	status := string(data)
+	annotations[kube.ResourceNamePrefix+kube.NodeResetStatus] = &status
+
+	if err := d.kubeclient.TryUpdateNodeAnnotation(annotations); err != nil {
+		klog.Errorf("Failed to write maintenance status: %v", err)
+		return err
+	}
+	return nil
+}
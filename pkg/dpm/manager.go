@@ -21,13 +21,17 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 
 	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/dra"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
 	"github.com/fsnotify/fsnotify"
 	udev "github.com/jochenvg/go-udev"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -38,12 +42,19 @@ type Manager struct {
 	udevWatcher <-chan *udev.Device
 
 	sigs chan os.Signal
+
+	// progress of the long-running loops, served to the healthcheck subcommand
+	health *health.Tracker
 }
 
+// healthBeatPeriod is how often the event loop of the Manager reports progress
+const healthBeatPeriod = 10 * time.Second
+
 // NewManager initialize Manger structure.
 func NewManager() *Manager {
 	return &Manager{
 		fsWatcher: nil,
+		health:    health.NewTracker(nil),
 	}
 }
 
@@ -64,6 +75,15 @@ func (m *Manager) Run(c *cli.Context, flags []cli.Flag) error {
 		ResourceName = cfg.ResourceName
 	}
 
+	m.health.Beat("manager")
+	healthServer, err := m.health.Serve(config.HealthSocket)
+	if err != nil {
+		return fmt.Errorf("Failed to start health server: %v", err)
+	}
+	defer healthServer.Close()
+	beat := time.NewTicker(healthBeatPeriod)
+	defer beat.Stop()
+
 	klog.Info("Loading IXML")
 	err = ixml.Init()
 	if err != nil {
@@ -97,13 +117,6 @@ func (m *Manager) Run(c *cli.Context, flags []cli.Flag) error {
 		klog.Infof("CUDA version = %s\n", cudaVersion)
 	}
 
-	klog.Info("Starting FS watcher.")
-	m.fsWatcher, err = newFSWatcher(pluginapi.DevicePluginPath)
-	if err != nil {
-		return fmt.Errorf("Failed to create FS watcher: %v", err)
-	}
-	defer m.fsWatcher.Close()
-
 	klog.Info("Starting OS watcher.")
 	m.sigs = newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	defer close(m.sigs)
@@ -127,48 +140,114 @@ func (m *Manager) Run(c *cli.Context, flags []cli.Flag) error {
 		return fmt.Errorf("Failed to create udev watcher: %v", err)
 	}
 
-	server := newServer(cfg)
-Restart:
-	err = server.start()
+	if cfg.Flags.Mode == config.ModeDRA {
+		return m.runDRA(cfg, beat.C)
+	}
+
+	klog.Info("Starting FS watcher.")
+	m.fsWatcher, err = newFSWatcher(pluginapi.DevicePluginPath)
 	if err != nil {
-		klog.Info("Failed to start plugin.")
+		return fmt.Errorf("Failed to create FS watcher: %v", err)
+	}
+	defer m.fsWatcher.Close()
 
-		return fmt.Errorf("Failed to start plugin: %v", err)
+	server := newServer(cfg, m.health)
+	defer server.stop()
+	if cfg.Flags.DebugAddr != "" {
+		debug, err := server.serveDebug(cfg.Flags.DebugAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to start debug API: %v", err)
+		}
+		defer debug.Close()
 	}
 
+	restarts := newRestarter(server.start, time.After)
+	restarts.start()
+
 	/*
-	 * 1. Stop plugin if kubelet exit.
-	 * 2. Start plugin if kubelet is running.
+	 * 1. Keep serving if kubelet exit.
+	 * 2. Serve a new socket and register again if kubelet is running.
 	 * 3. Stop plugin if interrupted.
 	 */
-HandleEvents:
 	for {
 		select {
 		case event := <-m.fsWatcher.Events:
 			if event.Name == pluginapi.KubeletSocket {
 				if event.Op&fsnotify.Create == fsnotify.Create {
 					klog.Infof("Notify '%s' created, restarting plugin.", pluginapi.KubeletSocket)
-					server.stop()
-					goto Restart
+					restarts.start()
 				}
 
 				if event.Op&fsnotify.Remove == fsnotify.Remove {
-					klog.Infof("Detect '%s' removed, stopping plugin.", pluginapi.KubeletSocket)
-					server.stop()
+					klog.Infof("Detect '%s' removed, waiting for kubelet.", pluginapi.KubeletSocket)
 				}
 			}
+		case <-restarts.retry:
+			restarts.start()
 		case ixdev := <-m.udevWatcher:
 			klog.Infof("udev:%v\n", ixdev.Sysname())
 			server.updateUdev(ixdev)
+		case <-beat.C:
+			m.health.Beat("manager")
 		case s := <-m.sigs:
 			switch s {
 			case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
 				klog.Infof("Received signal %v, shutting down.", s)
-				server.stop()
-				break HandleEvents
+				return nil
 			}
 		}
 	}
+}
 
-	return nil
+// restarter starts the plugin, and schedules another attempt after a failure
+// spaced by restartBackoff. A success resets the backoff.
+type restarter struct {
+	startPlugin func() error
+	after       func(time.Duration) <-chan time.Time
+	backoff     wait.Backoff
+	// retry fires when the next attempt is due, it is nil while the plugin
+	// runs
+	retry <-chan time.Time
+}
+
+func newRestarter(startPlugin func() error, after func(time.Duration) <-chan time.Time) *restarter {
+	return &restarter{startPlugin: startPlugin, after: after, backoff: restartBackoff}
+}
+
+func (r *restarter) start() {
+	if err := r.startPlugin(); err != nil {
+		delay := r.backoff.Step()
+		klog.Errorf("Failed to start plugin, retrying in %v: %v", delay, err)
+		r.retry = r.after(delay)
+		return
+	}
+	r.backoff = restartBackoff
+	r.retry = nil
+}
+
+// runDRA serves the DRA kubelet plugin instead of the device plugin, kubelet
+// finds it again through the registration socket when it restarts.
+func (m *Manager) runDRA(cfg *config.Config, beat <-chan time.Time) error {
+	driver := dra.NewDriver(cfg)
+	err := driver.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start DRA plugin: %v", err)
+	}
+	defer driver.Stop()
+
+	for {
+		select {
+		case ixdev := <-m.udevWatcher:
+			klog.Infof("udev:%v\n", ixdev.Sysname())
+			driver.UpdateUdev(ixdev)
+		case <-beat:
+			m.health.Beat("manager")
+		case s := <-m.sigs:
+			switch s {
+			case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
+				klog.Infof("Received signal %v, shutting down.", s)
+				return nil
+			}
+		}
+	}
 }
@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+// replicaOccupancy tracks the physical GPUs a time-slicing replica was
+// released from, so that a GPU is reset only once the last of its replicas
+// held by the allocation ledger is released. It is keyed by the parent device
+// uuid and survives rebuilds of the DeviceSet. A pending GPU gets no new
+// allocation, the replicas still held keep running and their health is left
+// alone.
+type replicaOccupancy struct {
+	lk sync.Mutex
+
+	// parent uuids released at least once and waiting for the reset
+	pendingReset map[string]bool
+}
+
+func newReplicaOccupancy() *replicaOccupancy {
+	return &replicaOccupancy{
+		pendingReset: map[string]bool{},
+	}
+}
+
+func (o *replicaOccupancy) isPendingReset(parent string) bool {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	return o.pendingReset[parent]
+}
+
+// release marks the parents of the released replicas pending.
+func (o *replicaOccupancy) release(ids []string) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	for _, id := range ids {
+		parent := gpuallocator.Alias(id).Prefix()
+		if !o.pendingReset[parent] {
+			klog.Infof("Replica %s released, %s pending reset", id, parent)
+			o.pendingReset[parent] = true
+		}
+	}
+}
+
+// ready returns the pending parents none of whose replicas is held anymore.
+func (o *replicaOccupancy) ready(held map[string]bool) []string {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	var ret []string
+	for parent := range o.pendingReset {
+		if !held[parent] {
+			ret = append(ret, parent)
+		}
+	}
+	return ret
+}
+
+func (o *replicaOccupancy) resetDone(parent string) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	delete(o.pendingReset, parent)
+}
+
+// heldParents returns the parents of the replicas the ledger holds.
+func (l *allocationLedger) heldParents() map[string]bool {
+	held := map[string]bool{}
+	for id := range l.heldReplicas() {
+		held[gpuallocator.Alias(id).Prefix()] = true
+	}
+	return held
+}
+
+// trackReplicas resets the pending GPUs once the ledger holds none of their
+// replicas. The ledger marks them pending itself, its releases only wake the
+// loop: the bus drops the events of a subscriber busy resetting. An entry never
+// bound to a pod leaves the ledger without a release, hence the ticker.
+func (d *iluvatarDevice) trackReplicas(ctx context.Context) {
+	klog.Infof("Start to track replica occupancy.")
+
+	sub := d.events.Subscribe("replica occupancy", eventBuffer, bus.Released)
+	defer sub.Close()
+	ticker := time.NewTicker(updatePeriod * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Info("Stoping replica occupancy tracking")
+			return
+		case <-sub.C:
+			d.resetReleasedGpus()
+		case <-ticker.C:
+			d.resetReleasedGpus()
+		}
+	}
+}
+
+func (d *iluvatarDevice) resetReleasedGpus() {
+	for _, parent := range d.occupancy.ready(d.ledger.heldParents()) {
+		dev, ok := d.devices.Load().Devices[parent]
+		if !ok {
+			klog.Warningf("Device %s pending reset is gone", parent)
+			d.occupancy.resetDone(parent)
+			continue
+		}
+		klog.Infof("All replicas of %s released, resetting", parent)
+		d.resetGpus(dev.GenerateIDS())
+		d.occupancy.resetDone(parent)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
+)
+
+// fakeResetter records the gpus it is asked to reset.
+type fakeResetter struct {
+	lk     sync.Mutex
+	resets [][]string
+}
+
+func (r *fakeResetter) InitCmInformer() {}
+
+func (r *fakeResetter) ResetGpus(uuids []string) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	sorted := append([]string(nil), uuids...)
+	sort.Strings(sorted)
+	r.resets = append(r.resets, sorted)
+	return nil
+}
+
+func (r *fakeResetter) calls() [][]string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.resets
+}
+
+func TestSharedGpuResetAfterLastReplica(t *testing.T) {
+	defer func(settle time.Duration) { resetSettleTime = settle }(resetSettleTime)
+	resetSettleTime = 0
+
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Sharing.TimeSlicing.Replicas = 2
+	s := newServerFor(cfg, health.NewTracker(nil), fakeBackend(2),
+		filepath.Join(dir, "allocations.json"), filepath.Join(dir, "ecc.json"))
+	resetter := &fakeResetter{}
+	s.resetClient = resetter
+	s.occupancy = newReplicaOccupancy()
+
+	gpu0 := "GPU-00000000-0000-0000-0000-000000000000"
+	gpu1 := "GPU-00000000-0000-0000-0000-000000000001"
+	pods := map[string]podRef{
+		"default/a": {key: "default/a", uid: "a", devices: []string{gpu0 + "::0"}},
+		"default/b": {key: "default/b", uid: "b", devices: []string{gpu0 + "::1"}},
+		"default/c": {key: "default/c", uid: "c", devices: []string{gpu1 + "::0"}},
+	}
+	now := time.Now()
+	for _, pod := range pods {
+		s.ledger.record(pod.devices, pod.devices, []string{gpuallocator.Alias(pod.devices[0]).Prefix()}, now)
+	}
+	gone := func(e *ledgerEntry) bool {
+		_, ok := pods[e.Pod]
+		return !ok
+	}
+	s.release(s.ledger.sync(pods, gone, now))
+	if s.occupancy.isPendingReset(gpu0) || s.occupancy.isPendingReset(gpu1) {
+		t.Fatal("a gpu is pending reset before any release")
+	}
+
+	// the first replica released: the gpu takes no new allocation, but the
+	// container still holding the other one keeps it
+	delete(pods, "default/a")
+	s.release(s.ledger.sync(pods, gone, now))
+	if !s.occupancy.isPendingReset(gpu0) {
+		t.Fatalf("%s not pending reset once a replica was released", gpu0)
+	}
+	s.resetReleasedGpus()
+	if got := resetter.calls(); len(got) != 0 {
+		t.Fatalf("reset %v while a replica is held", got)
+	}
+
+	// the last replica released: the gpu is reset, once
+	delete(pods, "default/b")
+	s.release(s.ledger.sync(pods, gone, now))
+	s.resetReleasedGpus()
+	s.resetReleasedGpus()
+	if got, want := resetter.calls(), [][]string{{gpu0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reset %v, want %v", got, want)
+	}
+	if s.occupancy.isPendingReset(gpu0) || s.occupancy.isPendingReset(gpu1) {
+		t.Error("a gpu is still pending reset")
+	}
+}
@@ -20,13 +20,18 @@ package dpm
 import (
 	"fmt"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
 	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -40,23 +45,49 @@ type iluvatarDevicePlugin struct {
 
 	name string
 
-	stopList chan struct{}
+	// cancelled once the plugin stops for good
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // GetDevicePluginOptions returns the values of the optional settings for this plugin
 func (p *iluvatarDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{GetPreferredAllocationAvailable: true}, nil
+	return p.options(), nil
 }
 
-// PreStartContainer allows kubelet to pass reinitialized devices to containers.
-func (p *iluvatarDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	klog.Info("PreStartContainer...")
+func (p *iluvatarDevicePlugin) options() *pluginapi.DevicePluginOptions {
+	return &pluginapi.DevicePluginOptions{
+		GetPreferredAllocationAvailable: true,
+		PreStartRequired:                p.devices.Load().Cfg.PreStart.Enabled,
+	}
+}
+
+// PreStartContainer checks the devices of a container before kubelet starts
+// it, so that it fails with the reason instead of at the initialization of
+// its runtime.
+func (p *iluvatarDevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	devSet := p.devices.Load()
+	chips, err := p.preStartChips(devSet, req.DevicesIDs)
+	if err == nil {
+		err = p.preStartCheck(devSet, chips)
+	}
+	if err != nil {
+		klog.Errorf("PreStartContainer for devices %v failed: %v", req.DevicesIDs, err)
+		return nil, fmt.Errorf("pre-start check of '%s' failed: %v", ResourceName, err)
+	}
+
+	klog.Infof("PreStartContainer for devices %v passed, chips: %v", req.DevicesIDs, chips)
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
 // ListAndWatch lists devices
 func (p *iluvatarDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	devs := p.devSet.CachedDevices()
+	// subscribed before listing, so that no change is missed
+	sub := p.events.Subscribe("ListAndWatch", eventBuffer, bus.DeviceAdded, bus.DeviceRemoved,
+		bus.HealthChanged, bus.ResetFinished)
+	defer sub.Close()
+
+	devs := p.devices.Load().CachedDevices()
 
 	klog.Info("Start to list and watch GPU.")
 
@@ -68,22 +99,27 @@ func (p *iluvatarDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.Devi
 
 	for {
 		select {
-		case <-p.stopList:
+		case <-p.ctx.Done():
 			klog.Info("Stoping list and watch GPU.")
 
 			return nil
-		case dev := <-p.deviceCh:
-			devs := p.devSet.CachedDevices()
-			if dev.Replicas == -1 {
+		case <-s.Context().Done():
+			klog.Info("Kubelet closed list and watch GPU.")
+
+			return nil
+		case event := <-sub.C:
+			devs := p.devices.Load().CachedDevices()
+			switch event.Type {
+			case bus.DeviceAdded:
+				klog.Infof("'%s' device added: %s", p.name, event.Device)
+			case bus.DeviceRemoved:
+				klog.Infof("'%s' device removed: %s", p.name, event.Device)
+			case bus.HealthChanged:
+				klog.Infof("'%s' device marked %s: %s", p.name, strings.ToLower(event.Health), event.Device)
+			default:
 				for _, dev := range devs {
 					klog.Infof("L->    %v\n", dev)
 				}
-			} else {
-				if dev.Exposed[0].Health == pluginapi.Unhealthy {
-					klog.Infof("'%s' device marked unhealthy: %s", p.name, dev.UUID)
-				} else {
-					klog.Infof("'%s' device marked healthy: %s", p.name, dev.UUID)
-				}
 			}
 			s.Send(&pluginapi.ListAndWatchResponse{Devices: devs})
 		}
@@ -96,7 +132,12 @@ func (p *iluvatarDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pl
 	response := &pluginapi.PreferredAllocationResponse{}
 
 	for _, req := range r.ContainerRequests {
-		IDs, err := p.alignedAlloc(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		if IDs := p.volcanoPreferred(req); IDs != nil {
+			resp := &pluginapi.ContainerPreferredAllocationResponse{DeviceIDs: IDs}
+			response.ContainerResponses = append(response.ContainerResponses, resp)
+			continue
+		}
+		IDs, err := p.alignedAlloc(p.allocatable(req.AvailableDeviceIDs), req.MustIncludeDeviceIDs, int(req.AllocationSize))
 		if err != nil {
 			klog.Infof("can't use prefered functionality:%v\n", err)
 			return nil, err
@@ -107,30 +148,41 @@ func (p *iluvatarDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pl
 	return response, nil
 }
 
-// GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
-func (p *iluvatarDevicePlugin) alignedAlloc(available, required []string, size int) ([]string, error) {
-	var devices []string
-	if p.devSet.Replicas > 0 {
-		arg := gpuallocator.ReplicaPolicyArgs{Device: p.devSet.BuildReplicaMap(), Available: available, Required: required, Size: size}
-		devices = gpuallocator.NewReplicaPolicy().Allocate(gpuallocator.PolicyArgs(arg))
-
-	} else {
-		availableDevices, err := p.devSet.Filter(available)
-		if err != nil {
-			return nil, fmt.Errorf("unable to retrieve list of available devices: %v", err)
+// volcanoPreferred returns the devices Volcano chose for the container kubelet
+// is about to allocate, so that Allocate matches it by its devices. It returns
+// nil if they are not known.
+func (p *iluvatarDevicePlugin) volcanoPreferred(req *pluginapi.ContainerPreferredAllocationRequest) []string {
+	if !p.devices.Load().Cfg.Flags.UseVolcano || p.kubeclient == nil {
+		return nil
+	}
+	IDs := kube.PreferredVolcanoDevices(p.kubeclient.GetActivePodListCache(), v1.ResourceName(ResourceName),
+		p.allocatable(req.AvailableDeviceIDs), int(req.AllocationSize))
+	for _, id := range req.MustIncludeDeviceIDs {
+		if !slices.Contains(IDs, id) {
+			return nil
 		}
+	}
+	return IDs
+}
 
-		requiredDevices, err := p.devSet.Filter(required)
-		if err != nil {
-			return nil, fmt.Errorf("unable to retrieve list of required devices: %v", err)
+// allocatable drops the replicas of the gpus pending reset, which stay
+// advertised healthy for the containers still running on them.
+func (p *iluvatarDevicePlugin) allocatable(available []string) []string {
+	if p.occupancy == nil {
+		return available
+	}
+	var ret []string
+	for _, id := range available {
+		if !p.occupancy.isPendingReset(gpuallocator.Alias(id).Prefix()) {
+			ret = append(ret, id)
 		}
-
-		arg := gpuallocator.BestPolicyArgs{Available: availableDevices, Required: requiredDevices, Size: size}
-
-		devices = gpuallocator.NewBestEffortPolicy().Allocate(gpuallocator.PolicyArgs(arg))
-
 	}
-	return devices, nil
+	return ret
+}
+
+// GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
+func (p *iluvatarDevicePlugin) alignedAlloc(available, required []string, size int) ([]string, error) {
+	return p.devices.Load().PreferredAllocation(available, required, size)
 }
 
 // Allocate returns list of devices.
@@ -138,24 +190,38 @@ func (p *iluvatarDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.All
 	responses := &pluginapi.AllocateResponse{}
 	klog.Infof("Allocate request: %v", reqs)
 
+	devSet := p.devices.Load()
+
+	// the ids kubelet asked for, before Volcano replaces them
+	kubeletIDs := make([][]string, len(reqs.ContainerRequests))
+	for i, req := range reqs.ContainerRequests {
+		kubeletIDs[i] = append([]string(nil), req.DevicesIDs...)
+	}
+
 	// reset before bind devices
 	uuidResetMap := make(map[string]bool)
+	var bindings []*kube.VolcanoBinding
 	for _, req := range reqs.ContainerRequests {
-		if p.kubeclient != nil {
-			volcanoDevices, isVolcano := p.UseVolcano(req.DevicesIDs)
-			if isVolcano {
-				req.DevicesIDs = volcanoDevices
+		if devSet.Cfg.Flags.UseVolcano {
+			binding, err := p.UseVolcano(req.DevicesIDs)
+			if err != nil {
+				return nil, err
 			}
+			bindings = append(bindings, binding)
+			req.DevicesIDs = binding.Devices
 		}
 		for _, id := range req.DevicesIDs {
-			if !p.devSet.DeviceExist(id) {
+			if !devSet.DeviceExist(id) {
 				return nil, fmt.Errorf("Invalid allocation request for '%s': unknown device: %s", ResourceName, id)
 			}
 			// generateIDS: get all chip UUIDs of the device
-			dev := p.devSet.Devices[gpuallocator.Alias(id).Prefix()]
+			dev := devSet.Devices[gpuallocator.Alias(id).Prefix()]
 			if dev == nil {
 				return nil, fmt.Errorf("Invalid allocation request for '%s': device not found: %s", ResourceName, id)
 			}
+			if p.occupancy != nil && p.occupancy.isPendingReset(dev.UUID) {
+				return nil, fmt.Errorf("Invalid allocation request for '%s': device pending reset: %s", ResourceName, id)
+			}
 			deviceIDs := dev.GenerateIDS()
 			for _, deviceID := range deviceIDs {
 				uuidResetMap[deviceID] = true
@@ -169,28 +235,38 @@ func (p *iluvatarDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.All
 		uuidResetList = append(uuidResetList, uuid)
 	}
 
-	p.resetGpusAndDeviceSet(uuidResetList)
+	// shared gpus are reset when their last replica is released instead
+	if devSet.Replicas == 0 {
+		p.resetGpusAndDeviceSet(uuidResetList)
+		devSet = p.devices.Load()
+	}
 
 	// After GPU reset, DeviceSet is rebuilt and device UUIDs may have changed.
 	// Re-validate that all requested devices still exist in the new DeviceSet.
 	for _, req := range reqs.ContainerRequests {
 		for _, id := range req.DevicesIDs {
-			if !p.devSet.DeviceExist(id) {
+			if !devSet.DeviceExist(id) {
 				return nil, fmt.Errorf("device '%s' no longer exists after GPU reset (UUID may have changed), please retry", id)
 			}
 		}
 	}
 
+	// the pods are bound only once every request passed, a failed
+	// allocation is retried by kubelet and has to match them again
+	if err := p.BindVolcano(bindings); err != nil {
+		return nil, err
+	}
+
 	// bind devices
-	for _, req := range reqs.ContainerRequests {
+	for i, req := range reqs.ContainerRequests {
 		response := &pluginapi.ContainerAllocateResponse{}
 		var deviceIDs []string
 		var replicaIDs []string
 
 		// if all of the device is allocated to device plugin, keep container /dev/iluvatar[devMinor] same order with host
-		if p.devSet.Replicas == 0 && len(req.DevicesIDs) == len(p.devSet.Devices) {
+		if devSet.Replicas == 0 && len(req.DevicesIDs) == len(devSet.Devices) {
 			var devMinors []int
-			for _, device := range p.devSet.Devices {
+			for _, device := range devSet.Devices {
 				for _, chip := range device.Chips {
 					devMinors = append(devMinors, int(chip.Minor))
 				}
@@ -216,7 +292,7 @@ func (p *iluvatarDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.All
 				deviceID := gpuallocator.Alias(id).Prefix()
 				if _, ok := deviceSpecList[deviceID]; !ok {
 					deviceSpecList[deviceID] = true
-					dev := p.devSet.Devices[deviceID]
+					dev := devSet.Devices[deviceID]
 					if dev == nil {
 						return nil, fmt.Errorf("device '%s' not found in DeviceSet after GPU reset", deviceID)
 					}
@@ -231,6 +307,12 @@ func (p *iluvatarDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.All
 		response.Envs["IX_REPLICA_DEVICES"] = strings.Join(replicaIDs, ",")
 
 		responses.ContainerResponses = append(responses.ContainerResponses, response)
+
+		if devSet.Cfg.ComputeMode.Enforce {
+			setComputeMode(p.devices.Backend(), devSet, deviceIDs)
+		}
+		p.ledger.record(kubeletIDs[i], replicaIDs, deviceIDs, time.Now())
+		p.events.Publish(bus.Event{Type: bus.Allocated, Replicas: replicaIDs, Chips: deviceIDs})
 	}
 
 	klog.Infof("Allocate response: %v", responses)
@@ -268,7 +350,7 @@ func (p *iluvatarDevicePlugin) allocateCommonDeviceSpecs() []*pluginapi.DeviceSp
 func (p *iluvatarDevicePlugin) allocateMountsByDeviceID(deviceID string) *pluginapi.Mount {
 	var mount pluginapi.Mount
 
-	for _, dev := range p.devSet.Devices {
+	for _, dev := range p.devices.Load().Devices {
 		if deviceID == dev.UUID {
 			// Mount for iluvatar pod
 		}
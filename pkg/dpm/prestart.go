@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// preStartChips returns the chips handed out for the device ids kubelet passes
+// to PreStartContainer. Volcano may have chosen other devices than kubelet, the
+// ledger tells which.
+func (d *iluvatarDevice) preStartChips(devSet *gpuallocator.DeviceSet, ids []string) ([]string, error) {
+	if chips, ok := d.ledger.devicesOf(ids); ok {
+		return chips, nil
+	}
+
+	seen := map[string]bool{}
+	var chips []string
+	for _, id := range ids {
+		uuid := gpuallocator.Alias(id).Prefix()
+		if seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+		dev := devSet.Devices[uuid]
+		if dev == nil {
+			return nil, fmt.Errorf("device %s is no longer on the node", id)
+		}
+		chips = append(chips, dev.GenerateIDS()...)
+	}
+	return chips, nil
+}
+
+// preStartCheck checks that the chips are still on the node and healthy, and
+// that no process of a previous tenant still runs on them, then applies the
+// configured compute mode and clocks.
+func (d *iluvatarDevice) preStartCheck(devSet *gpuallocator.DeviceSet, chips []string) error {
+	cfg := devSet.Cfg.PreStart
+	for _, uuid := range chips {
+		dev, _ := devSet.FindChip(uuid)
+		if dev == nil {
+			return fmt.Errorf("chip %s is no longer on the node", uuid)
+		}
+		if len(dev.Exposed) > 0 && dev.Exposed[0].Health != pluginapi.Healthy {
+			return fmt.Errorf("chip %s is unhealthy: %s", uuid, d.healthReason(dev))
+		}
+
+		chip, err := d.devices.Backend().NewDeviceByUUID(uuid)
+		if err != nil {
+			return fmt.Errorf("chip %s is not usable: %v", uuid, err)
+		}
+		// the replicas of a shared gpu run along the other containers
+		if devSet.Replicas == 0 {
+			procs, err := chip.DeviceGetComputeRunningProcesses()
+			if err != nil {
+				return fmt.Errorf("chip %s is not usable: %v", uuid, err)
+			}
+			if len(procs) > 0 {
+				return fmt.Errorf("chip %s is still used by a previous tenant: %s", uuid, describeProcesses(procs))
+			}
+		}
+
+		switch cfg.ComputeMode {
+		case config.ComputeModeDefault:
+			err = d.devices.Backend().SetComputeMode(uuid, ixml.ComputeModeDefault)
+		case config.ComputeModeExclusiveProcess:
+			err = d.devices.Backend().SetComputeMode(uuid, ixml.ComputeModeExclusiveProcess)
+		}
+		if err != nil {
+			return fmt.Errorf("set compute mode of chip %s failed: %v", uuid, err)
+		}
+		if mem, sm, ok, _ := cfg.Clocks(); ok {
+			if err := d.devices.Backend().SetApplicationClocks(uuid, mem, sm); err != nil {
+				return fmt.Errorf("set clocks of chip %s failed: %v", uuid, err)
+			}
+		}
+	}
+	return nil
+}
+
+// describeProcesses lists procs by pid, procs is shared with the leak auditor
+// and not sorted in place.
+func describeProcesses(procs []ixml.ProcessInfo) string {
+	procs = slices.Clone(procs)
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+	var descs []string
+	for _, p := range procs {
+		descs = append(descs, fmt.Sprintf("pid %d (%s, %dMiB)", p.Pid, p.Name, p.UsedMemory))
+	}
+	return strings.Join(descs, ", ")
+}
@@ -18,23 +18,43 @@ limitations under the License.
 package dpm
 
 import (
+	"fmt"
+	"math"
 	"net"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ecc"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/kube"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/metrics"
 	"github.com/jochenvg/go-udev"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/utils/clock"
 )
 
 const iluvatarDevicePluginSocket string = "iluvatar-gpu.sock"
 
+// restartBackoff spaces the restarts of a crashed grpc server, and the
+// attempts to register with kubelet.
+var restartBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Cap:      30 * time.Second,
+	Steps:    math.MaxInt32,
+}
+
 // server is a grpc implementation between kubelet and iluvatar device plugin.
 type server struct {
 	// iluvatar device plugin implementation
@@ -46,109 +66,234 @@ type server struct {
 	// socket for kubelet
 	kubeletSocket string
 
-	// iluvatar device plugin grpc server
+	// iluvatar device plugin grpc server, it lives as long as the server
+	// and serves a new listener each time kubelet restarts.
 	grpcServer *grpc.Server
+
+	// lk guards listener and stopped
+	lk       sync.Mutex
+	listener net.Listener
+	stopped  bool
+
+	// the background loops are started once, and waited for on stop
+	loopsOnce sync.Once
+	loops     sync.WaitGroup
+
+	// reported by the debug API health endpoints
+	serving    atomic.Bool
+	registered atomic.Bool
 }
 
-func newServer(cfg *config.Config) *server {
+func newServer(cfg *config.Config, tracker *health.Tracker) *server {
+	return newServerFor(cfg, tracker, ixml.Library, config.LedgerFile, config.EccFile)
+}
+
+// newServerFor creates the server of the chips enumerated by backend, which
+// keeps its allocations in ledgerFile and its ECC errors in eccFile.
+func newServerFor(cfg *config.Config, tracker *health.Tracker, backend ixml.Backend,
+	ledgerFile, eccFile string) *server {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := bus.New(nil)
+	devices := gpuallocator.NewDeviceStore(cfg, backend, clock.RealClock{}, events,
+		gpuallocator.BuildDeviceSet(cfg, backend))
 	ret := &server{
 		socket:        pluginapi.DevicePluginPath + iluvatarDevicePluginSocket,
 		kubeletSocket: pluginapi.KubeletSocket,
-		grpcServer:    nil,
 		iluvatarDevicePlugin: iluvatarDevicePlugin{
 			iluvatarDevice: iluvatarDevice{
-				devSet:          gpuallocator.BuildDeviceSet(cfg),
-				stopCheckHeal:   make(chan struct{}),
-				deviceCh:        make(chan *gpuallocator.Device),
-				volcanoUpdateCh: make(chan struct{}),
-				kubeclient:      nil,
-				resetClient:     nil,
+				devices:     devices,
+				events:      events,
+				kubeclient:  nil,
+				resetClient: nil,
+				exclusion:   newExclusion(cfg.ExcludeDevices),
+				health:      tracker,
+				metrics:     metrics.NewRegistry(),
 			},
-			name:     ResourceName,
-			stopList: make(chan struct{}),
+			name:   ResourceName,
+			ctx:    ctx,
+			cancel: cancel,
 		},
 	}
 
-	if cfg.Flags.UseVolcano {
-		var err error
-		ret.kubeclient, err = kube.NewKubeClient()
-		if err != nil {
+	ret.grpcServer = grpc.NewServer([]grpc.ServerOption{}...)
+	pluginapi.RegisterDevicePluginServer(ret.grpcServer, ret)
+
+	var err error
+	ret.kubeclient, err = kube.NewKubeClient()
+	if err != nil {
+		if cfg.Flags.UseVolcano || cfg.Flags.Maintenance || cfg.Flags.ExcludeAnnotation {
 			klog.Errorf("Failed to create kube client: %s", err)
 			klog.Flush()
 			os.Exit(1)
 		}
+		klog.Warningf("Kube client not available, node annotations and events are disabled: %s", err)
+	} else {
+		ret.kubeclient.InitEventRecorder()
 	}
 
 	klog.Infof("Config ResetGpu flag: %v", cfg.Flags.ResetGpu)
-	if cfg.Flags.ResetGpu {
-		klog.Info("Creating resetClient because ResetGpu is enabled")
+	if cfg.Flags.ResetGpu || cfg.Flags.Maintenance {
+		klog.Info("Creating resetClient because ResetGpu or Maintenance is enabled")
 		ret.resetClient = kube.NewResetClient()
 	} else {
 		klog.Info("ResetClient not created because ResetGpu is disabled")
 	}
 
-	ret.devSet.ShowLayout()
+	if cfg.Flags.Maintenance {
+		ret.maintenance = newMaintenance()
+	}
+
+	if cfg.Flags.ResetGpu && cfg.Sharing.TimeSlicing.Replicas > 0 {
+		klog.Info("Shared gpus are reset once all of their replicas are released")
+		ret.occupancy = newReplicaOccupancy()
+	}
+
+	ret.ledger, err = loadLedger(ledgerFile)
+	if err != nil {
+		klog.Warningf("Starting with an empty allocation ledger: %v", err)
+	}
+
+	eccStore, err := ecc.Load(eccFile)
+	if err != nil {
+		klog.Warningf("Starting with no ECC errors counted: %v", err)
+	}
+	ret.ecc = newEccCounter(eccStore, cfg.Ecc, ret.metrics)
+
+	ret.leaks = newLeakAuditor(cfg.LeakedProcesses.Action, ret.metrics)
+	ret.computeModes = newComputeModes(cfg.ComputeMode.Enforce, ret.metrics)
+	if cfg.Degraded.Enabled {
+		ret.degradation = newDegradation(cfg.Degraded, ret.metrics)
+	}
+	if cfg.Gpm.Enabled {
+		ret.gpm = newGpmSampler(cfg.Gpm, ret.metrics)
+	}
+
+	ret.devices.SetOverride(ret.adminUnhealthy)
+
+	ret.devices.Load().ShowLayout()
 
 	return ret
 }
 
+// start serves the plugin socket and registers it with kubelet. It is called
+// again each time kubelet restarts, as kubelet removes the plugin sockets: the
+// grpc server and the background loops are kept, so Allocate is answered on
+// the previous connection until kubelet dials the new socket.
 func (s *server) start() error {
-	s.grpcServer = grpc.NewServer([]grpc.ServerOption{}...)
+	s.registered.Store(false)
 
-	err := s.createServer()
+	err := s.listen()
 	if err != nil {
 		klog.Errorf("Failed to create gprc server for '%s': %s", s.name, err)
-		s.cleanup()
 		return err
 	}
 	klog.Infof("Create grpc server '%s' on '%s'", s.name, s.socket)
+	s.serving.Store(true)
 
 	err = s.register()
 	if err != nil {
 		klog.Errorf("Failed to register device plugin: '%s'", s.name)
-		s.stop()
 		return err
 	}
 	klog.Infof("Register device plugin for '%s' with Kubelet", s.name)
+	s.registered.Store(true)
+	s.health.Watch("grpc", s.probe)
+
+	s.loopsOnce.Do(s.startLoops)
+
+	return nil
+}
+
+// startLoops starts the background loops, exactly one of each for the
+// lifetime of the server.
+func (s *server) startLoops() {
+	run := func(loop func(ctx context.Context)) {
+		s.loops.Add(1)
+		go func() {
+			defer s.loops.Done()
+			loop(s.ctx)
+		}()
+	}
 
 	if s.resetClient != nil {
 		go s.resetClient.InitCmInformer()
 	}
 
-	go s.checkHealth()
+	run(s.checkHealth)
+	run(s.reportDeviceEvents)
 
+	// the pods are only cached for Volcano, and the node for the annotations
+	// read by the plugin
 	if s.kubeclient != nil {
-		go s.updateDeviceinfo()
-		s.kubeclient.InitPodInformer()
+		if s.devices.Cfg.Flags.UseVolcano {
+			s.kubeclient.InitPodInformer()
+		}
+		if s.maintenance != nil || s.devices.Cfg.Flags.ExcludeAnnotation {
+			s.kubeclient.InitNodeInformer(s.onNodeUpdate)
+		}
+		s.health.Watch("informers", s.kubeclient.CheckInformers)
+	}
 
-		s.notifyVolcanoUpdate()
+	// the device info is written once the pods are cached
+	if s.devices.Cfg.Flags.UseVolcano {
+		run(s.updateDeviceinfo)
 	}
 
-	return nil
+	if s.maintenance != nil {
+		run(s.maintainDevices)
+	}
+
+	if s.occupancy != nil {
+		run(s.trackReplicas)
+	}
+
+	run(s.ledger.persist)
+	run(s.trackAllocations)
+	run(s.auditLeaks)
+	run(s.checkComputeModes)
+	if s.degradation != nil {
+		run(s.checkDegraded)
+	}
+	if s.gpm != nil {
+		run(s.sampleGpm)
+	}
 }
 
+// stop stops serving and the background loops, it may be called any number
+// of times.
 func (s *server) stop() error {
-	if s == nil || s.grpcServer == nil {
+	s.lk.Lock()
+	if s.stopped {
+		s.lk.Unlock()
 		return nil
 	}
+	s.stopped = true
+	s.lk.Unlock()
+
 	klog.Infof("Stopping serve '%s' on %s", s.name, s.socket)
+	s.health.Forget("grpc")
+	s.health.Forget("informers")
+	s.cancel()
 	s.grpcServer.Stop()
+	s.loops.Wait()
+
+	s.serving.Store(false)
+	s.registered.Store(false)
 	if err := os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-
-	s.stopList <- struct{}{}
-	s.stopCheckHeal <- struct{}{}
-
-	s.cleanup()
 	return nil
 }
 
-func (s *server) cleanup() {
-	s.grpcServer = nil
-}
+// listen creates the plugin socket and serves it, in place of the socket of
+// the previous kubelet if any.
+func (s *server) listen() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.stopped {
+		return fmt.Errorf("server '%s' is stopped", s.name)
+	}
 
-func (s *server) createServer() error {
 	// Remove the socket if exist.
 	os.Remove(s.socket)
 
@@ -157,38 +302,14 @@ func (s *server) createServer() error {
 	if err != nil {
 		return err
 	}
+	// the path is the one of the next listener by the time this one is closed
+	sock.(*net.UnixListener).SetUnlinkOnClose(false)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.listener = sock
 
-	pluginapi.RegisterDevicePluginServer(s.grpcServer, s)
-
-	go func() {
-		lastCrashTime := time.Now()
-		restartCount := 0
-		for {
-			klog.Infof("Starting GRPC server for '%s'", s.name)
-			err := s.grpcServer.Serve(sock)
-			if err == nil {
-				break
-			}
-
-			klog.Infof("GRPC server for '%s' crashed with error: %v", s.name, err)
-
-			// restart if it has not been too often
-			// i.e. if server has crashed more than 5 times and it didn't last more than one hour each time
-			if restartCount > 5 {
-				// quit
-				klog.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", s.name)
-			}
-			timeSinceLastCrash := time.Since(lastCrashTime).Seconds()
-			lastCrashTime = time.Now()
-			if timeSinceLastCrash > 3600 {
-				// it has been one hour since the last crash.. reset the count
-				// to reflect on the frequency
-				restartCount = 1
-			} else {
-				restartCount++
-			}
-		}
-	}()
+	go s.serve(sock)
 
 	// Wait for server to start by launching a blocking connexion
 	conn, err := s.dial(s.socket, 5*time.Second)
@@ -200,8 +321,53 @@ func (s *server) createServer() error {
 	return nil
 }
 
+// current tells whether sock is still the listener to serve.
+func (s *server) current(sock net.Listener) bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return !s.stopped && s.listener == sock
+}
+
+func (s *server) serve(sock net.Listener) {
+	lastCrashTime := time.Now()
+	restartCount := 0
+	backoff := restartBackoff
+	for {
+		klog.Infof("Starting GRPC server for '%s'", s.name)
+		err := s.grpcServer.Serve(sock)
+		if err == nil || !s.current(sock) {
+			break
+		}
+
+		klog.Infof("GRPC server for '%s' crashed with error: %v", s.name, err)
+
+		// restart if it has not been too often
+		// i.e. if server has crashed more than 5 times and it didn't last more than one hour each time
+		if restartCount > 5 {
+			// quit
+			klog.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", s.name)
+		}
+		timeSinceLastCrash := time.Since(lastCrashTime).Seconds()
+		lastCrashTime = time.Now()
+		if timeSinceLastCrash > 3600 {
+			// it has been one hour since the last crash.. reset the count
+			// to reflect on the frequency
+			restartCount = 1
+			backoff = restartBackoff
+		} else {
+			restartCount++
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
 func (s *server) register() error {
-	conn, err := s.dial(pluginapi.KubeletSocket, 5*time.Second)
+	conn, err := s.dial(s.kubeletSocket, 5*time.Second)
 	if err != nil {
 		return err
 	}
@@ -212,9 +378,7 @@ func (s *server) register() error {
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(s.socket),
 		ResourceName: s.name,
-		Options: &pluginapi.DevicePluginOptions{
-			GetPreferredAllocationAvailable: true,
-		},
+		Options:      s.options(),
 	}
 
 	_, err = client.Register(context.Background(), reqt)
@@ -224,6 +388,21 @@ func (s *server) register() error {
 	return nil
 }
 
+// probe calls the grpc server the way kubelet does, it fails if the server
+// does not answer in time.
+func (s *server) probe() error {
+	conn, err := s.dial(s.socket, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("dial %s failed: %v", s.socket, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = pluginapi.NewDevicePluginClient(conn).GetDevicePluginOptions(ctx, &pluginapi.Empty{})
+	return err
+}
+
 // dial establishes the gRPC communication with the registered device plugin.
 func (s *server) dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
 	c, err := grpc.Dial(unixSocketPath, grpc.WithInsecure(), grpc.WithBlock(),
@@ -241,5 +420,5 @@ func (s *server) dial(unixSocketPath string, timeout time.Duration) (*grpc.Clien
 }
 
 func (s *server) updateUdev(dev *udev.Device) {
-	s.devSet.UpdateUdev(dev)
+	s.devices.UpdateUdev(dev)
 }
@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dpm
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/health"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeBackend enumerates count healthy single chip gpus.
+func fakeBackend(count int) *ixml.FakeBackend {
+	backend := &ixml.FakeBackend{}
+	for i := 0; i < count; i++ {
+		backend.Devices = append(backend.Devices, &ixml.FakeDevice{
+			Name:          "Iluvatar BI-V100",
+			UUID:          fmt.Sprintf("GPU-00000000-0000-0000-0000-00000000000%d", i),
+			Index:         uint(i),
+			Minor:         uint(i),
+			Serial:        fmt.Sprintf("SN%d", i),
+			BoardID:       uint32(i),
+			BoardPosition: -1,
+			NumaNode:      -1,
+			Pci:           ixml.PciInfo{BusId: fmt.Sprintf("0000:%02x:00.0", i+1), Bus: uint(i + 1)},
+		})
+	}
+	return backend
+}
+
+// fakeKubelet answers the registrations of the device plugins on a socket.
+type fakeKubelet struct {
+	pluginapi.UnimplementedRegistrationServer
+	server        *grpc.Server
+	registrations atomic.Int32
+}
+
+func startFakeKubelet(t *testing.T, socket string) *fakeKubelet {
+	sock, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen on kubelet socket failed: %v", err)
+	}
+	k := &fakeKubelet{server: grpc.NewServer()}
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(sock)
+	return k
+}
+
+func (k *fakeKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.registrations.Add(1)
+	return &pluginapi.Empty{}, nil
+}
+
+// restart stops kubelet and removes the sockets of its directory, as kubelet
+// does, then starts it again.
+func (k *fakeKubelet) restart(t *testing.T, socket string) *fakeKubelet {
+	k.server.Stop()
+	sockets, _ := filepath.Glob(filepath.Join(filepath.Dir(socket), "*.sock"))
+	for _, path := range sockets {
+		os.Remove(path)
+	}
+	return startFakeKubelet(t, socket)
+}
+
+func newTestServer(t *testing.T, dir string) *server {
+	cfg := &config.Config{}
+	s := newServerFor(cfg, health.NewTracker(nil), fakeBackend(2),
+		filepath.Join(dir, "allocations.json"), filepath.Join(dir, "ecc.json"))
+	s.socket = filepath.Join(dir, iluvatarDevicePluginSocket)
+	s.kubeletSocket = filepath.Join(dir, "kubelet.sock")
+	return s
+}
+
+// runningLoops counts the goroutines running the health check loop.
+func runningLoops() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Count(string(buf[:n]), "(*iluvatarDevice).checkHealth(")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// allocate asks the plugin for the first device, as kubelet does.
+func allocate(t *testing.T, s *server) {
+	conn, err := s.dial(s.socket, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial plugin failed: %v", err)
+	}
+	defer conn.Close()
+
+	var id string
+	for _, dev := range s.devices.Load().Devices {
+		if id == "" || dev.Exposed[0].ID < id {
+			id = dev.Exposed[0].ID
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := pluginapi.NewDevicePluginClient(conn).Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{id}}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if len(resp.ContainerResponses) != 1 || len(resp.ContainerResponses[0].Devices) == 0 {
+		t.Fatalf("Allocate returned no device: %v", resp)
+	}
+}
+
+func TestServerSurvivesKubeletRestarts(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t, dir)
+	kubelet := startFakeKubelet(t, s.kubeletSocket)
+	defer func() { kubelet.server.Stop() }()
+
+	for i := 1; i <= 3; i++ {
+		if i > 1 {
+			kubelet = kubelet.restart(t, s.kubeletSocket)
+		}
+		if err := s.start(); err != nil {
+			t.Fatalf("start %d failed: %v", i, err)
+		}
+		if got := kubelet.registrations.Load(); got != 1 {
+			t.Errorf("start %d registered %d times with kubelet, want 1", i, got)
+		}
+		if !s.serving.Load() || !s.registered.Load() {
+			t.Errorf("start %d: serving %v registered %v", i, s.serving.Load(), s.registered.Load())
+		}
+		allocate(t, s)
+		if got := runningLoops(); got != 1 {
+			t.Errorf("start %d: %d health check loops running, want 1", i, got)
+		}
+	}
+
+	if err := s.stop(); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	if err := s.stop(); err != nil {
+		t.Errorf("second stop failed: %v", err)
+	}
+	if got := runningLoops(); got != 0 {
+		t.Errorf("%d health check loops running after stop", got)
+	}
+	if _, err := os.Stat(s.socket); !os.IsNotExist(err) {
+		t.Errorf("plugin socket left after stop: %v", err)
+	}
+	if err := s.start(); err == nil {
+		t.Error("start after stop succeeded")
+	}
+}
+
+func TestRestarterBacksOff(t *testing.T) {
+	failures := 2
+	starts := 0
+	var delays []time.Duration
+	r := newRestarter(func() error {
+		starts++
+		if starts <= failures {
+			return fmt.Errorf("kubelet is not running")
+		}
+		return nil
+	}, func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		return make(chan time.Time)
+	})
+
+	for r.start(); r.retry != nil; r.start() {
+	}
+	if starts != failures+1 {
+		t.Errorf("started %d times, want %d", starts, failures+1)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second}; fmt.Sprint(delays) != fmt.Sprint(want) {
+		t.Errorf("retried after %v, want %v", delays, want)
+	}
+
+	// a failure after a success starts over from the first delay
+	failures = starts + 1
+	delays = nil
+	r.start()
+	if r.retry == nil || fmt.Sprint(delays) != fmt.Sprint([]time.Duration{time.Second}) {
+		t.Errorf("retried after %v once the plugin ran, want 1s", delays)
+	}
+}
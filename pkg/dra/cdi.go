@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dra
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+)
+
+const (
+	cdiVersion  = "0.5.0"
+	cdiKind     = "iluvatar.com/gpu"
+	cdiSpecDir  = "/var/run/cdi"
+	cdiKindFile = "iluvatar.com-gpu"
+)
+
+// Subset of the Container Device Interface spec used by the plugin.
+type cdiSpec struct {
+	Version string      `json:"cdiVersion"`
+	Kind    string      `json:"kind"`
+	Devices []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env         []string        `json:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+func claimDeviceName(claimUID string) string {
+	return "claim-" + claimUID
+}
+
+func claimSpecPath(claimUID string) string {
+	return filepath.Join(cdiSpecDir, cdiKindFile+"_"+claimUID+".json")
+}
+
+// buildClaimSpec describes the devices of a claim as a single CDI device, so
+// that the container sees the device nodes and the uuids of all of them.
+func buildClaimSpec(claimUID string, devs []*gpuallocator.Device) *cdiSpec {
+	edits := cdiContainerEdits{}
+	for _, dev := range []string{"/dev/itrctl"} {
+		if _, err := os.Stat(dev); err == nil {
+			edits.DeviceNodes = append(edits.DeviceNodes, cdiDeviceNode{Path: dev, HostPath: dev, Permissions: "rw"})
+		}
+	}
+
+	var uuids []string
+	for _, dev := range devs {
+		for _, c := range dev.SortedChips() {
+			node := config.HostPathPrefix + config.DeviceName + strconv.Itoa(int(c.Minor))
+			edits.DeviceNodes = append(edits.DeviceNodes, cdiDeviceNode{Path: node, HostPath: node, Permissions: "rw"})
+			uuids = append(uuids, c.UUID)
+		}
+	}
+	edits.Env = append(edits.Env, "IX_VISIBLE_DEVICES="+strings.Join(uuids, ","))
+
+	return &cdiSpec{
+		Version: cdiVersion,
+		Kind:    cdiKind,
+		Devices: []cdiDevice{{Name: claimDeviceName(claimUID), ContainerEdits: edits}},
+	}
+}
+
+// writeClaimSpec writes the spec of a claim and returns the fully qualified
+// name of its CDI device.
+func writeClaimSpec(claimUID string, devs []*gpuallocator.Device) (string, error) {
+	data, err := json.MarshalIndent(buildClaimSpec(claimUID, devs), "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshal cdi spec failed: %v", err)
+	}
+
+	if err := os.MkdirAll(cdiSpecDir, 0755); err != nil {
+		return "", fmt.Errorf("create %s failed: %v", cdiSpecDir, err)
+	}
+
+	// write then rename, the runtime never reads a partial spec
+	path := claimSpecPath(claimUID)
+	tmp := filepath.Join(cdiSpecDir, "."+filepath.Base(path))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", fmt.Errorf("write cdi spec failed: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("write cdi spec failed: %v", err)
+	}
+	return cdiKind + "=" + claimDeviceName(claimUID), nil
+}
+
+func removeClaimSpec(claimUID string) error {
+	if err := os.Remove(claimSpecPath(claimUID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove cdi spec failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dra implements a Dynamic Resource Allocation kubelet plugin for
+// iluvatar gpus, an alternative to the device plugin of package dpm.
+package dra
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"github.com/jochenvg/go-udev"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	resourceapi "k8s.io/api/resource/v1alpha2"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+	"k8s.io/utils/clock"
+)
+
+const (
+	// DriverName is the name of the driver in ResourceClasses and ResourceSlices.
+	DriverName = "gpu.iluvatar.com"
+
+	pluginRegistrationPath = "/var/lib/kubelet/plugins_registry"
+	pluginPath             = "/var/lib/kubelet/plugins/" + DriverName
+	pluginSocket           = "plugin.sock"
+	registrationSocket     = DriverName + "-reg.sock"
+
+	healthCheckPeriod = 5 * time.Second
+)
+
+// Driver serves the kubelet plugin registration and the DRA node services.
+type Driver struct {
+	devices *gpuallocator.DeviceStore
+	events  *bus.Bus
+
+	// resource model last sent to kubelet
+	lk     sync.Mutex
+	model  *resourceapi.ResourceModel
+	update chan struct{}
+	stop   chan struct{}
+
+	pluginServer       *grpc.Server
+	registrationServer *grpc.Server
+}
+
+// NewDriver builds the devices of the node according to cfg.
+func NewDriver(cfg *config.Config) *Driver {
+	events := bus.New(nil)
+	devices := gpuallocator.NewDeviceStore(cfg, ixml.Library, clock.RealClock{}, events,
+		gpuallocator.BuildDeviceSet(cfg, ixml.Library))
+	d := &Driver{
+		devices: devices,
+		events:  events,
+		update:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	d.model = buildResourceModel(d.devices.Load())
+	d.devices.Load().ShowLayout()
+	return d
+}
+
+// Start serves the node services, then registers the plugin with kubelet
+// which discovers the registration socket.
+func (d *Driver) Start() error {
+	if err := os.MkdirAll(pluginPath, 0750); err != nil {
+		return fmt.Errorf("create %s failed: %v", pluginPath, err)
+	}
+
+	d.pluginServer = grpc.NewServer()
+	drapb.RegisterNodeServer(d.pluginServer, d)
+	if err := serve(d.pluginServer, filepath.Join(pluginPath, pluginSocket)); err != nil {
+		return err
+	}
+
+	d.registrationServer = grpc.NewServer()
+	registerapi.RegisterRegistrationServer(d.registrationServer, d)
+	if err := serve(d.registrationServer, filepath.Join(pluginRegistrationPath, registrationSocket)); err != nil {
+		d.pluginServer.Stop()
+		return err
+	}
+
+	go d.checkHealth(d.events.Subscribe("resource model", 16, bus.DeviceAdded, bus.DeviceRemoved))
+
+	klog.Infof("DRA plugin '%s' started", DriverName)
+	return nil
+}
+
+// Stop stops serving kubelet, the prepared claims are left untouched.
+func (d *Driver) Stop() {
+	close(d.stop)
+	if d.registrationServer != nil {
+		d.registrationServer.Stop()
+	}
+	if d.pluginServer != nil {
+		d.pluginServer.Stop()
+	}
+	os.Remove(filepath.Join(pluginRegistrationPath, registrationSocket))
+	os.Remove(filepath.Join(pluginPath, pluginSocket))
+}
+
+func serve(server *grpc.Server, socket string) error {
+	os.Remove(socket)
+	sock, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("listen on %s failed: %v", socket, err)
+	}
+
+	go func() {
+		klog.Infof("Starting GRPC server on '%s'", socket)
+		if err := server.Serve(sock); err != nil {
+			klog.Errorf("GRPC server on '%s' stopped: %v", socket, err)
+		}
+	}()
+	return nil
+}
+
+func (d *Driver) UpdateUdev(dev *udev.Device) {
+	d.devices.UpdateUdev(dev)
+}
+
+// checkHealth refreshes the chip health, and resends the resource model when
+// the devices or their health changed. Added or removed devices are sent
+// right away.
+func (d *Driver) checkHealth(sub *bus.Subscription) {
+	ticker := time.NewTicker(healthCheckPeriod)
+	defer ticker.Stop()
+	defer sub.Close()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-sub.C:
+		}
+
+		event := gpuallocator.HealthEvent{}
+		for _, dev := range d.devices.Load().Devices {
+			for _, c := range dev.Chips {
+				health, err := c.Operations.DeviceGetHealth()
+				if ixml.IsNotSupported(err) {
+					health, err = 0, nil
+				}
+				herr := ixml.CheckDeviceError(health)
+				if err != nil {
+					event[c.UUID] = gpuallocator.ChipHealth{Health: pluginapi.Unhealthy, Reason: err.Error()}
+				} else if len(herr) > 0 {
+					event[c.UUID] = gpuallocator.ChipHealth{Health: pluginapi.Unhealthy, Reason: ixml.JoinDeviceErrors(herr)}
+				} else {
+					event[c.UUID] = gpuallocator.ChipHealth{Health: pluginapi.Healthy}
+				}
+			}
+		}
+		for _, dev := range d.devices.ApplyHealth(event) {
+			klog.Infof("Device %s health changed to %s", dev.UUID, dev.Exposed[0].Health)
+		}
+
+		model := buildResourceModel(d.devices.Load())
+		d.lk.Lock()
+		changed := !reflect.DeepEqual(model, d.model)
+		d.model = model
+		d.lk.Unlock()
+
+		if changed {
+			select {
+			case d.update <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// GetInfo is the kubelet plugin registration.
+func (d *Driver) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DRAPlugin,
+		Name:              DriverName,
+		Endpoint:          filepath.Join(pluginPath, pluginSocket),
+		SupportedVersions: []string{"1.0.0"},
+	}, nil
+}
+
+func (d *Driver) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if !status.PluginRegistered {
+		klog.Errorf("DRA plugin registration failed: %s", status.Error)
+	} else {
+		klog.Infof("DRA plugin '%s' registered with kubelet", DriverName)
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// NodeListAndWatchResources sends the devices kubelet publishes in the
+// ResourceSlice of the node.
+func (d *Driver) NodeListAndWatchResources(req *drapb.NodeListAndWatchResourcesRequest, s drapb.Node_NodeListAndWatchResourcesServer) error {
+	for {
+		d.lk.Lock()
+		model := d.model
+		d.lk.Unlock()
+
+		klog.Infof("Publish %d devices", len(model.NamedResources.Instances))
+		if err := s.Send(&drapb.NodeListAndWatchResourcesResponse{Resources: []*resourceapi.ResourceModel{model}}); err != nil {
+			return err
+		}
+
+		select {
+		case <-d.stop:
+			return nil
+		case <-s.Context().Done():
+			return nil
+		case <-d.update:
+		}
+	}
+}
+
+// NodePrepareResources prepares the claims as CDI devices.
+func (d *Driver) NodePrepareResources(ctx context.Context, req *drapb.NodePrepareResourcesRequest) (*drapb.NodePrepareResourcesResponse, error) {
+	resp := &drapb.NodePrepareResourcesResponse{Claims: map[string]*drapb.NodePrepareResourceResponse{}}
+	for _, claim := range req.Claims {
+		cdiDevice, err := d.prepareClaim(claim)
+		if err != nil {
+			klog.Errorf("Failed to prepare claim %s/%s: %v", claim.Namespace, claim.Name, err)
+			resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		klog.Infof("Prepared claim %s/%s as %s", claim.Namespace, claim.Name, cdiDevice)
+		resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{CDIDevices: []string{cdiDevice}}
+	}
+	return resp, nil
+}
+
+func (d *Driver) prepareClaim(claim *drapb.Claim) (string, error) {
+	if len(claim.StructuredResourceHandle) == 0 {
+		return "", fmt.Errorf("claim is not allocated with structured parameters")
+	}
+
+	var names []string
+	for _, handle := range claim.StructuredResourceHandle {
+		for _, result := range handle.Results {
+			if result.NamedResources != nil {
+				names = append(names, result.NamedResources.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("claim allocates no device")
+	}
+
+	devices := map[string]*gpuallocator.Device{}
+	for _, dev := range d.devices.Load().Devices {
+		devices[instanceName(dev)] = dev
+	}
+
+	var devs []*gpuallocator.Device
+	for _, name := range names {
+		dev, ok := devices[name]
+		if !ok {
+			return "", fmt.Errorf("device %s not found", name)
+		}
+		if dev.Exposed[0].Health != pluginapi.Healthy {
+			return "", fmt.Errorf("device %s(%s) is unhealthy", name, dev.UUID)
+		}
+		devs = append(devs, dev)
+	}
+
+	return writeClaimSpec(claim.Uid, devs)
+}
+
+// NodeUnprepareResources removes the CDI devices of the claims.
+func (d *Driver) NodeUnprepareResources(ctx context.Context, req *drapb.NodeUnprepareResourcesRequest) (*drapb.NodeUnprepareResourcesResponse, error) {
+	resp := &drapb.NodeUnprepareResourcesResponse{Claims: map[string]*drapb.NodeUnprepareResourceResponse{}}
+	for _, claim := range req.Claims {
+		if err := removeClaimSpec(claim.Uid); err != nil {
+			klog.Errorf("Failed to unprepare claim %s/%s: %v", claim.Namespace, claim.Name, err)
+			resp.Claims[claim.Uid] = &drapb.NodeUnprepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		klog.Infof("Unprepared claim %s/%s", claim.Namespace, claim.Name)
+		resp.Claims[claim.Uid] = &drapb.NodeUnprepareResourceResponse{}
+	}
+	return resp, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dra
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
+	resourceapi "k8s.io/api/resource/v1alpha2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// instanceName is the name of dev in the ResourceSlice. It is derived from the
+// uuid, or the PCI bus id of the master chip, which stay the same when the
+// devices are enumerated in another order, and has to be a DNS label.
+func instanceName(dev *gpuallocator.Device) string {
+	if name := "gpu-" + dnsLabel(dev.UUID); len(validation.IsDNS1123Label(name)) == 0 {
+		return name
+	}
+	if master := dev.GetMasterChip(); master != nil {
+		if name := "gpu-pci-" + dnsLabel(master.BusID); len(validation.IsDNS1123Label(name)) == 0 {
+			return name
+		}
+	}
+	return fmt.Sprintf("gpu-minor-%d", dev.Minor)
+}
+
+// dnsLabel lowers s and replaces what a DNS label can not hold with dashes.
+func dnsLabel(s string) string {
+	label := strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '-'
+	}, s)
+	return strings.Trim(label, "-")
+}
+
+func stringAttr(name, value string) resourceapi.NamedResourcesAttribute {
+	return resourceapi.NamedResourcesAttribute{
+		Name:                         name,
+		NamedResourcesAttributeValue: resourceapi.NamedResourcesAttributeValue{StringValue: &value},
+	}
+}
+
+func intAttr(name string, value int64) resourceapi.NamedResourcesAttribute {
+	return resourceapi.NamedResourcesAttribute{
+		Name:                         name,
+		NamedResourcesAttributeValue: resourceapi.NamedResourcesAttributeValue{IntValue: &value},
+	}
+}
+
+func stringSliceAttr(name string, values []string) resourceapi.NamedResourcesAttribute {
+	return resourceapi.NamedResourcesAttribute{
+		Name: name,
+		NamedResourcesAttributeValue: resourceapi.NamedResourcesAttributeValue{
+			StringSliceValue: &resourceapi.NamedResourcesStringSlice{Strings: values},
+		},
+	}
+}
+
+// buildInstance describes dev, a board or a single chip with splitboard, and
+// its chips in the attributes a claim can select on.
+func buildInstance(dev *gpuallocator.Device) resourceapi.NamedResourcesInstance {
+	var memory uint64
+	var uuids, busIDs []string
+	chips := dev.SortedChips()
+	for _, c := range chips {
+		memory += c.MemoryTotal
+		uuids = append(uuids, c.UUID)
+		busIDs = append(busIDs, c.BusID)
+	}
+
+	attrs := []resourceapi.NamedResourcesAttribute{
+		stringAttr("uuid", dev.UUID),
+		stringAttr("product", dev.Name),
+		{
+			Name: "memory",
+			NamedResourcesAttributeValue: resourceapi.NamedResourcesAttributeValue{
+				QuantityValue: resource.NewQuantity(int64(memory)*1024*1024, resource.BinarySI),
+			},
+		},
+		intAttr("chipCount", int64(len(chips))),
+		stringSliceAttr("chipUUIDs", uuids),
+		stringSliceAttr("pciBusIDs", busIDs),
+	}
+	if master := dev.GetMasterChip(); master != nil {
+		attrs = append(attrs, intAttr("boardID", int64(master.BoardID)), intAttr("numaNode", int64(master.NumaNode)))
+	}
+
+	var links []string
+	for uuid, l := range dev.Links {
+		for _, link := range l {
+			links = append(links, uuid+"="+gpuallocator.P2PLinkTypeToString(link.Type))
+		}
+	}
+	if len(links) > 0 {
+		sort.Strings(links)
+		attrs = append(attrs, stringSliceAttr("p2pLinks", links))
+	}
+
+	return resourceapi.NamedResourcesInstance{
+		Name:       instanceName(dev),
+		Attributes: attrs,
+	}
+}
+
+// buildResourceModel describes the healthy devices of devSet, unhealthy ones
+// are left out so that no claim is allocated to them.
+func buildResourceModel(devSet *gpuallocator.DeviceSet) *resourceapi.ResourceModel {
+	var instances []resourceapi.NamedResourcesInstance
+	for _, dev := range devSet.Devices {
+		if dev.Exposed[0].Health != pluginapi.Healthy {
+			continue
+		}
+		instances = append(instances, buildInstance(dev))
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	return &resourceapi.ResourceModel{
+		NamedResources: &resourceapi.NamedResourcesResources{Instances: instances},
+	}
+}
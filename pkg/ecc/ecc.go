@@ -0,0 +1,227 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ecc counts the ECC errors of the chips across driver reloads and
+// reboots, which reset the counters of the driver.
+package ecc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+)
+
+// bootIDFile changes on every boot of the node.
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// Record is the ECC errors counted on a chip over all the driver loads.
+type Record struct {
+	Corrected   uint64 `json:"corrected"`
+	Uncorrected uint64 `json:"uncorrected"`
+	// LastCorrected and LastUncorrected are the counters of the driver read
+	// last
+	LastCorrected   uint64 `json:"lastCorrected"`
+	LastUncorrected uint64 `json:"lastUncorrected"`
+	// BootID is the boot of the node the counters were read last in
+	BootID string `json:"bootID,omitempty"`
+	// HourCorrected are the corrected errors counted since HourStart, and
+	// LastHourCorrected the ones of the hour before
+	HourStart         time.Time `json:"hourStart"`
+	HourCorrected     uint64    `json:"hourCorrected"`
+	LastHourCorrected uint64    `json:"lastHourCorrected"`
+	Updated           time.Time `json:"updated"`
+}
+
+// since returns the errors counted from last to cur. The driver restarted
+// counting from zero if the node rebooted meanwhile, or if cur is lower as
+// when it was reloaded.
+func since(cur, last uint64, rebooted bool) uint64 {
+	if rebooted || cur < last {
+		return cur
+	}
+	return cur - last
+}
+
+// apply adds the errors counted since the last read, during the boot bootID,
+// which is empty if unknown. It returns false if nothing was counted and no
+// hour passed.
+func (r *Record) apply(counts ixml.EccCounts, bootID string, now time.Time) bool {
+	rebooted := bootID != "" && r.BootID != "" && bootID != r.BootID
+	corrected := since(counts.Corrected, r.LastCorrected, rebooted)
+	uncorrected := since(counts.Uncorrected, r.LastUncorrected, rebooted)
+	changed := corrected > 0 || uncorrected > 0 || counts.Corrected != r.LastCorrected ||
+		counts.Uncorrected != r.LastUncorrected || (bootID != "" && bootID != r.BootID)
+
+	r.Corrected += corrected
+	r.Uncorrected += uncorrected
+	r.LastCorrected, r.LastUncorrected = counts.Corrected, counts.Uncorrected
+	if bootID != "" {
+		r.BootID = bootID
+	}
+
+	switch {
+	case r.HourStart.IsZero():
+		r.HourStart = now
+		changed = true
+	case now.Sub(r.HourStart) >= time.Hour:
+		r.LastHourCorrected, r.HourCorrected, r.HourStart = r.HourCorrected, 0, now
+		changed = true
+	}
+	r.HourCorrected += corrected
+	if changed {
+		r.Updated = now
+	}
+	return changed
+}
+
+// CorrectedPerHour is the highest of the corrected errors counted in the
+// current and in the last hour.
+func (r *Record) CorrectedPerHour() uint64 {
+	return max(r.HourCorrected, r.LastHourCorrected)
+}
+
+// Errors returns the record as listed in the device info.
+func (r *Record) Errors() deviceinfo.EccErrors {
+	return deviceinfo.EccErrors{
+		Corrected:        r.Corrected,
+		Uncorrected:      r.Uncorrected,
+		CorrectedPerHour: r.CorrectedPerHour(),
+	}
+}
+
+// Exceeds tells why the chip exceeds the limits, empty if it does not. A zero
+// limit is not checked. The reason does not change with the counts, so that
+// the health of the chip does not either.
+func (r *Record) Exceeds(uncorrectedLimit, correctedPerHour uint64) string {
+	if uncorrectedLimit > 0 && r.Uncorrected >= uncorrectedLimit {
+		return fmt.Sprintf("uncorrected ECC errors reached the limit of %d", uncorrectedLimit)
+	}
+	if correctedPerHour > 0 && r.CorrectedPerHour() >= correctedPerHour {
+		return fmt.Sprintf("corrected ECC errors reached the limit of %d per hour", correctedPerHour)
+	}
+	return ""
+}
+
+// Store keeps the records of the chips by uuid in a file, so that a restart
+// of the plugin or a reboot of the node does not forget the errors of a chip.
+type Store struct {
+	lk      sync.Mutex
+	path    string
+	records map[string]*Record
+	dirty   bool
+	// bootID is the current boot of the node, empty if unknown
+	bootID string
+}
+
+// readBootID returns the current boot of the node, empty if unknown.
+func readBootID() string {
+	data, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Load reads the store saved at path, a missing file is an empty store.
+func Load(path string) (*Store, error) {
+	s := &Store{path: path, records: map[string]*Record{}, bootID: readBootID()}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("read ECC records %s failed: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		s.records = map[string]*Record{}
+		return s, fmt.Errorf("decode ECC records %s failed: %v", path, err)
+	}
+	return s, nil
+}
+
+// Observe counts the errors read from a chip, and returns its record.
+func (s *Store) Observe(uuid string, counts ixml.EccCounts, now time.Time) Record {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	r, ok := s.records[uuid]
+	if !ok {
+		r = &Record{}
+		s.records[uuid] = r
+	}
+	if r.apply(counts, s.bootID, now) {
+		s.dirty = true
+	}
+	return *r
+}
+
+// Peek returns the record of a chip as Observe would, without changing the
+// store.
+func (s *Store) Peek(uuid string, counts ixml.EccCounts, now time.Time) Record {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	var r Record
+	if saved, ok := s.records[uuid]; ok {
+		r = *saved
+	}
+	r.apply(counts, s.bootID, now)
+	return r
+}
+
+// Get returns the record of a chip, false if it was never observed.
+func (s *Store) Get(uuid string) (Record, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	r, ok := s.records[uuid]
+	if !ok {
+		return Record{}, false
+	}
+	return *r, true
+}
+
+// Save writes the records if they changed, through a rename so that a crash
+// never leaves a partial file.
+func (s *Store) Save() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ecc
+
+import (
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+)
+
+func TestRecordApply(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// read at start during boot-a, 3 corrected errors counted this hour
+	counted := Record{
+		Corrected:       10,
+		Uncorrected:     1,
+		LastCorrected:   5,
+		LastUncorrected: 1,
+		BootID:          "boot-a",
+		HourStart:       start,
+		HourCorrected:   3,
+		Updated:         start,
+	}
+
+	tests := []struct {
+		name    string
+		record  Record
+		counts  ixml.EccCounts
+		bootID  string
+		after   time.Duration
+		want    Record
+		changed bool
+	}{
+		{
+			name:   "first read",
+			counts: ixml.EccCounts{Corrected: 2, Uncorrected: 1},
+			bootID: "boot-a",
+			want: Record{Corrected: 2, Uncorrected: 1, LastCorrected: 2, LastUncorrected: 1, BootID: "boot-a",
+				HourStart: start, HourCorrected: 2, Updated: start},
+			changed: true,
+		},
+		{
+			name:   "nothing new",
+			record: counted,
+			counts: ixml.EccCounts{Corrected: 5, Uncorrected: 1},
+			bootID: "boot-a",
+			after:  time.Minute,
+			want:   counted,
+		},
+		{
+			name:   "counted during the boot",
+			record: counted,
+			counts: ixml.EccCounts{Corrected: 7, Uncorrected: 2},
+			bootID: "boot-a",
+			after:  time.Minute,
+			want: Record{Corrected: 12, Uncorrected: 2, LastCorrected: 7, LastUncorrected: 2, BootID: "boot-a",
+				HourStart: start, HourCorrected: 5, Updated: start.Add(time.Minute)},
+			changed: true,
+		},
+		{
+			name:   "driver reloaded",
+			record: counted,
+			counts: ixml.EccCounts{Corrected: 2, Uncorrected: 0},
+			bootID: "boot-a",
+			after:  time.Minute,
+			want: Record{Corrected: 12, Uncorrected: 1, LastCorrected: 2, LastUncorrected: 0, BootID: "boot-a",
+				HourStart: start, HourCorrected: 5, Updated: start.Add(time.Minute)},
+			changed: true,
+		},
+		{
+			name:   "rebooted past the last counts",
+			record: counted,
+			counts: ixml.EccCounts{Corrected: 6, Uncorrected: 1},
+			bootID: "boot-b",
+			after:  time.Minute,
+			want: Record{Corrected: 16, Uncorrected: 2, LastCorrected: 6, LastUncorrected: 1, BootID: "boot-b",
+				HourStart: start, HourCorrected: 9, Updated: start.Add(time.Minute)},
+			changed: true,
+		},
+		{
+			name:   "rebooted with no error yet",
+			record: counted,
+			bootID: "boot-b",
+			after:  time.Minute,
+			want: Record{Corrected: 10, Uncorrected: 1, BootID: "boot-b", HourStart: start, HourCorrected: 3,
+				Updated: start.Add(time.Minute)},
+			changed: true,
+		},
+		{
+			name:   "boot unknown",
+			record: counted,
+			counts: ixml.EccCounts{Corrected: 6, Uncorrected: 1},
+			after:  time.Minute,
+			want: Record{Corrected: 11, Uncorrected: 1, LastCorrected: 6, LastUncorrected: 1, BootID: "boot-a",
+				HourStart: start, HourCorrected: 4, Updated: start.Add(time.Minute)},
+			changed: true,
+		},
+		{
+			name:   "record of a previous version",
+			record: Record{Corrected: 10, LastCorrected: 5, HourStart: start},
+			counts: ixml.EccCounts{Corrected: 6},
+			bootID: "boot-a",
+			after:  time.Minute,
+			want: Record{Corrected: 11, LastCorrected: 6, BootID: "boot-a", HourStart: start, HourCorrected: 1,
+				Updated: start.Add(time.Minute)},
+			changed: true,
+		},
+		{
+			name:   "hour passed",
+			record: counted,
+			counts: ixml.EccCounts{Corrected: 6, Uncorrected: 1},
+			bootID: "boot-a",
+			after:  time.Hour,
+			want: Record{Corrected: 11, Uncorrected: 1, LastCorrected: 6, LastUncorrected: 1, BootID: "boot-a",
+				HourStart: start.Add(time.Hour), HourCorrected: 1, LastHourCorrected: 3,
+				Updated: start.Add(time.Hour)},
+			changed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.record
+			changed := r.apply(tt.counts, tt.bootID, start.Add(tt.after))
+			if changed != tt.changed {
+				t.Errorf("apply changed %v, want %v", changed, tt.changed)
+			}
+			if r != tt.want {
+				t.Errorf("apply =\n%+v, want\n%+v", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordExceeds(t *testing.T) {
+	tests := []struct {
+		name             string
+		record           Record
+		uncorrected      uint64
+		correctedPerHour uint64
+		want             string
+	}{
+		{
+			name:   "no limit",
+			record: Record{Uncorrected: 100, HourCorrected: 100},
+		},
+		{
+			name:        "below the uncorrected limit",
+			record:      Record{Uncorrected: 1},
+			uncorrected: 2,
+		},
+		{
+			name:        "uncorrected limit reached",
+			record:      Record{Uncorrected: 2},
+			uncorrected: 2,
+			want:        "uncorrected ECC errors reached the limit of 2",
+		},
+		{
+			name:             "below the corrected limit",
+			record:           Record{HourCorrected: 9, LastHourCorrected: 9},
+			correctedPerHour: 10,
+		},
+		{
+			name:             "corrected limit reached this hour",
+			record:           Record{HourCorrected: 10},
+			correctedPerHour: 10,
+			want:             "corrected ECC errors reached the limit of 10 per hour",
+		},
+		{
+			name:             "corrected limit reached last hour",
+			record:           Record{LastHourCorrected: 12},
+			correctedPerHour: 10,
+			want:             "corrected ECC errors reached the limit of 10 per hour",
+		},
+		{
+			name:             "both reached",
+			record:           Record{Uncorrected: 3, HourCorrected: 10},
+			uncorrected:      1,
+			correctedPerHour: 10,
+			want:             "uncorrected ECC errors reached the limit of 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.record.Exceeds(tt.uncorrected, tt.correctedPerHour); got != tt.want {
+				t.Errorf("Exceeds = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
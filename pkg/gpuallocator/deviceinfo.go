@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gpuallocator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// HealthReason tells why dev is unhealthy from the state of its chips.
+func (d *Device) HealthReason() string {
+	if d.IsMulChip && len(d.Chips) != 2 {
+		return "chips of the board are missing"
+	}
+
+	var reasons []string
+	for uuid, c := range d.Chips {
+		if c.Health == pluginapi.Unhealthy {
+			reasons = append(reasons, fmt.Sprintf("chip %s: %s", uuid, c.HealthReason))
+		}
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
+
+// SortedChips returns the chips of dev ordered by index.
+func (d *Device) SortedChips() []*Chip {
+	var chips []*Chip
+	for _, c := range d.Chips {
+		chips = append(chips, c)
+	}
+	sort.Slice(chips, func(i, j int) bool { return chips[i].Index < chips[j].Index })
+	return chips
+}
+
+// NodeDeviceInfo describes the devices in the versioned device-info schema,
+// allocated are the replica ids held by active pods and healthReason tells
+// why an unhealthy device is not advertised.
+func (ds *DeviceSet) NodeDeviceInfo(allocated map[string]bool, healthReason func(*Device) string) *deviceinfo.NodeDeviceInfo {
+	info := &deviceinfo.NodeDeviceInfo{
+		SchemaVersion: deviceinfo.SchemaVersion,
+		Devices:       []deviceinfo.Device{},
+	}
+
+	for _, dev := range ds.Devices {
+		chipCount := 1
+		if dev.IsMulChip {
+			chipCount = 2
+		}
+		device := deviceinfo.Device{
+			UUID:         dev.UUID,
+			Name:         dev.Name,
+			ChipCount:    chipCount,
+			NumaNode:     -1,
+			Health:       deviceinfo.Health{Healthy: dev.Exposed[0].Health == pluginapi.Healthy},
+			Replicas:     []string{},
+			UsedReplicas: []string{},
+			Chips:        []deviceinfo.Chip{},
+		}
+		if !device.Health.Healthy {
+			device.Health.Reason = healthReason(dev)
+		}
+		if master := dev.GetMasterChip(); master != nil {
+			device.BoardID = master.BoardID
+			device.NumaNode = master.NumaNode
+		}
+
+		for _, rdev := range dev.Exposed {
+			device.Replicas = append(device.Replicas, rdev.ID)
+			if allocated[rdev.ID] {
+				device.UsedReplicas = append(device.UsedReplicas, rdev.ID)
+			}
+		}
+
+		for _, c := range dev.SortedChips() {
+			device.MemoryTotal += c.MemoryTotal
+			device.Chips = append(device.Chips, deviceinfo.Chip{
+				UUID:          c.UUID,
+				Index:         c.Index,
+				Minor:         c.Minor,
+				BusID:         c.BusID,
+				BoardPosition: c.BoardPosition,
+				MemoryTotal:   c.MemoryTotal,
+				NumaNode:      c.NumaNode,
+				Health: deviceinfo.Health{
+					Healthy: c.Health == pluginapi.Healthy,
+					Reason:  c.HealthReason,
+				},
+			})
+		}
+
+		for uuid, links := range dev.Links {
+			for _, link := range links {
+				device.Links = append(device.Links, deviceinfo.Link{
+					Target:    uuid,
+					Type:      P2PLinkTypeToString(link.Type),
+					TypeIndex: int(link.Type),
+				})
+			}
+		}
+		sort.Slice(device.Links, func(i, j int) bool { return device.Links[i].Target < device.Links[j].Target })
+
+		info.Devices = append(info.Devices, device)
+	}
+	sort.Slice(info.Devices, func(i, j int) bool { return info.Devices[i].UUID < info.Devices[j].UUID })
+
+	return info
+}
+
+// ReadComputeModes reads the compute mode of the chips, by chip uuid. The
+// chips it can not be read from are left out.
+func (ds *DeviceSet) ReadComputeModes() map[string]ixml.ComputeMode {
+	modes := map[string]ixml.ComputeMode{}
+	for _, dev := range ds.Devices {
+		for uuid, c := range dev.Chips {
+			mode, err := c.Operations.DeviceGetComputeMode()
+			if err != nil {
+				klog.Warningf("Failed to read the compute mode of chip %s: %v", uuid, err)
+				continue
+			}
+			modes[uuid] = mode
+		}
+	}
+	return modes
+}
+
+// SetComputeModes fills the compute mode of the chips of info from modes, and
+// the expected one where they do not match.
+func (ds *DeviceSet) SetComputeModes(info *deviceinfo.NodeDeviceInfo, modes map[string]ixml.ComputeMode) {
+	expected := ds.ExpectedComputeMode()
+	for i := range info.Devices {
+		for j := range info.Devices[i].Chips {
+			chip := &info.Devices[i].Chips[j]
+			mode, ok := modes[chip.UUID]
+			if !ok {
+				continue
+			}
+			chip.ComputeMode = mode.String()
+			if mode != expected {
+				chip.ExpectedComputeMode = expected.String()
+			}
+		}
+	}
+}
+
+// ReadEccErrors reads the ECC errors of the chips with ECC enabled, by chip
+// uuid. The chips they can not be read from are left out.
+func (ds *DeviceSet) ReadEccErrors() map[string]ixml.EccCounts {
+	counts := map[string]ixml.EccCounts{}
+	for _, dev := range ds.Devices {
+		for uuid, c := range dev.Chips {
+			enabled, err := c.Operations.DeviceGetEccMode()
+			if err != nil || !enabled {
+				continue
+			}
+			errs, err := c.Operations.DeviceGetEccErrors()
+			if err != nil {
+				klog.Warningf("Failed to read the ECC errors of chip %s: %v", uuid, err)
+				continue
+			}
+			counts[uuid] = errs
+		}
+	}
+	return counts
+}
+
+// SetEccErrors fills the ECC errors of the chips of info from errs, by chip
+// uuid.
+func SetEccErrors(info *deviceinfo.NodeDeviceInfo, errs map[string]deviceinfo.EccErrors) {
+	for i := range info.Devices {
+		for j := range info.Devices[i].Chips {
+			chip := &info.Devices[i].Chips[j]
+			if e, ok := errs[chip.UUID]; ok {
+				chip.Ecc = &e
+			}
+		}
+	}
+}
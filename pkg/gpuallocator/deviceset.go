@@ -21,23 +21,30 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 
 	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
 	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
 
-	udev "github.com/jochenvg/go-udev"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 type Chip struct {
-	Name       string
-	Minor      uint
-	UUID       string
-	Index      uint
-	Operations ixml.Device
+	Name    string
+	Minor   uint
+	UUID    string
+	Index   uint
+	Serial  string
+	BusID   string
+	BoardID uint32
+	// BoardPosition is -1 if the position is not reported
+	BoardPosition int
+	// MemoryTotal in MiB
+	MemoryTotal uint64
+	// NumaNode is -1 if the chip is not attached to a NUMA node
+	NumaNode     int
+	HealthReason string
+	Operations   ixml.Device
 	pluginapi.Device
 }
 
@@ -59,40 +66,22 @@ type Device struct {
 	Replicas int
 }
 
+// DeviceSet is a snapshot of the devices of the node. It is never modified
+// once published by a DeviceStore.
 type DeviceSet struct {
 	Devices  map[string]*Device
-	Lk       sync.Mutex
 	Count    uint
 	Cfg      *config.Config
 	Replicas int
-	ixmlLock sync.Mutex
+	// Version is bumped by every snapshot published
+	Version uint64
+	// Generation is bumped each time the devices are rebuilt from a scan
+	Generation uint64
 }
 
 type DeviceList []*Device
 type ReplicaDeviceMap map[string]ReplicaDevice
 type Alias string
-type moduleContext struct {
-	ChipMap         map[string]*Chip
-	unManagedChip   map[string]*Chip
-	timeLck         sync.Mutex
-	timeEventDone   bool
-	timeProcessUdev *time.Timer
-	duration        time.Duration
-	timeArg         *[]*Chip
-	count           uint
-}
-
-var (
-	libctx = moduleContext{
-		ChipMap:         make(map[string]*Chip),
-		unManagedChip:   make(map[string]*Chip),
-		count:           0,
-		timeEventDone:   true,
-		timeProcessUdev: nil,
-		duration:        time.Duration(5) * time.Second,
-		timeArg:         nil,
-	}
-)
 
 func (a Alias) HasAlias() bool {
 	slc := strings.Split(string(a), "::")
@@ -126,6 +115,43 @@ func (d *Device) GenerateIndexs() []int {
 	return ret
 }
 
+// NormalizeBusID turns a PCI bus id into the lower case
+// "domain:bus:device.function" form with a 4 digit domain.
+func NormalizeBusID(busID string) string {
+	busID = strings.ToLower(strings.TrimSpace(strings.Trim(busID, "\x00")))
+	parts := strings.Split(busID, ":")
+	switch len(parts) {
+	case 2:
+		return "0000:" + busID
+	case 3:
+		domain, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			return busID
+		}
+		return fmt.Sprintf("%04x:%s:%s", domain, parts[1], parts[2])
+	}
+	return busID
+}
+
+// MatchID reports which attribute of the chip, if any, is equal to id. A chip
+// is matched by its uuid, index, PCI bus id or serial number.
+func (c *Chip) MatchID(id string) (string, bool) {
+	id = strings.TrimSpace(id)
+	switch {
+	case id == "":
+		return "", false
+	case id == c.UUID:
+		return "uuid", true
+	case id == strconv.Itoa(int(c.Index)):
+		return "index", true
+	case c.BusID != "" && NormalizeBusID(id) == c.BusID:
+		return "bus id", true
+	case c.Serial != "" && id == c.Serial:
+		return "serial", true
+	}
+	return "", false
+}
+
 func buildReplicaDevice(dev pluginapi.Device, parent *Device) *ReplicaDevice {
 	return &ReplicaDevice{Device: dev, Parent: parent}
 }
@@ -145,24 +171,64 @@ func buildChip(index uint, d ixml.Device) *Chip {
 		klog.Errorf("Failed to get device name: %v", err)
 	}
 
+	// the minor number names the device node handed out to containers
 	chip.Minor, err = d.DeviceGetMinorNumber()
 	if err != nil {
-		klog.Errorf("Failed to get device minor number: %v", err)
+		klog.Errorf("Failed to get device minor number of %s, skipped: %v", chip.UUID, err)
+		return nil
+	}
+
+	chip.Serial, err = d.DeviceGetSerial()
+	if err != nil {
+		klog.Warningf("Failed to get device serial: %v", err)
+	}
+
+	pci, err := d.DeviceGetPciInfo()
+	if err != nil {
+		klog.Warningf("Failed to get pci info: %v", err)
+	} else {
+		chip.BusID = NormalizeBusID(pci.BusIdLegacy)
+	}
+
+	chip.BoardPosition = -1
+	if ok, pos := d.DeviceGetBoardPosition(); ok {
+		chip.BoardPosition = pos
+	}
+
+	chip.BoardID, err = d.DeviceGetBoardId()
+	if err != nil {
+		klog.Warningf("Failed to get board id: %v", err)
+	}
+
+	mem, err := d.DeviceGetMemoryInfo()
+	if err != nil {
+		klog.Warningf("Failed to get memory info: %v", err)
+	} else {
+		chip.MemoryTotal = mem.Total
 	}
 
 	hasNuma, numa, err := d.DeviceGetNumaNode()
 	if err != nil {
 		klog.Errorf("Failed to get pci info: %v", err)
 	}
+	chip.NumaNode = -1
+	if hasNuma {
+		chip.NumaNode = numa
+	}
 
 	health, err := d.DeviceGetHealth()
+	if ixml.IsNotSupported(err) {
+		health, err = 0, nil
+	}
 	herr := ixml.CheckDeviceError(health)
 	if err != nil {
 		klog.Warningf("Unhealthy: dev:%v   err:%v\n", chip.UUID, err)
 		chip.Health = pluginapi.Unhealthy
+		chip.HealthReason = err.Error()
 	} else if len(herr) > 0 {
 		klog.Warningf("Unhealthy: dev:%v   herr:%v\n", chip.UUID, herr)
 		chip.Health = pluginapi.Unhealthy
+		chip.HealthReason = ixml.JoinDeviceErrors(herr)
 	} else {
 		chip.Health = pluginapi.Healthy
 	}
@@ -243,12 +309,11 @@ func processSingleChip(sideEffect *DeviceSet, ChipList []*Chip) {
 	}
 }
 
-// Shall lock gpuallocator global contexts
 func processMultiChip(sideEffect *DeviceSet, ChipList []*Chip) {
 	var Mul []*Chip
-	for _, chip := range libctx.unManagedChip {
-		Mul = append(Mul, chip)
-	}
+	// chips not on the first position of their board, until they are
+	// attached to the device of the board
+	unManagedChip := make(map[string]*Chip)
 	for _, chip := range ChipList {
 		isSupport, pos := chip.Operations.DeviceGetBoardPosition()
 		if isSupport {
@@ -258,7 +323,7 @@ func processMultiChip(sideEffect *DeviceSet, ChipList []*Chip) {
 				dev.IsMulChip = true
 			} else {
 				Mul = append(Mul, chip)
-				libctx.unManagedChip[chip.UUID] = chip
+				unManagedChip[chip.UUID] = chip
 			}
 		} else {
 			dev := buildDevice(chip, sideEffect.Replicas)
@@ -282,7 +347,7 @@ func processMultiChip(sideEffect *DeviceSet, ChipList []*Chip) {
 					if Mul[i].Health == pluginapi.Unhealthy {
 						dev.SetUnHealth()
 					}
-					delete(libctx.unManagedChip, Mul[i].UUID)
+					delete(unManagedChip, Mul[i].UUID)
 
 					Mul[i] = nil
 				}
@@ -295,8 +360,8 @@ func processMultiChip(sideEffect *DeviceSet, ChipList []*Chip) {
 		}
 	}
 
-	for _, chip := range libctx.unManagedChip {
-		klog.Info("Warning: still have chips is not recognized :%v", chip)
+	for _, chip := range unManagedChip {
+		klog.Infof("Warning: still have chips is not recognized :%v", chip)
 	}
 }
 
@@ -343,33 +408,75 @@ func (d *Device) GenerateIDS() []string {
 	return ret
 }
 
-func (d *Device) UpdateHealth() bool {
-	ret := false
-
+// updateHealth sets the health of the exposed devices from the chips, and to
+// unhealthy if overridden. It returns true if the health changed.
+func (d *Device) updateHealth(overridden bool) bool {
+	health := pluginapi.Healthy
 	//check wheter is offline card
-	if d.IsMulChip && len(d.Chips) != 2 {
-		if d.Exposed[0].Health == pluginapi.Healthy {
-			d.SetUnHealth()
-			ret = true
-		}
-		return ret
+	if overridden || (d.IsMulChip && len(d.Chips) != 2) {
+		health = pluginapi.Unhealthy
 	}
-
 	for _, c := range d.Chips {
 		if c.Health == pluginapi.Unhealthy {
-			if d.Exposed[0].Health == pluginapi.Healthy {
-				d.SetUnHealth()
-				ret = true
-			}
-			return ret
+			health = pluginapi.Unhealthy
 		}
 	}
 
-	if d.Exposed[0].Health == pluginapi.Unhealthy {
+	if len(d.Exposed) == 0 || d.Exposed[0].Health == health {
+		return false
+	}
+	if health == pluginapi.Healthy {
 		d.SetHealth()
-		ret = true
+	} else {
+		d.SetUnHealth()
 	}
-	return ret
+	return true
+}
+
+// clone copies the devices of d, their chips, replicas and links, so that the
+// copy can be changed without affecting the readers of d.
+func (d *DeviceSet) clone() *DeviceSet {
+	ret := *d
+	ret.Devices = make(map[string]*Device, len(d.Devices))
+	for uuid, dev := range d.Devices {
+		cp := *dev
+		cp.Chips = make(map[string]*Chip, len(dev.Chips))
+		for id, c := range dev.Chips {
+			chip := *c
+			cp.Chips[id] = &chip
+		}
+		if master := cp.GetMasterChip(); master != nil {
+			cp.Index = &master.Index
+		}
+		cp.Exposed = make([]*ReplicaDevice, len(dev.Exposed))
+		for i, r := range dev.Exposed {
+			cp.Exposed[i] = buildReplicaDevice(r.Device, &cp)
+		}
+		ret.Devices[uuid] = &cp
+	}
+
+	// links point to the devices of the copy
+	for uuid, dev := range d.Devices {
+		cp := ret.Devices[uuid]
+		cp.Links = make(map[string][]P2PLink, len(dev.Links))
+		for target, links := range dev.Links {
+			for _, link := range links {
+				if gpu, ok := ret.Devices[link.GPU.UUID]; ok {
+					cp.Links[target] = append(cp.Links[target], P2PLink{gpu, link.Type})
+				}
+			}
+		}
+	}
+	return &ret
+}
+
+// ExpectedComputeMode is the compute mode the chips should run in given the
+// sharing of the devices.
+func (d *DeviceSet) ExpectedComputeMode() ixml.ComputeMode {
+	if d.Replicas > 0 {
+		return ixml.ComputeModeDefault
+	}
+	return ixml.ComputeModeExclusiveProcess
 }
 
 func (d *DeviceSet) CachedDevices() []*pluginapi.Device {
@@ -400,83 +507,33 @@ func (d *DeviceSet) DeviceExist(id string) bool {
 	return false
 }
 
-func BuildDeviceSet(cfg *config.Config) *DeviceSet {
-	chips, err := scanAllChips()
+// BuildDeviceSet scans the chips of backend and builds the devices of the
+// node, it returns nil if the chips could not be listed.
+func BuildDeviceSet(cfg *config.Config, backend ixml.Backend) *DeviceSet {
+	chips, err := scanAllChips(backend)
 	if err != nil {
 		return nil
 	}
-	var ds DeviceSet
-	ds.Cfg = cfg
-	ds.Replicas = cfg.Sharing.TimeSlicing.Replicas
-
-	reconcileDeviceSet(&ds, chips)
-
-	return &ds
-}
-
-func (d *DeviceSet) updateDeviceEvent() {
-	klog.Info("Start Update DeviceSet")
-	// Always do a full scan + full rebuild
-	chips, err := scanAllChips()
-	if err != nil {
-		klog.Infof("get device count failed, Failed to update Udev event.")
-		return
-	}
-
-	libctx.timeLck.Lock()
-	libctx.timeArg = &chips
-	if libctx.timeEventDone {
-		// First event after idle: schedule a delayed rebuild
-		libctx.timeEventDone = false
-		libctx.timeProcessUdev = time.AfterFunc(libctx.duration, func() {
-			// Actually rebuild after the debounce window
-			local := *libctx.timeArg
-			reconcileDeviceSet(d, local)
-
-			libctx.timeLck.Lock()
-			libctx.timeArg = nil
-			libctx.timeEventDone = true
-			libctx.timeLck.Unlock()
-		})
-	} else {
-		// Merge multiple events: if another event arrives before the timer fires,
-		// update timeArg with the latest chip list
-		libctx.timeArg = &chips
-	}
-	libctx.timeLck.Unlock()
-}
-
-func (d *DeviceSet) UpdateUdev(dev *udev.Device) {
-	action := dev.Action()
-	switch action {
-	case "add":
-		klog.Infof("-- Add    -- udev event\n")
-		d.updateDeviceEvent()
-	case "remove":
-		klog.Infof("-- Remove -- udev event\n")
-		d.updateDeviceEvent()
-	case "change":
-		klog.Infof("-- Change -- udev event\n")
-		d.updateDeviceEvent()
-	default:
-		klog.Infof("[%v] udev event (ignored)\n", action)
+	ds := newDeviceSet(cfg, chips)
+	for _, dev := range ds.Devices {
+		dev.updateHealth(false)
 	}
+	return ds
 }
 
-func scanAllChips() ([]*Chip, error) {
+func scanAllChips(backend ixml.Backend) ([]*Chip, error) {
 	klog.Info("Start scan all chips")
 	var chips []*Chip
 
-	count, err := ixml.GetDeviceCount()
+	count, err := backend.GetDeviceCount()
 	if err != nil {
 		klog.Infof("get device count failed.")
 		return nil, err
 	}
 	klog.Infof("IXML device count = %d", count)
 
-	libctx.ChipMap = make(map[string]*Chip)
 	for i := uint(0); i < count; i++ {
-		devHandler, err := ixml.NewDeviceByIndex(i)
+		devHandler, err := backend.NewDeviceByIndex(i)
 		if err != nil {
 			klog.Errorf("Failed to get device-%d handle: %v", i, err)
 			continue
@@ -487,24 +544,19 @@ func scanAllChips() ([]*Chip, error) {
 			continue
 		}
 		chips = append(chips, c)
-		libctx.ChipMap[c.UUID] = c
 	}
 
 	klog.Infof("Real device count = %d", len(chips))
 	return chips, nil
 }
 
-func reconcileDeviceSet(ds *DeviceSet, chips []*Chip) {
+func newDeviceSet(cfg *config.Config, chips []*Chip) *DeviceSet {
 	klog.Info("Reconcile DeviceSet")
-	if ds == nil {
-		return
+	ds := &DeviceSet{
+		Devices:  make(map[string]*Device),
+		Cfg:      cfg,
+		Replicas: cfg.Sharing.TimeSlicing.Replicas,
 	}
-	ds.Lk.Lock()
-	defer ds.Lk.Unlock()
-
-	// rebuild DeviceSet
-	ds.Devices = make(map[string]*Device)
-	libctx.unManagedChip = make(map[string]*Chip)
 
 	if ds.Cfg.Flags.SplitBoard {
 		processSingleChip(ds, chips)
@@ -514,9 +566,8 @@ func reconcileDeviceSet(ds *DeviceSet, chips []*Chip) {
 	resetTopological(&ds.Devices)
 
 	ds.Count = uint(len(chips))
-	libctx.count = ds.Count
 
-	ds.ShowLayout()
+	return ds
 }
 
 func (d *DeviceSet) ShowLayout() {
@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gpuallocator
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	udev "github.com/jochenvg/go-udev"
+	"k8s.io/klog/v2"
+)
+
+var busIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-9a-fA-F]$`)
+
+// udevTarget is the chip a udev event is about, as far as the event tells.
+type udevTarget struct {
+	action string
+	busID  string
+	minor  int
+}
+
+// parseUdev finds the PCI address of the chip in the device path, which is
+// still reported once the device left sysfs, and its minor in the device
+// number or the trailing digits of the name. A zero major means the event had
+// no device number.
+func parseUdev(action, devpath, sysname string, major, minor int) udevTarget {
+	t := udevTarget{action: action, minor: -1}
+
+	elems := strings.Split(devpath, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		if busIDPattern.MatchString(elems[i]) {
+			t.busID = NormalizeBusID(elems[i])
+			break
+		}
+	}
+
+	if major != 0 {
+		t.minor = minor
+	} else if digits := strings.TrimLeft(sysname, "abcdefghijklmnopqrstuvwxyz-_"); digits != "" {
+		if n, err := strconv.Atoi(digits); err == nil {
+			t.minor = n
+		}
+	}
+	return t
+}
+
+func udevTargetOf(dev *udev.Device) udevTarget {
+	devnum := dev.Devnum()
+	return parseUdev(dev.Action(), dev.Devpath(), dev.Sysname(), devnum.Major(), devnum.Minor())
+}
+
+func (t udevTarget) identified() bool {
+	return t.busID != "" || t.minor >= 0
+}
+
+func (t udevTarget) event(typ bus.Type, device string) bus.Event {
+	return bus.Event{
+		Type:   typ,
+		Device: device,
+		Reason: "udev " + t.action + " event",
+		BusID:  t.busID,
+	}
+}
+
+// matches tells if c is the chip of the event, any chip matches an event
+// which could not be parsed.
+func (t udevTarget) matches(c *Chip) bool {
+	if t.busID != "" && c.BusID != "" {
+		return t.busID == c.BusID
+	}
+	if t.minor >= 0 {
+		return t.minor == int(c.Minor)
+	}
+	return true
+}
+
+// applyUdev applies the settled udev events to the current snapshot: the
+// departed chips are removed and the new ones added, the other devices keep
+// their health and replicas.
+func (s *DeviceStore) applyUdev(targets []udevTarget) {
+	var scanned []*Chip
+	for _, t := range targets {
+		if t.action == "remove" && t.identified() {
+			continue
+		}
+		chips, err := scanAllChips(s.backend)
+		if err != nil {
+			klog.Errorf("Failed to apply udev events, scan chips failed: %v", err)
+			return
+		}
+		scanned = chips
+		break
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	next := s.current.Load().clone()
+	var events []bus.Event
+	for _, t := range targets {
+		events = append(events, next.removeChips(t, scanned)...)
+		if t.action != "remove" {
+			events = append(events, next.addChips(t, scanned)...)
+		}
+	}
+	if len(events) == 0 {
+		klog.Info("Udev events did not change the chips")
+		return
+	}
+
+	next.refreshChips(scanned)
+	resetTopological(&next.Devices)
+	for _, dev := range next.Devices {
+		dev.updateHealth(s.overridden(dev))
+	}
+	s.publish(next)
+	next.ShowLayout()
+
+	for _, event := range events {
+		event.Version = next.Version
+		klog.Infof("%s device %s, chips: %v, bus id: %s", event.Type, event.Device, event.Chips, event.BusID)
+		s.events.Publish(event)
+	}
+}
+
+// FindChip returns the chip with the uuid and the device it belongs to, nil
+// if there is none.
+func (d *DeviceSet) FindChip(uuid string) (*Device, *Chip) {
+	for _, dev := range d.Devices {
+		if c, ok := dev.Chips[uuid]; ok {
+			return dev, c
+		}
+	}
+	return nil, nil
+}
+
+// chips returns the chips of d by uuid, with the device they belong to.
+func (d *DeviceSet) chips() map[string]*Device {
+	ret := map[string]*Device{}
+	for _, dev := range d.Devices {
+		for uuid := range dev.Chips {
+			ret[uuid] = dev
+		}
+	}
+	return ret
+}
+
+// removeChips removes the chips of the event. Without a scan only the chip
+// identified by the event goes, otherwise the chips it matches which are no
+// longer listed by IXML.
+func (d *DeviceSet) removeChips(t udevTarget, scanned []*Chip) []bus.Event {
+	listed := map[string]bool{}
+	for _, c := range scanned {
+		listed[c.UUID] = true
+	}
+	keepListed := t.action != "remove" || !t.identified()
+	if keepListed && scanned == nil {
+		return nil
+	}
+
+	var events []bus.Event
+	for uuid, dev := range d.chips() {
+		c, ok := dev.Chips[uuid]
+		if !ok || d.Devices[dev.UUID] != dev || !t.matches(c) || (keepListed && listed[uuid]) {
+			continue
+		}
+		event := t.event(bus.DeviceRemoved, dev.UUID)
+		if uuid == dev.UUID {
+			// the chips left on the board are not usable without the master
+			for id := range dev.Chips {
+				event.Chips = append(event.Chips, id)
+			}
+			sort.Strings(event.Chips)
+			delete(d.Devices, dev.UUID)
+		} else {
+			event.Chips = []string{uuid}
+			delete(dev.Chips, uuid)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// addChips adds the scanned chips matching the event which are not in d yet.
+// A board is added by its first chip, the other chips of the board join it.
+func (d *DeviceSet) addChips(t udevTarget, scanned []*Chip) []bus.Event {
+	known := d.chips()
+	var added []*Chip
+	for _, c := range scanned {
+		if _, ok := known[c.UUID]; !ok && t.matches(c) {
+			added = append(added, c)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].BoardPosition < added[j].BoardPosition
+	})
+
+	var events []bus.Event
+	for _, c := range added {
+		event := t.event(bus.DeviceAdded, "")
+		event.Chips = []string{c.UUID}
+		supported, pos := c.Operations.DeviceGetBoardPosition()
+		if d.Cfg.Flags.SplitBoard || !supported || pos == 0 {
+			dev := buildDevice(c, d.Replicas)
+			dev.IsMulChip = !d.Cfg.Flags.SplitBoard && supported
+			d.Devices[dev.UUID] = dev
+			event.Device = dev.UUID
+			events = append(events, event)
+			continue
+		}
+
+		dev := d.boardOf(c)
+		if dev == nil {
+			klog.Warningf("Chip %s is not recognized, no device on its board", c.UUID)
+			continue
+		}
+		dev.Chips[c.UUID] = c
+		event.Device = dev.UUID
+		events = append(events, event)
+	}
+	return events
+}
+
+// boardOf returns the multi-chip device on the board of c.
+func (d *DeviceSet) boardOf(c *Chip) *Device {
+	for _, dev := range d.Devices {
+		master := dev.GetMasterChip()
+		if !dev.IsMulChip || master == nil {
+			continue
+		}
+		if _, onSameBoard := ixml.GetDeviceOnSameBoard(master.Operations, c.Operations); onSameBoard {
+			return dev
+		}
+	}
+	return nil
+}
+
+// refreshChips updates the index and handle of the chips kept across the
+// events from scanned, IXML may enumerate them in a different order.
+func (d *DeviceSet) refreshChips(scanned []*Chip) {
+	byUUID := map[string]*Chip{}
+	for _, c := range scanned {
+		byUUID[c.UUID] = c
+	}
+
+	d.Count = 0
+	for _, dev := range d.Devices {
+		for uuid, c := range dev.Chips {
+			if s, ok := byUUID[uuid]; ok {
+				c.Index = s.Index
+				c.Minor = s.Minor
+				c.Operations = s.Operations
+			}
+		}
+		d.Count += uint(len(dev.Chips))
+	}
+}
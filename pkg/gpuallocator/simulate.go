@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gpuallocator
+
+import (
+	"fmt"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// PairScore is the link score of two devices used by the best effort policy.
+func PairScore(gpu0 *Device, gpu1 *Device) int {
+	return calculateGPUPairScore(gpu0, gpu1)
+}
+
+// PreferredAllocation runs the policy of the device set, the replica policy
+// with time-slicing and the best effort policy otherwise.
+func (d *DeviceSet) PreferredAllocation(available, required []string, size int) ([]string, error) {
+	if d.Replicas > 0 {
+		arg := ReplicaPolicyArgs{Device: d.BuildReplicaMap(), Available: available, Required: required, Size: size}
+		return NewReplicaPolicy().Allocate(PolicyArgs(arg)), nil
+	}
+
+	availableDevices, err := d.Filter(available)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of available devices: %v", err)
+	}
+
+	requiredDevices, err := d.Filter(required)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of required devices: %v", err)
+	}
+
+	arg := BestPolicyArgs{Available: availableDevices, Required: requiredDevices, Size: size}
+	return NewBestEffortPolicy().Allocate(PolicyArgs(arg)), nil
+}
+
+// BuildDeviceSetFromInfo builds the device set described by a device-info,
+// without IXML, so that the policies can be run offline.
+func BuildDeviceSetFromInfo(cfg *config.Config, info *deviceinfo.NodeDeviceInfo) (*DeviceSet, error) {
+	ds := &DeviceSet{
+		Devices:  map[string]*Device{},
+		Cfg:      cfg,
+		Replicas: cfg.Sharing.TimeSlicing.Replicas,
+	}
+
+	for _, desc := range info.Devices {
+		health := pluginapi.Unhealthy
+		if desc.Health.Healthy {
+			health = pluginapi.Healthy
+		}
+
+		dev := &Device{
+			Name:      desc.Name,
+			UUID:      desc.UUID,
+			IsMulChip: desc.ChipCount > 1,
+			Chips:     map[string]*Chip{},
+			Links:     map[string][]P2PLink{},
+			Replicas:  ds.Replicas,
+		}
+		for _, c := range desc.Chips {
+			chip := &Chip{
+				Name:          desc.Name,
+				Minor:         c.Minor,
+				UUID:          c.UUID,
+				Index:         c.Index,
+				BusID:         c.BusID,
+				BoardID:       desc.BoardID,
+				BoardPosition: c.BoardPosition,
+				MemoryTotal:   c.MemoryTotal,
+				NumaNode:      c.NumaNode,
+				HealthReason:  c.Health.Reason,
+			}
+			chip.ID = c.UUID
+			chip.Health = pluginapi.Unhealthy
+			if c.Health.Healthy {
+				chip.Health = pluginapi.Healthy
+			}
+			dev.Chips[c.UUID] = chip
+		}
+		if master := dev.GetMasterChip(); master != nil {
+			dev.Minor = master.Minor
+			dev.Index = &master.Index
+		}
+
+		replicas := desc.Replicas
+		if len(replicas) == 0 {
+			replicas = []string{desc.UUID}
+		}
+		if ds.Replicas > 0 && len(replicas) != ds.Replicas {
+			return nil, fmt.Errorf("device %s has %d replicas, config has %d", desc.UUID, len(replicas), ds.Replicas)
+		}
+		for _, id := range replicas {
+			dev.Exposed = append(dev.Exposed, buildReplicaDevice(pluginapi.Device{ID: id, Health: health}, dev))
+		}
+
+		ds.Devices[dev.UUID] = dev
+	}
+
+	for _, desc := range info.Devices {
+		dev := ds.Devices[desc.UUID]
+		for _, link := range desc.Links {
+			target, ok := ds.Devices[link.Target]
+			if !ok {
+				return nil, fmt.Errorf("device %s links to unknown device %s", desc.UUID, link.Target)
+			}
+			dev.Links[link.Target] = append(dev.Links[link.Target], P2PLink{GPU: target, Type: P2PLinkType(link.TypeIndex)})
+		}
+	}
+
+	// the best effort policy expects every link in both directions
+	for uuid, dev := range ds.Devices {
+		for target, links := range dev.Links {
+			if len(links) != len(ds.Devices[target].Links[uuid]) {
+				return nil, fmt.Errorf("links between %s and %s are not bidirectional", uuid, target)
+			}
+		}
+	}
+
+	ds.Count = uint(len(ds.Devices))
+	return ds, nil
+}
+
+// Fragmentation describes how the free capacity of a device set is split.
+type Fragmentation struct {
+	// Free and Total are counted in the ids advertised to kubelet
+	Free  int
+	Total int
+	// Fragmented groups are partially allocated: boards with splitboard, or
+	// devices with time-slicing
+	FragmentedGroups int
+	// FreeInFragmented is the free capacity left in fragmented groups, it can
+	// not serve a request for a whole group anymore
+	FreeInFragmented int
+}
+
+// Ratio is the share of the free capacity in fragmented groups.
+func (f Fragmentation) Ratio() float64 {
+	if f.Free == 0 {
+		return 0
+	}
+	return float64(f.FreeInFragmented) / float64(f.Free)
+}
+
+// GetFragmentation computes the fragmentation of the healthy devices once the
+// allocated ids are in use. A group is a device with time-slicing, and the
+// devices sharing a board id otherwise.
+func (d *DeviceSet) GetFragmentation(allocated map[string]bool) Fragmentation {
+	type group struct{ free, total int }
+	groups := map[string]*group{}
+
+	var f Fragmentation
+	for _, dev := range d.Devices {
+		if dev.Exposed[0].Health != pluginapi.Healthy {
+			continue
+		}
+
+		key := dev.UUID
+		if d.Replicas == 0 {
+			if master := dev.GetMasterChip(); master != nil && master.BoardID != 0 {
+				key = fmt.Sprintf("board-%d", master.BoardID)
+			}
+		}
+		if groups[key] == nil {
+			groups[key] = &group{}
+		}
+
+		for _, rdev := range dev.Exposed {
+			groups[key].total++
+			f.Total++
+			if !allocated[rdev.ID] {
+				groups[key].free++
+				f.Free++
+			}
+		}
+	}
+
+	for _, g := range groups {
+		if g.free > 0 && g.free < g.total {
+			f.FragmentedGroups++
+			f.FreeInFragmented += g.free
+		}
+	}
+	return f
+}
@@ -0,0 +1,246 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gpuallocator
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	udev "github.com/jochenvg/go-udev"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// udevSettleTime is how long udev events are merged before the devices are
+// rebuilt.
+const udevSettleTime = 5 * time.Second
+
+// ChipHealth is the health of a chip as reported by a health check.
+type ChipHealth struct {
+	Health string
+	Reason string
+}
+
+// HealthEvent is the chip health reported by a health check, keyed by chip
+// uuid. Chips not in the event keep their health.
+type HealthEvent map[string]ChipHealth
+
+// DeviceStore publishes the DeviceSet of the node as immutable snapshots.
+// Readers Load the current snapshot and may keep it as long as they need,
+// writers build the next snapshot from a copy of the current one and publish
+// it, a published DeviceSet is never modified.
+type DeviceStore struct {
+	Cfg *config.Config
+
+	// backend lists the chips on a rescan
+	backend ixml.Backend
+	// clock schedules the udev rebuilds
+	clock clock.WithDelayedExecution
+	// events receives the changes of the devices
+	events *bus.Bus
+
+	current atomic.Pointer[DeviceSet]
+
+	// lk serializes the writers
+	lk sync.Mutex
+	// override keeps a device unhealthy whatever its chips report
+	override func(*Device) bool
+
+	// udev events are queued, and applied together once they settle
+	udevLk      sync.Mutex
+	udevTimer   clock.Timer
+	udevTargets []udevTarget
+}
+
+// NewDeviceStore publishes set as the first snapshot, an empty one if set is
+// nil. The chips are scanned again through backend, the udev events are
+// merged using clk, and the changes of the devices are published on events.
+func NewDeviceStore(cfg *config.Config, backend ixml.Backend, clk clock.WithDelayedExecution,
+	events *bus.Bus, set *DeviceSet) *DeviceStore {
+	if set == nil {
+		set = &DeviceSet{
+			Devices:  map[string]*Device{},
+			Cfg:      cfg,
+			Replicas: cfg.Sharing.TimeSlicing.Replicas,
+		}
+	}
+	s := &DeviceStore{
+		Cfg:     cfg,
+		backend: backend,
+		clock:   clk,
+		events:  events,
+	}
+	s.current.Store(set)
+	return s
+}
+
+// Load returns the current snapshot.
+func (s *DeviceStore) Load() *DeviceSet {
+	return s.current.Load()
+}
+
+// Backend returns the backend the chips are scanned through.
+func (s *DeviceStore) Backend() ixml.Backend {
+	return s.backend
+}
+
+// SetOverride sets the function which keeps devices unhealthy whatever their
+// chips report, and applies it. fn is called with the store locked, it must
+// not write to the store.
+func (s *DeviceStore) SetOverride(fn func(*Device) bool) {
+	s.lk.Lock()
+	s.override = fn
+	s.lk.Unlock()
+
+	s.ApplyHealth(nil)
+}
+
+func (s *DeviceStore) overridden(dev *Device) bool {
+	return s.override != nil && s.override(dev)
+}
+
+// publish stores next as the current snapshot, the caller holds lk.
+func (s *DeviceStore) publish(next *DeviceSet) {
+	next.Version = s.current.Load().Version + 1
+	s.current.Store(next)
+}
+
+// ApplyHealth applies event to the current snapshot, and evaluates the health
+// of every device again. It returns the devices whose health changed, as found
+// in the published snapshot. An empty event only evaluates the override.
+func (s *DeviceStore) ApplyHealth(event HealthEvent) []*Device {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	next := s.current.Load().clone()
+	changed := false
+	var devs []*Device
+	for _, dev := range next.Devices {
+		for uuid, c := range dev.Chips {
+			h, ok := event[uuid]
+			if !ok || (c.Health == h.Health && c.HealthReason == h.Reason) {
+				continue
+			}
+			c.Health = h.Health
+			c.HealthReason = h.Reason
+			changed = true
+		}
+		if dev.updateHealth(s.overridden(dev)) {
+			devs = append(devs, dev)
+		}
+	}
+
+	if changed || len(devs) > 0 {
+		s.publish(next)
+	}
+	for _, dev := range devs {
+		s.events.Publish(bus.Event{
+			Type:    bus.HealthChanged,
+			Device:  dev.UUID,
+			Chips:   dev.GenerateIDS(),
+			Health:  dev.Exposed[0].Health,
+			Reason:  dev.HealthReason(),
+			Version: next.Version,
+		})
+	}
+	return devs
+}
+
+// Replace publishes a new generation built from chips.
+func (s *DeviceStore) Replace(chips []*Chip) *DeviceSet {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	next := newDeviceSet(s.Cfg, chips)
+	for _, dev := range next.Devices {
+		dev.updateHealth(s.overridden(dev))
+	}
+	prev := s.current.Load()
+	next.Generation = prev.Generation + 1
+	s.publish(next)
+	next.ShowLayout()
+
+	for uuid, dev := range prev.Devices {
+		if _, ok := next.Devices[uuid]; !ok {
+			s.events.Publish(bus.Event{Type: bus.DeviceRemoved, Device: uuid, Chips: dev.GenerateIDS(),
+				Reason: "rescan", Version: next.Version})
+		}
+	}
+	for uuid, dev := range next.Devices {
+		if _, ok := prev.Devices[uuid]; !ok {
+			s.events.Publish(bus.Event{Type: bus.DeviceAdded, Device: uuid, Chips: dev.GenerateIDS(),
+				Reason: "rescan", Version: next.Version})
+		}
+	}
+	return next
+}
+
+// Rescan scans the chips again and publishes a new generation.
+func (s *DeviceStore) Rescan() error {
+	chips, err := scanAllChips(s.backend)
+	if err != nil {
+		return fmt.Errorf("scan chips failed: %v", err)
+	}
+	s.Replace(chips)
+	return nil
+}
+
+func (s *DeviceStore) queueUdev(t udevTarget) {
+	s.udevLk.Lock()
+	defer s.udevLk.Unlock()
+	s.udevTargets = append(s.udevTargets, t)
+	if s.udevTimer != nil {
+		return
+	}
+	// First event after idle: schedule the update, the driver needs some time
+	// before IXML lists a new chip
+	s.udevTimer = s.clock.AfterFunc(udevSettleTime, func() {
+		s.udevLk.Lock()
+		targets := s.udevTargets
+		s.udevTargets = nil
+		s.udevTimer = nil
+		s.udevLk.Unlock()
+
+		s.applyUdev(targets)
+	})
+}
+
+// UpdateUdev updates the chips of the udev event, only the chips it is about
+// are added or removed.
+func (s *DeviceStore) UpdateUdev(dev *udev.Device) {
+	action := dev.Action()
+	switch action {
+	case "add":
+		klog.Infof("-- Add    -- udev event\n")
+	case "remove":
+		klog.Infof("-- Remove -- udev event\n")
+	case "change":
+		klog.Infof("-- Change -- udev event\n")
+	default:
+		klog.Infof("[%v] udev event (ignored)\n", action)
+		return
+	}
+	t := udevTargetOf(dev)
+	klog.Infof("udev %s of %s, bus id: %s, minor: %d", action, dev.Sysname(), t.busID, t.minor)
+	s.queueUdev(t)
+}
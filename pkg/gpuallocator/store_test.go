@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gpuallocator
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/bus"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/config"
+	"gitee.com/deep-spark/ix-device-plugin/pkg/ixml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	testclock "k8s.io/utils/clock/testing"
+)
+
+// fakeBackend enumerates count healthy single chip gpus.
+func fakeBackend(count int) *ixml.FakeBackend {
+	backend := &ixml.FakeBackend{}
+	for i := 0; i < count; i++ {
+		backend.Devices = append(backend.Devices, &ixml.FakeDevice{
+			Name:          "Iluvatar BI-V100",
+			UUID:          fmt.Sprintf("GPU-00000000-0000-0000-0000-00000000000%d", i),
+			Index:         uint(i),
+			Minor:         uint(i),
+			Serial:        fmt.Sprintf("SN%d", i),
+			BoardID:       uint32(i),
+			BoardPosition: -1,
+			NumaNode:      -1,
+			Pci:           ixml.PciInfo{BusId: fmt.Sprintf("0000:%02x:00.0", i+1), Bus: uint(i + 1)},
+		})
+	}
+	return backend
+}
+
+// checkSnapshot fails if the devices of set do not belong to it.
+func checkSnapshot(t *testing.T, set *DeviceSet) {
+	for uuid, dev := range set.Devices {
+		if dev.UUID != uuid || dev.Chips[uuid] == nil {
+			t.Errorf("version %d: device %s has uuid %s and chips %v", set.Version, uuid, dev.UUID, dev.Chips)
+		}
+		for _, r := range dev.Exposed {
+			if r.Parent != dev || r.Health != dev.Exposed[0].Health {
+				t.Errorf("version %d: replica %s does not match its device %s", set.Version, r.ID, uuid)
+			}
+		}
+		for target, links := range dev.Links {
+			for _, link := range links {
+				if set.Devices[target] != link.GPU {
+					t.Errorf("version %d: device %s links to %s of another snapshot", set.Version, uuid, target)
+				}
+			}
+		}
+	}
+}
+
+// TestDeviceStoreConcurrentWriters runs every writer of the store at the same
+// time as its readers, run it with -race.
+func TestDeviceStoreConcurrentWriters(t *testing.T) {
+	const (
+		count      = 4
+		iterations = 200
+	)
+	cfg := &config.Config{}
+	cfg.Sharing.TimeSlicing.Replicas = 2
+	backend := fakeBackend(count)
+	clk := testclock.NewFakeClock(time.Now())
+	// the fake clock applies the udev events with its lock held, the events
+	// they publish are stamped with the real one
+	events := bus.New(nil)
+	sub := events.Subscribe("test", 16)
+	defer sub.Close()
+	go func() {
+		for range sub.C {
+		}
+	}()
+
+	s := NewDeviceStore(cfg, backend, clk, events, BuildDeviceSet(cfg, backend))
+	chips, err := scanAllChips(backend)
+	if err != nil {
+		t.Fatalf("scan chips failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	// readers keep their snapshot while the writers publish the next ones
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			var last uint64
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				set := s.Load()
+				if set.Version < last {
+					t.Errorf("loaded version %d after %d", set.Version, last)
+				}
+				last = set.Version
+				checkSnapshot(t, set)
+				set.BuildReplicaMap()
+			}
+		}()
+	}
+
+	run(func(i int) {
+		health := ChipHealth{Health: pluginapi.Healthy}
+		if i%2 == 0 {
+			health = ChipHealth{Health: pluginapi.Unhealthy, Reason: "xid 79"}
+		}
+		s.ApplyHealth(HealthEvent{chips[i%count].UUID: health})
+	})
+	run(func(i int) {
+		s.Replace(chips)
+	})
+	run(func(i int) {
+		if err := s.Rescan(); err != nil {
+			t.Errorf("rescan failed: %v", err)
+		}
+	})
+	run(func(i int) {
+		busID := chips[i%count].BusID
+		s.applyUdev([]udevTarget{
+			{action: "remove", busID: busID, minor: -1},
+			{action: "add", busID: busID, minor: -1},
+		})
+	})
+	run(func(i int) {
+		s.queueUdev(udevTarget{action: "change", minor: -1})
+		clk.Step(udevSettleTime)
+	})
+	run(func(i int) {
+		uuid := chips[i%count].UUID
+		s.SetOverride(func(dev *Device) bool { return dev.UUID == uuid })
+	})
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	s.SetOverride(nil)
+	set := s.Replace(chips)
+	checkSnapshot(t, set)
+	if len(set.Devices) != count {
+		t.Errorf("%d devices after the last scan, want %d", len(set.Devices), count)
+	}
+	if len(set.BuildReplicaMap()) != count*cfg.Sharing.TimeSlicing.Replicas {
+		t.Errorf("%d replicas after the last scan, want %d", len(set.BuildReplicaMap()),
+			count*cfg.Sharing.TimeSlicing.Replicas)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health tracks the progress of the long-running loops of the plugin,
+// so that a probe can tell a wedged plugin from a healthy one.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// LoopStatus is the state of a loop as seen by the probe.
+type LoopStatus struct {
+	// LastProgress is the last time the loop went through an iteration, it is
+	// not set for the components which are checked on request.
+	LastProgress time.Time `json:"lastProgress,omitempty"`
+	// Error is set when the check of the component failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Status is the state of all the tracked loops.
+type Status struct {
+	Time  time.Time             `json:"time"`
+	Loops map[string]LoopStatus `json:"loops"`
+}
+
+// Problems lists the loops whose check failed or which did not make progress
+// for longer than threshold.
+func (s *Status) Problems(threshold time.Duration) []string {
+	var problems []string
+	for name, loop := range s.Loops {
+		if loop.Error != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, loop.Error))
+		} else if !loop.LastProgress.IsZero() && s.Time.Sub(loop.LastProgress) > threshold {
+			problems = append(problems, fmt.Sprintf("%s: no progress since %s", name,
+				loop.LastProgress.Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+type loop struct {
+	last  time.Time
+	check func() error
+}
+
+// Tracker records when each loop last made progress. A nil Tracker tracks
+// nothing, so that components can be run without one.
+type Tracker struct {
+	lk    sync.Mutex
+	loops map[string]*loop
+	now   func() time.Time
+}
+
+// NewTracker creates a Tracker using clock, time.Now if nil.
+func NewTracker(clock func() time.Time) *Tracker {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Tracker{
+		loops: map[string]*loop{},
+		now:   clock,
+	}
+}
+
+// Beat records that the loop name made progress.
+func (t *Tracker) Beat(name string) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.loops[name] == nil {
+		t.loops[name] = &loop{}
+	}
+	t.loops[name].last = t.now()
+}
+
+// Watch tracks a component which has no loop of its own, check is called on
+// every status request.
+func (t *Tracker) Watch(name string, check func() error) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.loops[name] = &loop{check: check}
+}
+
+// Forget stops tracking name, once the loop was deliberately stopped.
+func (t *Tracker) Forget(name string) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	delete(t.loops, name)
+}
+
+// Status returns the state of all the tracked loops.
+func (t *Tracker) Status() *Status {
+	checks := map[string]func() error{}
+	status := &Status{Loops: map[string]LoopStatus{}}
+
+	t.lk.Lock()
+	status.Time = t.now()
+	for name, l := range t.loops {
+		if l.check != nil {
+			checks[name] = l.check
+		} else {
+			status.Loops[name] = LoopStatus{LastProgress: l.last}
+		}
+	}
+	t.lk.Unlock()
+
+	// the checks may dial, they run without the lock
+	for name, check := range checks {
+		s := LoopStatus{}
+		if err := check(); err != nil {
+			s.Error = err.Error()
+		}
+		status.Loops[name] = s
+	}
+	return status
+}
+
+// Serve answers the status requests on the unix socket path.
+func (t *Tracker) Serve(path string) (*http.Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(t.Status()); err != nil {
+			klog.Warningf("Failed to write health status: %v", err)
+		}
+	})
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(sock); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Health server on %s failed: %v", path, err)
+		}
+	}()
+	return srv, nil
+}
+
+// Query asks the plugin listening on the unix socket path for its status.
+func Query(path string, timeout time.Duration) (*Status, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://localhost/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decode status failed: %v", err)
+	}
+	return &status, nil
+}
@@ -41,7 +41,7 @@ var (
 func deviceInit() error {
 	ret := goixml.Init()
 	if ret != goixml.SUCCESS {
-		return fmt.Errorf("Failed to init ixml.")
+		return newError("init ixml", ret)
 	}
 	return nil
 }
@@ -49,7 +49,7 @@ func deviceInit() error {
 func deviceShutdown() error {
 	ret := goixml.Shutdown()
 	if ret != goixml.SUCCESS {
-		return fmt.Errorf("Failed to shutdown ixml.")
+		return newError("shutdown ixml", ret)
 	}
 
 	return nil
@@ -58,7 +58,7 @@ func deviceShutdown() error {
 func getDeviceCount() (uint, error) {
 	num, ret := goixml.DeviceGetCount()
 	if ret != goixml.SUCCESS {
-		return 0, fmt.Errorf("Failed to get the count of gpu device.")
+		return 0, newError("get the count of gpu device", ret)
 	}
 
 	return uint(num), nil
@@ -67,7 +67,7 @@ func getDeviceCount() (uint, error) {
 func getDriverVersion() (string, error) {
 	version, ret := goixml.SystemGetDriverVersion()
 	if ret != goixml.SUCCESS {
-		return "", fmt.Errorf("Failed to get the driver version of gpu device.")
+		return "", newError("get the driver version of gpu device", ret)
 	}
 
 	return version, nil
@@ -76,7 +76,7 @@ func getDriverVersion() (string, error) {
 func getCudaVersion() (string, error) {
 	cudaversion, ret := goixml.SystemGetCudaDriverVersion()
 	if ret != goixml.SUCCESS {
-		return "", fmt.Errorf("Failed to get the current CUDA version.")
+		return "", newError("get the current CUDA version", ret)
 	}
 
 	version, err := strconv.Atoi(cudaversion)
@@ -92,7 +92,7 @@ func getCudaVersion() (string, error) {
 func getIxmlVersion() (string, error) {
 	version, ret := goixml.SystemGetNVMLVersion()
 	if ret != goixml.SUCCESS {
-		return "", fmt.Errorf("Failed to get the current IXML version.")
+		return "", newError("get the current IXML version", ret)
 	}
 	return version, nil
 }
@@ -101,7 +101,7 @@ func getDeviceByIndex(index uint) (*device, error) {
 	var dev goixml.Device
 	ret := goixml.DeviceGetHandleByIndex(index, &dev)
 	if ret != goixml.SUCCESS {
-		return nil, fmt.Errorf("Failed to get device handle of gpu-%d", index)
+		return nil, newError(fmt.Sprintf("get device handle of gpu-%d", index), ret)
 	}
 
 	d := &device{Device: dev}
@@ -112,7 +112,7 @@ func getDeviceByIndex(index uint) (*device, error) {
 func getDeviceByUUID(uuid string) (*device, error) {
 	dev, ret := goixml.GetHandleByUUID(uuid)
 	if ret != goixml.SUCCESS {
-		return nil, fmt.Errorf("Failed to get device handle of gpu-%s", uuid)
+		return nil, newError(fmt.Sprintf("get device handle of gpu-%s", uuid), ret)
 	}
 
 	d := &device{Device: dev}
@@ -133,7 +133,7 @@ func GetDeviceOnSameBoard(device1 Device, device2 Device) (error, bool) {
 
 	onSameBoard, ret := goixml.GetOnSameBoard(dev1.Device, dev2.Device)
 	if ret != goixml.SUCCESS {
-		return fmt.Errorf("Failed to judge whether two devices on same board"), isOnSameBoard
+		return newError("judge whether two devices on same board", ret), isOnSameBoard
 	}
 
 	if onSameBoard == 0 {
@@ -152,7 +152,7 @@ type device struct {
 func (d *device) DeviceGetName() (string, error) {
 	name, ret := d.GetName()
 	if ret != goixml.SUCCESS {
-		return "", fmt.Errorf("Failed to get device name of gpu")
+		return "", newError("get device name of gpu", ret)
 	}
 
 	return name, nil
@@ -161,7 +161,7 @@ func (d *device) DeviceGetName() (string, error) {
 func (d *device) DeviceGetUUID() (string, error) {
 	uuid, ret := d.GetUUID()
 	if ret != goixml.SUCCESS {
-		return "", fmt.Errorf("Failed to get device UUID of gpu")
+		return "", newError("get device UUID of gpu", ret)
 	}
 
 	return uuid, nil
@@ -170,17 +170,52 @@ func (d *device) DeviceGetUUID() (string, error) {
 func (d *device) DeviceGetIndex() (uint, error) {
 	index, ret := d.GetIndex()
 	if ret != goixml.SUCCESS {
-		return 0, fmt.Errorf("Failed to get device index of gpu")
+		return 0, newError("get device index of gpu", ret)
 	}
 
 	return uint(index), nil
 }
 
+func (d *device) DeviceGetSerial() (string, error) {
+	serial, ret := d.GetSerial()
+	if ret != goixml.SUCCESS {
+		return "", newError("get serial number of gpu", ret)
+	}
+
+	return serial, nil
+}
+
+func (d *device) DeviceGetBoardId() (uint32, error) {
+	boardId, ret := d.GetBoardId()
+	if ret != goixml.SUCCESS {
+		return 0, newError("get board id of gpu", ret)
+	}
+
+	return boardId, nil
+}
+
+func (d *device) DeviceGetBoardPartNumber() (string, error) {
+	partNumber, ret := d.GetBoardPartNumber()
+	if ret != goixml.SUCCESS {
+		return "", newError("get board part number of gpu", ret)
+	}
+
+	return partNumber, nil
+}
+
+func (d *device) DeviceGetCudaComputeCapability() (int, int, error) {
+	major, minor, ret := d.GetCudaComputeCapability()
+	if ret != goixml.SUCCESS {
+		return 0, 0, newError("get CUDA compute capability of gpu", ret)
+	}
+
+	return major, minor, nil
+}
+
 func (d *device) DeviceGetMinorNumber() (uint, error) {
 	minor, ret := d.GetMinorNumber()
 	if ret != goixml.SUCCESS {
-		// FIXME: 100 is a pseudo value.
-		return 100, fmt.Errorf("Failed to get device minor number of gpu")
+		return 0, newError("get device minor number of gpu", ret)
 	}
 
 	return uint(minor), nil
@@ -189,7 +224,7 @@ func (d *device) DeviceGetMinorNumber() (uint, error) {
 func (d *device) DeviceGetFanSpeed() (uint, error) {
 	speed, ret := d.GetFanSpeed()
 	if ret != goixml.SUCCESS {
-		return 0, fmt.Errorf("Failed to get fan speed of gpu")
+		return 0, newError("get fan speed of gpu", ret)
 	}
 	return uint(speed), nil
 }
@@ -197,7 +232,7 @@ func (d *device) DeviceGetFanSpeed() (uint, error) {
 func (d *device) DeviceGetMemoryInfo() (MemoryInfo, error) {
 	mem, ret := d.GetMemoryInfo()
 	if ret != goixml.SUCCESS {
-		return MemoryInfo{}, fmt.Errorf("Failed to get memory information of gpu")
+		return MemoryInfo{}, newError("get memory information of gpu", ret)
 	}
 
 	totalMem := uint64(mem.Total)
@@ -215,7 +250,7 @@ func (d *device) DeviceGetMemoryInfo() (MemoryInfo, error) {
 func (d *device) DeviceGetTemperature() (uint, error) {
 	temp, ret := d.GetTemperature()
 	if ret != goixml.SUCCESS {
-		return 0, fmt.Errorf("Failed to get the current temperature of gpu")
+		return 0, newError("get the current temperature of gpu", ret)
 	}
 
 	return uint(temp), nil
@@ -224,7 +259,7 @@ func (d *device) DeviceGetTemperature() (uint, error) {
 func (d *device) DeviceGetPciInfo() (PciInfo, error) {
 	pci, ret := d.GetPciInfo()
 	if ret != goixml.SUCCESS {
-		return PciInfo{}, fmt.Errorf("Failed to get pci information of gpu")
+		return PciInfo{}, newError("get pci information of gpu", ret)
 	}
 
 	bytesBuffer := bytes.NewBuffer([]byte{})
@@ -249,7 +284,7 @@ func (d *device) DeviceGetPciInfo() (PciInfo, error) {
 func (d *device) DeviceGetPowerUsage() (uint, error) {
 	usage, ret := d.GetPowerUsage()
 	if ret != goixml.SUCCESS {
-		return 0, fmt.Errorf("Failed to get power usage of gpu")
+		return 0, newError("get power usage of gpu", ret)
 	}
 
 	return uint(usage), nil
@@ -258,7 +293,7 @@ func (d *device) DeviceGetPowerUsage() (uint, error) {
 func (d *device) DeviceGetPowerLimitConstraints() (PowerLimitConstraints, error) {
 	min, max, ret := d.GetPowerManagementLimitConstraints()
 	if ret != goixml.SUCCESS {
-		return PowerLimitConstraints{}, fmt.Errorf("Failed to get power limitation of gpu")
+		return PowerLimitConstraints{}, newError("get power limitation of gpu", ret)
 	}
 
 	return PowerLimitConstraints{
@@ -267,10 +302,46 @@ func (d *device) DeviceGetPowerLimitConstraints() (PowerLimitConstraints, error)
 	}, nil
 }
 
+func (d *device) DeviceGetPowerLimit() (uint, error) {
+	limit, ret := d.GetPowerManagementLimit()
+	if ret != goixml.SUCCESS {
+		return 0, newError("get power limit of gpu", ret)
+	}
+
+	return uint(limit), nil
+}
+
+func (d *device) DeviceGetPowerDefaultLimit() (uint, error) {
+	limit, ret := d.GetPowerManagementDefaultLimit()
+	if ret != goixml.SUCCESS {
+		return 0, newError("get default power limit of gpu", ret)
+	}
+
+	return uint(limit), nil
+}
+
+func (d *device) DeviceGetVoltage() (Voltage, error) {
+	integer, decimal, ret := d.GetGPUVoltage()
+	if ret != goixml.SUCCESS {
+		return Voltage{}, newError("get voltage of gpu", ret)
+	}
+
+	return Voltage{Integer: uint(integer), Decimal: uint(decimal)}, nil
+}
+
+func (d *device) DeviceGetTemperatureThreshold(threshold TemperatureThreshold) (uint, error) {
+	temp, ret := d.GetTemperatureThreshold(goixml.TemperatureThresholds(threshold))
+	if ret != goixml.SUCCESS {
+		return 0, newError(fmt.Sprintf("get temperature threshold %d of gpu", threshold), ret)
+	}
+
+	return uint(temp), nil
+}
+
 func (d *device) DeviceGetClockInfo() (ClockInfo, error) {
 	clockinfo, ret := d.GetClockInfo()
 	if ret != goixml.SUCCESS {
-		return ClockInfo{}, fmt.Errorf("Failed to get SM clock of gpu")
+		return ClockInfo{}, newError("get SM clock of gpu", ret)
 	}
 
 	return ClockInfo{
@@ -282,7 +353,7 @@ func (d *device) DeviceGetClockInfo() (ClockInfo, error) {
 func (d *device) DeviceGetUtilization() (Utilization, error) {
 	utilization, ret := d.GetUtilizationRates()
 	if ret != goixml.SUCCESS {
-		return Utilization{}, fmt.Errorf("Failed to get utilization rates of gpu")
+		return Utilization{}, newError("get utilization rates of gpu", ret)
 	}
 
 	return Utilization{
@@ -291,6 +362,166 @@ func (d *device) DeviceGetUtilization() (Utilization, error) {
 	}, nil
 }
 
+func (d *device) DeviceGetComputeRunningProcesses() ([]ProcessInfo, error) {
+	infos, ret := d.GetComputeRunningProcesses()
+	if ret != goixml.SUCCESS {
+		return nil, newError("get running processes of gpu", ret)
+	}
+
+	var procs []ProcessInfo
+	for _, info := range infos {
+		procs = append(procs, ProcessInfo{
+			Pid:        info.Pid,
+			Name:       info.Name,
+			UsedMemory: info.UsedGpuMemory,
+		})
+	}
+	return procs, nil
+}
+
+func (d *device) DeviceGetComputeMode() (ComputeMode, error) {
+	mode, ret := d.GetComputeMode()
+	if ret != goixml.SUCCESS {
+		return 0, newError("get compute mode of gpu", ret)
+	}
+	return ComputeMode(mode), nil
+}
+
+func (d *device) DeviceGetCurrPcieLink() (PcieLink, error) {
+	gen, ret := d.GetCurrPcieLinkGeneration()
+	if ret != goixml.SUCCESS {
+		return PcieLink{}, newError("get PCIe link generation of gpu", ret)
+	}
+	width, ret := d.GetCurrPcieLinkWidth()
+	if ret != goixml.SUCCESS {
+		return PcieLink{}, newError("get PCIe link width of gpu", ret)
+	}
+	return PcieLink{Generation: uint(gen), Width: uint(width)}, nil
+}
+
+func (d *device) DeviceGetMaxPcieLink() (PcieLink, error) {
+	gen, ret := d.GetMaxPcieLinkGeneration()
+	if ret != goixml.SUCCESS {
+		return PcieLink{}, newError("get max PCIe link generation of gpu", ret)
+	}
+	width, ret := d.GetMaxPcieLinkWidth()
+	if ret != goixml.SUCCESS {
+		return PcieLink{}, newError("get max PCIe link width of gpu", ret)
+	}
+	return PcieLink{Generation: uint(gen), Width: uint(width)}, nil
+}
+
+func (d *device) DeviceGetPcieThroughput() (PcieThroughput, error) {
+	tx, ret := d.GetPcieThroughput(goixml.PCIE_UTIL_TX_BYTES)
+	if ret != goixml.SUCCESS {
+		return PcieThroughput{}, newError("get PCIe tx throughput of gpu", ret)
+	}
+	rx, ret := d.GetPcieThroughput(goixml.PCIE_UTIL_RX_BYTES)
+	if ret != goixml.SUCCESS {
+		return PcieThroughput{}, newError("get PCIe rx throughput of gpu", ret)
+	}
+	return PcieThroughput{Tx: uint(tx), Rx: uint(rx)}, nil
+}
+
+func (d *device) DeviceGetPcieReplayCounter() (uint, error) {
+	count, ret := d.GetPcieReplayCounter()
+	if ret != goixml.SUCCESS {
+		return 0, newError("get PCIe replay counter of gpu", ret)
+	}
+	return uint(count), nil
+}
+
+func (d *device) DeviceGetCurrentClocksThrottleReasons() (ThrottleReasons, error) {
+	reasons, ret := d.GetCurrentClocksThrottleReasons()
+	if ret != goixml.SUCCESS {
+		return 0, newError("get clocks throttle reasons of gpu", ret)
+	}
+	return ThrottleReasons(reasons), nil
+}
+
+func (d *device) DeviceGetEccMode() (bool, error) {
+	current, _, ret := d.GetEccMode()
+	if ret != goixml.SUCCESS {
+		return false, newError("get ECC mode of gpu", ret)
+	}
+	return current == goixml.FEATURE_ENABLED, nil
+}
+
+func (d *device) DeviceGetEccErrors() (EccCounts, error) {
+	single, double, ret := d.GetEccErros()
+	if ret != goixml.SUCCESS {
+		return EccCounts{}, newError("get ECC errors of gpu", ret)
+	}
+	return EccCounts{Corrected: uint64(single), Uncorrected: uint64(double)}, nil
+}
+
+func (d *device) DeviceGetSupportedEventTypes() (EventTypes, error) {
+	types, ret := d.GetSupportedEventTypes()
+	if ret != goixml.SUCCESS {
+		return 0, newError("get supported event types of gpu", ret)
+	}
+	return EventTypes(types), nil
+}
+
+type gpmSample struct {
+	goixml.GpmSample
+}
+
+func (s *gpmSample) Free() error {
+	if ret := s.GpmSample.Free(); ret != goixml.SUCCESS {
+		return newError("free GPM sample", ret)
+	}
+	return nil
+}
+
+func (d *device) DeviceGpmQueryDeviceSupport() (bool, error) {
+	support, ret := d.GpmQueryDeviceSupport()
+	if ret != goixml.SUCCESS {
+		return false, newError("query GPM support of gpu", ret)
+	}
+	return support.IsSupportedDevice != 0, nil
+}
+
+func (d *device) DeviceGpmSampleGet() (GpmSample, error) {
+	sample, ret := goixml.GpmSampleAlloc()
+	if ret != goixml.SUCCESS {
+		return nil, newError("allocate GPM sample", ret)
+	}
+	if ret := d.GpmSampleGet(sample); ret != goixml.SUCCESS {
+		sample.Free()
+		return nil, newError("get GPM sample of gpu", ret)
+	}
+	return &gpmSample{sample}, nil
+}
+
+func (d *device) DeviceGpmMetricsGet(first, second GpmSample, metrics []GpmMetric) (map[GpmMetric]float64, error) {
+	s1, ok1 := first.(*gpmSample)
+	s2, ok2 := second.(*gpmSample)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("GPM samples were not taken by IXML")
+	}
+
+	get := goixml.GpmMetricsGetType{Sample1: s1.GpmSample, Sample2: s2.GpmSample}
+	for _, m := range metrics {
+		if int(get.NumMetrics) == len(get.Metrics) {
+			break
+		}
+		get.Metrics[get.NumMetrics].MetricId = uint32(m)
+		get.NumMetrics++
+	}
+	if ret := goixml.GpmMetricsGet(&get); ret != goixml.SUCCESS {
+		return nil, newError("get GPM metrics of gpu", ret)
+	}
+
+	values := map[GpmMetric]float64{}
+	for _, m := range get.Metrics[:get.NumMetrics] {
+		if goixml.Return(m.NvmlReturn) == goixml.SUCCESS {
+			values[GpmMetric(m.MetricId)] = m.Value
+		}
+	}
+	return values, nil
+}
+
 func CheckDeviceError(health Health) []error {
 	errs := []error{}
 	if (health & Health(goixml.HealthSYSHUBError)) > 0 {
@@ -318,10 +549,19 @@ func CheckDeviceError(health Health) []error {
 	return errs
 }
 
+// JoinDeviceErrors formats the errors returned by CheckDeviceError.
+func JoinDeviceErrors(errs []error) string {
+	var reasons []string
+	for _, e := range errs {
+		reasons = append(reasons, e.Error())
+	}
+	return strings.Join(reasons, ", ")
+}
+
 func (d *device) DeviceGetHealth() (Health, error) {
 	health, ret := d.GetHealth()
 	if ret != goixml.SUCCESS {
-		return Health(health), fmt.Errorf("Failed to get Health status of GPU: %v", ret)
+		return Health(health), newError("get Health status of GPU", ret)
 	}
 
 	return Health(health), nil
@@ -330,7 +570,7 @@ func (d *device) DeviceGetHealth() (Health, error) {
 func (d *device) DeviceGetNumaNode() (bool, int, error) {
 	info, err := d.DeviceGetPciInfo()
 	if err != nil {
-		return false, 0, fmt.Errorf("error getting PCI Bus Info of device: %v", err)
+		return false, 0, fmt.Errorf("error getting PCI Bus Info of device: %w", err)
 	}
 
 	busID := strings.ToLower(info.BusIdLegacy)
@@ -359,7 +599,7 @@ func (d *device) DeviceGetTopology(device2 *Device) (goixml.GpuTopologyLevel, er
 
 	pathinfo, ret := d.GetTopology(dev2.Device)
 	if ret != goixml.SUCCESS {
-		return goixml.GpuTopologyLevel(0), fmt.Errorf("unkown topology %v", ret)
+		return goixml.GpuTopologyLevel(0), newError("get topology of gpu", ret)
 	} else {
 		return pathinfo, nil
 	}
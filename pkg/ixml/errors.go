@@ -0,0 +1,85 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ixml
+
+import (
+	"errors"
+	"fmt"
+
+	goixml "gitee.com/deep-spark/go-ixml/pkg/ixml"
+)
+
+// Error is an IXML call which failed, with the code the library returned.
+type Error struct {
+	// Op is what the call did, such as "get device UUID of gpu"
+	Op     string
+	Return goixml.Return
+}
+
+func newError(op string, ret goixml.Return) error {
+	return &Error{Op: op, Return: ret}
+}
+
+var returnNames = map[goixml.Return]string{
+	goixml.ERROR_UNINITIALIZED:       "uninitialized",
+	goixml.ERROR_INVALID_ARGUMENT:    "invalid argument",
+	goixml.ERROR_NOT_SUPPORTED:       "not supported",
+	goixml.ERROR_NO_PERMISSION:       "no permission",
+	goixml.ERROR_ALREADY_INITIALIZED: "already initialized",
+	goixml.ERROR_NOT_FOUND:           "not found",
+	goixml.ERROR_INSUFFICIENT_SIZE:   "insufficient size",
+	goixml.ERROR_DRIVER_NOT_LOADED:   "driver not loaded",
+	goixml.ERROR_TIMEOUT:             "timeout",
+	goixml.ERROR_LIBRARY_NOT_FOUND:   "library not found",
+	goixml.ERROR_FUNCTION_NOT_FOUND:  "function not found",
+	goixml.ERROR_GPU_IS_LOST:         "gpu is lost",
+	goixml.ERROR_RESET_REQUIRED:      "reset required",
+	goixml.ERROR_IN_USE:              "in use",
+	goixml.ERROR_MEMORY:              "out of memory",
+	goixml.ERROR_NO_DATA:             "no data",
+	goixml.ERROR_UNKNOWN:             "unknown error",
+}
+
+func (e *Error) Error() string {
+	name, ok := returnNames[e.Return]
+	if !ok {
+		name = fmt.Sprintf("error %d", e.Return)
+	}
+	return fmt.Sprintf("Failed to %s: %s", e.Op, name)
+}
+
+func isReturn(err error, ret goixml.Return) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Return == ret
+}
+
+// IsNotSupported tells if err is a call the gpu or the driver does not
+// support.
+func IsNotSupported(err error) bool {
+	return isReturn(err, goixml.ERROR_NOT_SUPPORTED)
+}
+
+// IsGPULost tells if err is a call to a gpu fallen off the bus.
+func IsGPULost(err error) bool {
+	return isReturn(err, goixml.ERROR_GPU_IS_LOST)
+}
+
+// IsUninitialized tells if err is a call made before Init.
+func IsUninitialized(err error) bool {
+	return isReturn(err, goixml.ERROR_UNINITIALIZED)
+}
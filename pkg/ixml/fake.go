@@ -0,0 +1,341 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ixml
+
+import (
+	"fmt"
+	"sync"
+
+	goixml "gitee.com/deep-spark/go-ixml/pkg/ixml"
+)
+
+// FakeDevice is a Device reporting what its fields are set to, for tests and
+// offline tools. Err, when set, is returned by every call instead, such as an
+// Error with ERROR_GPU_IS_LOST for a gpu fallen off the bus.
+type FakeDevice struct {
+	Name       string
+	UUID       string
+	Index      uint
+	Minor      uint
+	Serial     string
+	BoardID    uint32
+	PartNumber string
+	// BoardPosition is -1 if the gpu does not report it
+	BoardPosition int
+	// NumaNode is -1 if the gpu is not attached to a NUMA node
+	NumaNode int
+
+	CudaMajor, CudaMinor int
+	FanSpeed             uint
+	Memory               MemoryInfo
+	Temperature          uint
+	Pci                  PciInfo
+	PowerUsage           uint
+	PowerConstraints     PowerLimitConstraints
+	PowerLimit           uint
+	PowerDefaultLimit    uint
+	Voltage              Voltage
+	// TemperatureThresholds missing a threshold do not support it
+	TemperatureThresholds map[TemperatureThreshold]uint
+	Clocks                ClockInfo
+	Utilization           Utilization
+	Health                Health
+	// Topology to the other gpus, by uuid
+	Topology map[string]goixml.GpuTopologyLevel
+
+	Processes       []ProcessInfo
+	ComputeMode     ComputeMode
+	CurrPcieLink    PcieLink
+	MaxPcieLink     PcieLink
+	PcieThroughput  PcieThroughput
+	PcieReplays     uint
+	ThrottleReasons ThrottleReasons
+	EccEnabled      bool
+	EccErrors       EccCounts
+	EventTypes      EventTypes
+	// GpmMetrics are returned between any two samples, GPM is supported if
+	// it is not nil
+	GpmMetrics map[GpmMetric]float64
+	// HealthErr, when set, is returned by DeviceGetHealth only
+	HealthErr error
+
+	Err error
+
+	// lk guards the fields set through the FakeBackend: ComputeMode and
+	// Clocks
+	lk sync.Mutex
+}
+
+var _ Device = &FakeDevice{}
+
+func (d *FakeDevice) DeviceGetName() (string, error) {
+	return d.Name, d.Err
+}
+
+func (d *FakeDevice) DeviceGetMinorNumber() (uint, error) {
+	return d.Minor, d.Err
+}
+
+func (d *FakeDevice) DeviceGetUUID() (string, error) {
+	return d.UUID, d.Err
+}
+
+func (d *FakeDevice) DeviceGetIndex() (uint, error) {
+	return d.Index, d.Err
+}
+
+func (d *FakeDevice) DeviceGetSerial() (string, error) {
+	return d.Serial, d.Err
+}
+
+func (d *FakeDevice) DeviceGetBoardId() (uint32, error) {
+	return d.BoardID, d.Err
+}
+
+func (d *FakeDevice) DeviceGetBoardPartNumber() (string, error) {
+	return d.PartNumber, d.Err
+}
+
+func (d *FakeDevice) DeviceGetCudaComputeCapability() (int, int, error) {
+	return d.CudaMajor, d.CudaMinor, d.Err
+}
+
+func (d *FakeDevice) DeviceGetFanSpeed() (uint, error) {
+	return d.FanSpeed, d.Err
+}
+
+func (d *FakeDevice) DeviceGetMemoryInfo() (MemoryInfo, error) {
+	return d.Memory, d.Err
+}
+
+func (d *FakeDevice) DeviceGetTemperature() (uint, error) {
+	return d.Temperature, d.Err
+}
+
+func (d *FakeDevice) DeviceGetPciInfo() (PciInfo, error) {
+	return d.Pci, d.Err
+}
+
+func (d *FakeDevice) DeviceGetPowerUsage() (uint, error) {
+	return d.PowerUsage, d.Err
+}
+
+func (d *FakeDevice) DeviceGetPowerLimitConstraints() (PowerLimitConstraints, error) {
+	return d.PowerConstraints, d.Err
+}
+
+func (d *FakeDevice) DeviceGetPowerLimit() (uint, error) {
+	return d.PowerLimit, d.Err
+}
+
+func (d *FakeDevice) DeviceGetPowerDefaultLimit() (uint, error) {
+	return d.PowerDefaultLimit, d.Err
+}
+
+func (d *FakeDevice) DeviceGetVoltage() (Voltage, error) {
+	return d.Voltage, d.Err
+}
+
+func (d *FakeDevice) DeviceGetTemperatureThreshold(threshold TemperatureThreshold) (uint, error) {
+	if d.Err != nil {
+		return 0, d.Err
+	}
+	temp, ok := d.TemperatureThresholds[threshold]
+	if !ok {
+		return 0, newError(fmt.Sprintf("get temperature threshold %d of gpu", threshold), goixml.ERROR_NOT_SUPPORTED)
+	}
+	return temp, nil
+}
+
+func (d *FakeDevice) DeviceGetClockInfo() (ClockInfo, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.Clocks, d.Err
+}
+
+func (d *FakeDevice) DeviceGetUtilization() (Utilization, error) {
+	return d.Utilization, d.Err
+}
+
+func (d *FakeDevice) DeviceGetHealth() (Health, error) {
+	if d.Err != nil {
+		return 0, d.Err
+	}
+	return d.Health, d.HealthErr
+}
+
+func (d *FakeDevice) DeviceGetNumaNode() (bool, int, error) {
+	return d.NumaNode >= 0, d.NumaNode, d.Err
+}
+
+func (d *FakeDevice) DeviceGetTopology(device2 *Device) (goixml.GpuTopologyLevel, error) {
+	if d.Err != nil {
+		return 0, d.Err
+	}
+	uuid, err := (*device2).DeviceGetUUID()
+	if err != nil {
+		return 0, err
+	}
+	level, ok := d.Topology[uuid]
+	if !ok {
+		return 0, fmt.Errorf("Failed to get topology between gpu %s and %s", d.UUID, uuid)
+	}
+	return level, nil
+}
+
+func (d *FakeDevice) DeviceGetBoardPosition() (bool, int) {
+	return d.Err == nil && d.BoardPosition >= 0, d.BoardPosition
+}
+
+func (d *FakeDevice) DeviceGetComputeRunningProcesses() ([]ProcessInfo, error) {
+	return d.Processes, d.Err
+}
+
+func (d *FakeDevice) DeviceGetComputeMode() (ComputeMode, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.ComputeMode, d.Err
+}
+
+func (d *FakeDevice) DeviceGetCurrPcieLink() (PcieLink, error) {
+	return d.CurrPcieLink, d.Err
+}
+
+func (d *FakeDevice) DeviceGetMaxPcieLink() (PcieLink, error) {
+	return d.MaxPcieLink, d.Err
+}
+
+func (d *FakeDevice) DeviceGetPcieThroughput() (PcieThroughput, error) {
+	return d.PcieThroughput, d.Err
+}
+
+func (d *FakeDevice) DeviceGetPcieReplayCounter() (uint, error) {
+	return d.PcieReplays, d.Err
+}
+
+func (d *FakeDevice) DeviceGetCurrentClocksThrottleReasons() (ThrottleReasons, error) {
+	return d.ThrottleReasons, d.Err
+}
+
+func (d *FakeDevice) DeviceGetEccMode() (bool, error) {
+	return d.EccEnabled, d.Err
+}
+
+func (d *FakeDevice) DeviceGetEccErrors() (EccCounts, error) {
+	return d.EccErrors, d.Err
+}
+
+func (d *FakeDevice) DeviceGetSupportedEventTypes() (EventTypes, error) {
+	return d.EventTypes, d.Err
+}
+
+type fakeGpmSample struct{}
+
+func (fakeGpmSample) Free() error {
+	return nil
+}
+
+func (d *FakeDevice) DeviceGpmQueryDeviceSupport() (bool, error) {
+	return d.GpmMetrics != nil, d.Err
+}
+
+func (d *FakeDevice) DeviceGpmSampleGet() (GpmSample, error) {
+	if d.Err != nil {
+		return nil, d.Err
+	}
+	return fakeGpmSample{}, nil
+}
+
+func (d *FakeDevice) DeviceGpmMetricsGet(first, second GpmSample, metrics []GpmMetric) (map[GpmMetric]float64, error) {
+	if d.Err != nil {
+		return nil, d.Err
+	}
+	values := map[GpmMetric]float64{}
+	for _, m := range metrics {
+		if v, ok := d.GpmMetrics[m]; ok {
+			values[m] = v
+		}
+	}
+	return values, nil
+}
+
+// FakeBackend is a Backend enumerating FakeDevices, by index. The settings
+// are applied to the device of the uuid, SetErr is returned instead when set.
+type FakeBackend struct {
+	Devices []*FakeDevice
+	SetErr  error
+}
+
+var _ Backend = &FakeBackend{}
+
+func (b *FakeBackend) GetDeviceCount() (uint, error) {
+	return uint(len(b.Devices)), nil
+}
+
+func (b *FakeBackend) NewDeviceByIndex(index uint) (Device, error) {
+	if index >= uint(len(b.Devices)) {
+		return nil, newError(fmt.Sprintf("get device handle of gpu-%d", index), goixml.ERROR_INVALID_ARGUMENT)
+	}
+	return b.Devices[index], nil
+}
+
+func (b *FakeBackend) NewDeviceByUUID(uuid string) (Device, error) {
+	if d := b.device(uuid); d != nil {
+		return d, nil
+	}
+	return nil, newError(fmt.Sprintf("get device handle of gpu-%s", uuid), goixml.ERROR_NOT_FOUND)
+}
+
+func (b *FakeBackend) device(uuid string) *FakeDevice {
+	for _, d := range b.Devices {
+		if d.UUID == uuid {
+			return d
+		}
+	}
+	return nil
+}
+
+func (b *FakeBackend) SetComputeMode(uuid string, mode ComputeMode) error {
+	if b.SetErr != nil {
+		return b.SetErr
+	}
+	d := b.device(uuid)
+	if d == nil {
+		return newError(fmt.Sprintf("set compute mode of gpu-%s", uuid), goixml.ERROR_NOT_FOUND)
+	}
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.ComputeMode = mode
+	return nil
+}
+
+// SetApplicationClocks sets the clocks the device reports, as it runs at the
+// application clocks under load.
+func (b *FakeBackend) SetApplicationClocks(uuid string, mem, sm uint) error {
+	if b.SetErr != nil {
+		return b.SetErr
+	}
+	d := b.device(uuid)
+	if d == nil {
+		return newError(fmt.Sprintf("set application clocks of gpu-%s", uuid), goixml.ERROR_NOT_FOUND)
+	}
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.Clocks = ClockInfo{Mem: mem, Sm: sm}
+	return nil
+}
@@ -17,7 +17,11 @@ limitations under the License.
 
 package ixml
 
-import goixml "gitee.com/deep-spark/go-ixml/pkg/ixml"
+import (
+	"fmt"
+
+	goixml "gitee.com/deep-spark/go-ixml/pkg/ixml"
+)
 
 // MemoryInfo contains information of a gpu device.
 type MemoryInfo struct {
@@ -57,6 +61,126 @@ type Utilization struct {
 
 type Health uint64
 
+// ComputeMode tells which processes may run on a gpu at the same time.
+type ComputeMode uint
+
+const (
+	ComputeModeDefault          = ComputeMode(goixml.COMPUTEMODE_DEFAULT)
+	ComputeModeExclusiveThread  = ComputeMode(goixml.COMPUTEMODE_EXCLUSIVE_THREAD)
+	ComputeModeProhibited       = ComputeMode(goixml.COMPUTEMODE_PROHIBITED)
+	ComputeModeExclusiveProcess = ComputeMode(goixml.COMPUTEMODE_EXCLUSIVE_PROCESS)
+)
+
+func (m ComputeMode) String() string {
+	switch m {
+	case ComputeModeDefault:
+		return "Default"
+	case ComputeModeExclusiveThread:
+		return "ExclusiveThread"
+	case ComputeModeProhibited:
+		return "Prohibited"
+	case ComputeModeExclusiveProcess:
+		return "ExclusiveProcess"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint(m))
+}
+
+// ThrottleReasons is the bitmask of the reasons the clocks of a gpu are
+// lowered, IXML reports them with the NVML values.
+type ThrottleReasons uint64
+
+const (
+	ThrottleGpuIdle              ThrottleReasons = 0x1
+	ThrottleApplicationsClocks   ThrottleReasons = 0x2
+	ThrottleSwPowerCap           ThrottleReasons = 0x4
+	ThrottleHwSlowdown           ThrottleReasons = 0x8
+	ThrottleSyncBoost            ThrottleReasons = 0x10
+	ThrottleSwThermalSlowdown    ThrottleReasons = 0x20
+	ThrottleHwThermalSlowdown    ThrottleReasons = 0x40
+	ThrottleHwPowerBrakeSlowdown ThrottleReasons = 0x80
+
+	// ThrottleThermal and ThrottlePower group the reasons by their cause
+	ThrottleThermal = ThrottleSwThermalSlowdown | ThrottleHwThermalSlowdown | ThrottleHwSlowdown
+	ThrottlePower   = ThrottleSwPowerCap | ThrottleHwPowerBrakeSlowdown
+)
+
+// PcieLink is the generation and width of the PCIe link of a gpu.
+type PcieLink struct {
+	Generation uint
+	Width      uint
+}
+
+// EccCounts are the ECC errors a gpu counted since the driver was loaded.
+type EccCounts struct {
+	// Corrected are the single bit errors
+	Corrected uint64
+	// Uncorrected are the double bit errors
+	Uncorrected uint64
+}
+
+// PcieThroughput is the PCIe throughput of a gpu, in KB per second.
+type PcieThroughput struct {
+	Tx uint
+	Rx uint
+}
+
+// Voltage of a gpu, as the integer and decimal parts the driver reports.
+type Voltage struct {
+	Integer uint
+	Decimal uint
+}
+
+// TemperatureThreshold is a temperature at which the gpu acts.
+type TemperatureThreshold uint
+
+const (
+	TemperatureThresholdShutdown = TemperatureThreshold(goixml.TEMPERATURE_THRESHOLD_SHUTDOWN)
+	TemperatureThresholdSlowdown = TemperatureThreshold(goixml.TEMPERATURE_THRESHOLD_SLOWDOWN)
+	TemperatureThresholdMemMax   = TemperatureThreshold(goixml.TEMPERATURE_THRESHOLD_MEM_MAX)
+	TemperatureThresholdGpuMax   = TemperatureThreshold(goixml.TEMPERATURE_THRESHOLD_GPU_MAX)
+)
+
+// EventTypes is the bitmask of the events a gpu may report.
+type EventTypes uint64
+
+const (
+	EventSingleBitEccError = EventTypes(goixml.EventTypeSingleBitEccError)
+	EventDoubleBitEccError = EventTypes(goixml.EventTypeDoubleBitEccError)
+	EventPState            = EventTypes(goixml.EventTypePState)
+	EventXidCriticalError  = EventTypes(goixml.EventTypeXidCriticalError)
+	EventClock             = EventTypes(goixml.EventTypeClock)
+	EventPowerSourceChange = EventTypes(goixml.EventTypePowerSourceChange)
+)
+
+// GpmMetric is a profiling metric GPM computes from two samples of a gpu.
+// The utilizations are in percent, the PCIe throughputs in MiB per second.
+type GpmMetric uint32
+
+const (
+	GpmSmUtil        = GpmMetric(goixml.GPM_METRIC_SM_UTIL)
+	GpmSmOccupancy   = GpmMetric(goixml.GPM_METRIC_SM_OCCUPANCY)
+	GpmAnyTensorUtil = GpmMetric(goixml.GPM_METRIC_ANY_TENSOR_UTIL)
+	GpmDramBwUtil    = GpmMetric(goixml.GPM_METRIC_DRAM_BW_UTIL)
+	GpmFp64Util      = GpmMetric(goixml.GPM_METRIC_FP64_UTIL)
+	GpmFp32Util      = GpmMetric(goixml.GPM_METRIC_FP32_UTIL)
+	GpmFp16Util      = GpmMetric(goixml.GPM_METRIC_FP16_UTIL)
+	GpmPcieTxPerSec  = GpmMetric(goixml.GPM_METRIC_PCIE_TX_PER_SEC)
+	GpmPcieRxPerSec  = GpmMetric(goixml.GPM_METRIC_PCIE_RX_PER_SEC)
+)
+
+// GpmSample is a snapshot of the GPM counters of a gpu, it must be freed.
+type GpmSample interface {
+	Free() error
+}
+
+// ProcessInfo is a process running compute work on a gpu.
+type ProcessInfo struct {
+	Pid  uint32
+	Name string
+	// UsedMemory in MiB
+	UsedMemory uint64
+}
+
 // Device defines the implementation of specified device.
 type Device interface {
 	// DeviceGetName returns the name of the gpu.
@@ -71,6 +195,19 @@ type Device interface {
 	// DeviceGetIndex returns the index of the gpu.
 	DeviceGetIndex() (uint, error)
 
+	// DeviceGetSerial returns the board serial number of the gpu.
+	DeviceGetSerial() (string, error)
+
+	// DeviceGetBoardId returns the id of the board the gpu is on.
+	DeviceGetBoardId() (uint32, error)
+
+	// DeviceGetBoardPartNumber returns the part number of the board.
+	DeviceGetBoardPartNumber() (string, error)
+
+	// DeviceGetCudaComputeCapability returns the CUDA compute capability
+	// of the gpu.
+	DeviceGetCudaComputeCapability() (major int, minor int, err error)
+
 	// DeviceGetFanSpeed returns the value of the gpu fan speed.
 	DeviceGetFanSpeed() (uint, error)
 
@@ -89,6 +226,20 @@ type Device interface {
 	// DeviceGetPowerLimitConstraints returns the power limitation of the gpu.
 	DeviceGetPowerLimitConstraints() (PowerLimitConstraints, error)
 
+	// DeviceGetPowerLimit returns the power limit of the gpu in milliwatts.
+	DeviceGetPowerLimit() (uint, error)
+
+	// DeviceGetPowerDefaultLimit returns the power limit the gpu boots with,
+	// in milliwatts.
+	DeviceGetPowerDefaultLimit() (uint, error)
+
+	// DeviceGetVoltage returns the current voltage of the gpu.
+	DeviceGetVoltage() (Voltage, error)
+
+	// DeviceGetTemperatureThreshold returns a temperature threshold of the
+	// gpu in degrees C.
+	DeviceGetTemperatureThreshold(threshold TemperatureThreshold) (uint, error)
+
 	// DeviceGetClockInfo returns the sm clock and memory clock of the gpu.
 	DeviceGetClockInfo() (ClockInfo, error)
 
@@ -104,6 +255,93 @@ type Device interface {
 	DeviceGetTopology(device2 *Device) (goixml.GpuTopologyLevel, error)
 
 	DeviceGetBoardPosition() (bool, int)
+
+	// DeviceGetComputeRunningProcesses returns the processes running compute
+	// work on the gpu.
+	DeviceGetComputeRunningProcesses() ([]ProcessInfo, error)
+
+	// DeviceGetComputeMode returns the compute mode of the gpu.
+	DeviceGetComputeMode() (ComputeMode, error)
+
+	// DeviceGetCurrPcieLink returns the PCIe link the gpu trained at.
+	DeviceGetCurrPcieLink() (PcieLink, error)
+
+	// DeviceGetMaxPcieLink returns the fastest PCIe link the gpu supports.
+	DeviceGetMaxPcieLink() (PcieLink, error)
+
+	// DeviceGetPcieThroughput returns the PCIe throughput of the gpu.
+	DeviceGetPcieThroughput() (PcieThroughput, error)
+
+	// DeviceGetPcieReplayCounter returns the number of PCIe replays since
+	// the driver was loaded.
+	DeviceGetPcieReplayCounter() (uint, error)
+
+	// DeviceGetCurrentClocksThrottleReasons returns why the clocks of the
+	// gpu are lowered.
+	DeviceGetCurrentClocksThrottleReasons() (ThrottleReasons, error)
+
+	// DeviceGetEccMode tells if ECC is enabled on the gpu.
+	DeviceGetEccMode() (bool, error)
+
+	// DeviceGetEccErrors returns the ECC errors counted by the gpu.
+	DeviceGetEccErrors() (EccCounts, error)
+
+	// DeviceGetSupportedEventTypes returns the events the gpu may report.
+	// They can not be waited for: go-ixml declares RegisterEvents, but no
+	// EventSet type nor a way to create or wait on a set, so the health
+	// check polls the gpus instead.
+	DeviceGetSupportedEventTypes() (EventTypes, error)
+
+	// DeviceGpmQueryDeviceSupport tells if the gpu supports GPM.
+	DeviceGpmQueryDeviceSupport() (bool, error)
+
+	// DeviceGpmSampleGet takes a GPM sample of the gpu.
+	DeviceGpmSampleGet() (GpmSample, error)
+
+	// DeviceGpmMetricsGet computes the metrics between two samples of the
+	// gpu. The metrics the gpu can not compute are left out.
+	DeviceGpmMetricsGet(first, second GpmSample, metrics []GpmMetric) (map[GpmMetric]float64, error)
+}
+
+// Backend enumerates the chips of the node, and changes their settings.
+// Library is the one backed by the IXML library and ixsmi, tests and offline
+// tools may provide their own.
+type Backend interface {
+	GetDeviceCount() (uint, error)
+	NewDeviceByIndex(index uint) (Device, error)
+	NewDeviceByUUID(uuid string) (Device, error)
+
+	// SetComputeMode sets the compute mode of the gpu.
+	SetComputeMode(uuid string, mode ComputeMode) error
+	// SetApplicationClocks sets the memory and SM clocks, in MHz, the gpu
+	// runs applications at.
+	SetApplicationClocks(uuid string, mem, sm uint) error
+}
+
+type library struct{}
+
+// Library is the Backend backed by the IXML library, which must be
+// initialized with Init.
+var Library Backend = library{}
+
+func (library) GetDeviceCount() (uint, error) {
+	return GetDeviceCount()
+}
+
+func (library) NewDeviceByIndex(index uint) (Device, error) {
+	return NewDeviceByIndex(index)
+}
+
+func (library) NewDeviceByUUID(uuid string) (Device, error) {
+	return NewDeviceByUUID(uuid)
+}
+
+func (library) SetComputeMode(uuid string, mode ComputeMode) error {
+	return SetComputeMode(uuid, mode)
+}
+
+func (library) SetApplicationClocks(uuid string, mem, sm uint) error {
+	return SetApplicationClocks(uuid, mem, sm)
 }
 
 // Init
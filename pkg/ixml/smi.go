@@ -0,0 +1,47 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ixml
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// IXML only reads the settings of a gpu, they are changed through ixsmi.
+const ixsmi = "/usr/local/corex/bin/ixsmi"
+
+// SetComputeMode sets the compute mode of the gpu.
+func SetComputeMode(uuid string, mode ComputeMode) error {
+	return runIxsmi("-i", uuid, "-c", fmt.Sprintf("%d", mode))
+}
+
+// SetApplicationClocks sets the memory and SM clocks, in MHz, the gpu runs
+// applications at.
+func SetApplicationClocks(uuid string, mem, sm uint) error {
+	return runIxsmi("-i", uuid, "-ac", fmt.Sprintf("%d,%d", mem, sm))
+}
+
+func runIxsmi(args ...string) error {
+	output, err := exec.Command(ixsmi, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ixsmi %s failed: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -16,7 +16,11 @@ limitations under the License.
 */
 package kube
 
-import "regexp"
+import (
+	"regexp"
+
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
+)
 
 const (
 	DefaultNameSpace       = "kube-system"
@@ -24,12 +28,24 @@ const (
 	DeviceInfoCMDataKey    = "DeviceInfoCfg"
 	DeviceListCMDataKey    = "DeviceListCfg"
 
+	DeviceInfoSchemaCMDataKey = deviceinfo.DataKey
+
 	ResourceNamePrefix = "iluvatar.com/"
 	GPU                = "gpu"
 	PodDevVolcano      = "DevVolcano"
 	PodDevKubelet      = "DevKubelet"
 	PodDevRealAlloc    = "DevRealAlloc"
+	PodDevVolcanoBound = "DevVolcanoBound"
 	PodPredicateTime   = "predicate-time"
+	NodeResetRequest   = "reset-request"
+	NodeDrainRequest   = "drain-request"
+	NodeResetStatus    = "reset-status"
+	NodeExcludeDevices = "exclude-devices"
+
+	MaintenancePhaseDraining  = "Draining"
+	MaintenancePhaseResetting = "Resetting"
+	MaintenancePhaseSucceeded = "Succeeded"
+	MaintenancePhaseFailed    = "Failed"
 
 	KubeEnvMaxLength       = 230
 	RetryUpdateCount       = 3
@@ -42,6 +58,8 @@ const (
 
 	ResetConfigName  = "ix-gpu-reset-"
 	DevicePluginName = "ix-device-plugin"
+
+	NodeConditionGPUHealthy = "IluvatarGPUHealthy"
 )
 
 var (
@@ -0,0 +1,55 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package kube
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func (ki *KubeClient) InitEventRecorder() {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: ki.Client.CoreV1().Events("")})
+	ki.Recorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{
+		Component: DevicePluginName,
+		Host:      ki.NodeName,
+	})
+}
+
+// RecordNodeEvent records an event against the node the plugin runs on.
+func (ki *KubeClient) RecordNodeEvent(eventType, reason, message string) {
+	if ki.Recorder == nil {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind: "Node",
+		Name: ki.NodeName,
+		UID:  types.UID(ki.NodeName),
+	}
+	ki.Recorder.Event(ref, eventType, reason, message)
+}
+
+// RecordPodEvent records an event against pod.
+func (ki *KubeClient) RecordPodEvent(pod *v1.Pod, eventType, reason, message string) {
+	if ki.Recorder == nil {
+		return
+	}
+	ki.Recorder.Event(pod, eventType, reason, message)
+}
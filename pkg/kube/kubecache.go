@@ -3,29 +3,19 @@ package kube
 import (
 	"context"
 	"fmt"
-	"math"
 	"reflect"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
-var (
-	nodeDeviceInfoCache *NodeDeviceInfoCache
-	podCache            = map[types.UID]*podInfo{}
-	lock                = sync.Mutex{}
-)
-
 type podInfo struct {
 	*v1.Pod
 	updateTime time.Time
@@ -39,15 +29,15 @@ func (ki *KubeClient) InitPodInformer() {
 	podInformer := factory.Core().V1().Pods().Informer()
 	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			UpdatePodList(nil, obj, EventTypeAdd)
+			ki.UpdatePodList(nil, obj, EventTypeAdd)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			if !reflect.DeepEqual(oldObj, newObj) {
-				UpdatePodList(oldObj, newObj, EventTypeUpdate)
+				ki.UpdatePodList(oldObj, newObj, EventTypeUpdate)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
-			UpdatePodList(nil, obj, EventTypeDelete)
+			ki.UpdatePodList(nil, obj, EventTypeDelete)
 		},
 	})
 	podInformer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
@@ -60,33 +50,97 @@ func (ki *KubeClient) InitPodInformer() {
 	ki.PodInformer = podInformer
 }
 
-func UpdatePodList(oldObj, newObj interface{}, operator EventType) {
+func (ki *KubeClient) InitNodeInformer(handler func(node *v1.Node)) {
+	factory := informers.NewSharedInformerFactoryWithOptions(ki.Client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = "metadata.name=" + ki.NodeName
+		}))
+	nodeInformer := factory.Core().V1().Nodes().Informer()
+	nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if node, ok := obj.(*v1.Node); ok {
+				handler(node)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(oldNode.Annotations, newNode.Annotations) {
+				handler(newNode)
+			}
+		},
+	})
+	nodeInformer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		klog.Errorf("node informer watch error: %v", err)
+	})
+	factory.Start(make(chan struct{}))
+
+	cache.WaitForCacheSync(wait.NeverStop, nodeInformer.HasSynced)
+
+	ki.NodeInformer = nodeInformer
+}
+
+// CheckInformers fails if an informer started by the client stopped or is
+// not synced.
+func (ki *KubeClient) CheckInformers() error {
+	informers := map[string]cache.SharedIndexInformer{
+		"pod":  ki.PodInformer,
+		"node": ki.NodeInformer,
+	}
+	for name, informer := range informers {
+		if informer == nil {
+			continue
+		}
+		if informer.IsStopped() {
+			return fmt.Errorf("%s informer stopped", name)
+		}
+		if !informer.HasSynced() {
+			return fmt.Errorf("%s informer not synced", name)
+		}
+	}
+	return nil
+}
+
+// UpdatePodList applies an event of the pod informer to the pod cache.
+func (ki *KubeClient) UpdatePodList(oldObj, newObj interface{}, operator EventType) {
 	newPod, ok := newObj.(*v1.Pod)
 	if !ok {
 		return
 	}
-	lock.Lock()
-	defer lock.Unlock()
+	ki.podLk.Lock()
+	defer ki.podLk.Unlock()
 	switch operator {
 	case EventTypeAdd, EventTypeUpdate:
 		// klog.Infof("pod(%s/%s) is %s to cache", newPod.Namespace, newPod.Name, operator)
-		podCache[newPod.UID] = &podInfo{
+		ki.podCache[newPod.UID] = &podInfo{
 			Pod:        newPod,
-			updateTime: time.Now(),
+			updateTime: ki.clock.Now(),
 		}
 	case EventTypeDelete:
 		// klog.Infof("pod(%s/%s) is deleted from cache", newPod.Namespace, newPod.Name)
-		delete(podCache, newPod.UID)
+		delete(ki.podCache, newPod.UID)
 	default:
 		klog.Errorf("operator is undefined, find operater: %s", operator)
 	}
 }
 
+// HasPodCache tells whether the pod informer was started, the pod cache is
+// empty otherwise.
+func (ki *KubeClient) HasPodCache() bool {
+	return ki.PodInformer != nil
+}
+
 func (ki *KubeClient) GetActivePodListCache() []v1.Pod {
 	newPodList := make([]v1.Pod, 0)
-	lock.Lock()
-	defer lock.Unlock()
-	for _, pi := range podCache {
+	ki.podLk.Lock()
+	defer ki.podLk.Unlock()
+	for _, pi := range ki.podCache {
 		if pi.Status.Phase == v1.PodFailed || pi.Status.Phase == v1.PodSucceeded {
 			continue
 		}
@@ -126,22 +180,6 @@ func (ki *KubeClient) getPodListByCondition(selector fields.Selector) (*v1.PodLi
 	return newPodList, err
 }
 
-func checkAnnotationAllocateValid(requestDevices []string, pod *v1.Pod) bool {
-	if predicateTime, ok := pod.Annotations[PodPredicateTime]; ok {
-		if predicateTime == strconv.FormatUint(math.MaxUint64, 10) {
-			klog.Warningf("The pod has been mounted to a device, pod name: %s", pod.Name)
-			return false
-		}
-	}
-	devStr, exist := pod.Annotations[ResourceNamePrefix+PodDevVolcano]
-	if !exist {
-		return false
-	}
-
-	allocateDevice := strings.Split(devStr, CommaSepDev)
-	return len(allocateDevice) == len(requestDevices)
-}
-
 func isShouldDeletePod(pod *v1.Pod) bool {
 	if pod.DeletionTimestamp != nil {
 		return true
@@ -168,64 +206,3 @@ func FilterPods(pods []v1.Pod, conditionFunc func(pod *v1.Pod) bool) []v1.Pod {
 	}
 	return res
 }
-
-func (ki *KubeClient) GetMatchedPod(requestDevices []string) (*v1.Pod, error) {
-	conditionFunc := func(pod *v1.Pod) bool {
-		return checkAnnotationAllocateValid(requestDevices, pod)
-	}
-	var filteredPods = make([]v1.Pod, 0)
-	var allPods = make([]v1.Pod, 0)
-	for i := 0; i < GetPodFromInformerTime; i++ {
-		if i == GetPodFromInformerTime-1 {
-			// in the last time of retry, get the pod from api server instead of cache
-			noneCachedPod, err := ki.GetActivePodList()
-			if err != nil {
-				klog.Errorf("get active pod from api server failed")
-				return nil, err
-			}
-			allPods = noneCachedPod
-		} else {
-			allPods = ki.GetActivePodListCache()
-		}
-		filteredPods = FilterPods(allPods, conditionFunc)
-		if len(filteredPods) != 0 {
-			break
-		}
-		klog.Warningf("no pod passed the filter, request device: %v, retry: %d", requestDevices, i)
-		time.Sleep(time.Second)
-	}
-	oldestPod := getOldestPod(filteredPods)
-	if oldestPod == nil {
-		return nil, fmt.Errorf("not get valid pod")
-	}
-
-	return oldestPod, nil
-}
-
-func getOldestPod(pods []v1.Pod) *v1.Pod {
-	if len(pods) == 0 {
-		return nil
-	}
-	oldest := pods[0]
-	for _, pod := range pods {
-		if getPredicateTimeFromPodAnnotation(&oldest) > getPredicateTimeFromPodAnnotation(&pod) {
-			oldest = pod
-		}
-	}
-	klog.Infof("oldest pod %#v, predicate time: %#v", oldest.Name, oldest.Annotations[PodPredicateTime])
-	return &oldest
-}
-
-func getPredicateTimeFromPodAnnotation(pod *v1.Pod) uint64 {
-	assumeTimeStr, ok := pod.Annotations[PodPredicateTime]
-	if !ok {
-		klog.Warningf("volcano not write timestamp, pod Name: %s", pod.Name)
-		return math.MaxUint64
-	}
-	predicateTime, err := strconv.ParseUint(assumeTimeStr, 10, 64)
-	if err != nil {
-		klog.Errorf("parse timestamp failed, %v", err)
-		return math.MaxUint64
-	}
-	return predicateTime
-}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -28,8 +29,10 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 type KubeClient struct {
@@ -38,8 +41,16 @@ type KubeClient struct {
 	DeviceInfoName string
 	NeedRefresh    bool
 	PodInformer    cache.SharedIndexInformer
+	NodeInformer   cache.SharedIndexInformer
 	Queue          workqueue.RateLimitingInterface
 	Namespace      string
+	Recorder       record.EventRecorder
+
+	// clock stamps the cached pods and the device info written to the cm
+	clock clock.PassiveClock
+	// podCache is the pods of the node, as seen by the pod informer
+	podLk    sync.Mutex
+	podCache map[types.UID]*podInfo
 }
 
 func NewKubeClient() (*KubeClient, error) {
@@ -65,6 +76,12 @@ func NewKubeClient() (*KubeClient, error) {
 		namespace = DefaultNameSpace
 	}
 
+	return NewKubeClientFor(client, nodeName, namespace, clock.RealClock{}), nil
+}
+
+// NewKubeClientFor creates a KubeClient of the node nodeName using client,
+// the device info is written to namespace.
+func NewKubeClientFor(client kubernetes.Interface, nodeName, namespace string, clk clock.PassiveClock) *KubeClient {
 	return &KubeClient{
 		Client:         client,
 		NodeName:       nodeName,
@@ -72,7 +89,9 @@ func NewKubeClient() (*KubeClient, error) {
 		Queue:          workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
 		NeedRefresh:    false,
 		Namespace:      namespace,
-	}, nil
+		clock:          clk,
+		podCache:       map[types.UID]*podInfo{},
+	}
 }
 
 func GetNodeNameFromEnv() (string, error) {
@@ -148,3 +167,8 @@ func (ki *KubeClient) PatchPod(pod *v1.Pod, data []byte) (*v1.Pod, error) {
 	return ki.Client.CoreV1().Pods(pod.Namespace).Patch(context.Background(),
 		pod.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
 }
+
+func (ki *KubeClient) PatchNode(data []byte) (*v1.Node, error) {
+	return ki.Client.CoreV1().Nodes().Patch(context.Background(),
+		ki.NodeName, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+}
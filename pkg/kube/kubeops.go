@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 
+	"gitee.com/deep-spark/ix-device-plugin/pkg/deviceinfo"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,7 +19,7 @@ func (ki *KubeClient) WriteDevicelisttoCM(devices []string) error {
 
 	var nodeDeviceListData = NodeDeviceList{
 		DeviceList: devices,
-		UpdateTime: time.Now().Unix(),
+		UpdateTime: ki.clock.Now().Unix(),
 	}
 
 	var devicelistdata []byte
@@ -30,7 +31,7 @@ func (ki *KubeClient) WriteDevicelisttoCM(devices []string) error {
 
 	newConfigmapData := map[string]interface{}{
 		"data": map[string]interface{}{
-			"DeviceListCfg": string(devicelistdata),
+			DeviceListCMDataKey: string(devicelistdata),
 		},
 	}
 	configmapUpdateData, err := json.Marshal(newConfigmapData)
@@ -56,23 +57,24 @@ func (ki *KubeClient) WriteDevicelisttoCM(devices []string) error {
 	return err
 }
 
-func (ki *KubeClient) WriteDeviceInfoDataIntoCM(devices []string, deviceinfo map[string]DeviceInfo, verbose bool) error {
+// WriteDeviceInfoDataIntoCM writes the versioned info, and the legacy
+// unversioned one unless legacy is nil.
+func (ki *KubeClient) WriteDeviceInfoDataIntoCM(devices []string, info *deviceinfo.NodeDeviceInfo,
+	legacy map[string]DeviceInfo, verbose bool) error {
 
-	updatetime := time.Now().Unix()
-	var nodeDeviceInfoData = NodeDeviceInfo{
-		DeviceInfo: deviceinfo,
-		UpdateTime: updatetime,
-	}
+	updatetime := ki.clock.Now().Unix()
+	info.NodeName = ki.NodeName
+	info.UpdateTime = updatetime
 
 	var nodeDeviceListData = NodeDeviceList{
 		DeviceList: devices,
 		UpdateTime: updatetime,
 	}
 
-	var deviceinfodata, devicelistdata []byte
+	var infodata, devicelistdata []byte
 	var err error
-	if deviceinfodata, err = json.Marshal(nodeDeviceInfoData); err != nil {
-		return fmt.Errorf("marshal nodeDeviceInfoData failed: %v", err)
+	if infodata, err = json.Marshal(info); err != nil {
+		return fmt.Errorf("marshal device info failed: %v", err)
 	}
 
 	if devicelistdata, err = json.Marshal(nodeDeviceListData); err != nil {
@@ -87,8 +89,20 @@ func (ki *KubeClient) WriteDeviceInfoDataIntoCM(devices []string, deviceinfo map
 	}
 
 	deviceInfoCM.Data = map[string]string{
-		DeviceInfoCMDataKey: string(deviceinfodata),
-		DeviceListCMDataKey: string(devicelistdata),
+		DeviceInfoSchemaCMDataKey: string(infodata),
+		DeviceListCMDataKey:       string(devicelistdata),
+	}
+
+	if legacy != nil {
+		var nodeDeviceInfoData = NodeDeviceInfo{
+			DeviceInfo: legacy,
+			UpdateTime: updatetime,
+		}
+		var deviceinfodata []byte
+		if deviceinfodata, err = json.Marshal(nodeDeviceInfoData); err != nil {
+			return fmt.Errorf("marshal nodeDeviceInfoData failed: %v", err)
+		}
+		deviceInfoCM.Data[DeviceInfoCMDataKey] = string(deviceinfodata)
 	}
 	if verbose {
 		klog.Infof("write device info cache into cm: %s/%s.", deviceInfoCM.Namespace, deviceInfoCM.Name)
@@ -108,12 +122,12 @@ func (ki *KubeClient) TryUpdatePodCacheAnnotation(pod *v1.Pod, annotation map[st
 		return err
 	}
 	// update cache
-	lock.Lock()
-	defer lock.Unlock()
-	for i, podInCache := range podCache {
+	ki.podLk.Lock()
+	defer ki.podLk.Unlock()
+	for i, podInCache := range ki.podCache {
 		if podInCache.Namespace == pod.Namespace && podInCache.Name == pod.Name {
 			for k, v := range annotation {
-				podCache[i].Annotations[k] = v
+				ki.podCache[i].Annotations[k] = v
 			}
 			klog.Infof("update annotation in pod cache success, name: %s, namespace: %s", pod.Name, pod.Namespace)
 			return nil
@@ -125,7 +139,7 @@ func (ki *KubeClient) TryUpdatePodCacheAnnotation(pod *v1.Pod, annotation map[st
 
 func (ki *KubeClient) TryUpdatePodAnnotation(pod *v1.Pod, annotation map[string]string) error {
 
-	newPodMetaData := podMetaData{"metadata": metaData{Annotation: annotation}}
+	newPodMetaData := podMetaData{"metadata": metaData{UID: pod.UID, Annotation: annotation}}
 	podUpdateMetaData, err := json.Marshal(newPodMetaData)
 	if err != nil {
 		klog.Errorf("Failed to marshal pod metadata: %v", err)
@@ -148,3 +162,77 @@ func (ki *KubeClient) TryUpdatePodAnnotation(pod *v1.Pod, annotation map[string]
 
 	return fmt.Errorf("patch pod annotation failed, exceeded max number of retries")
 }
+
+// TryUpdateNodeAnnotation patches annotations of the node the plugin runs on,
+// a nil value removes the annotation.
+func (ki *KubeClient) TryUpdateNodeAnnotation(annotation map[string]*string) error {
+	newNodeMetaData := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotation},
+	}
+	nodeUpdateMetaData, err := json.Marshal(newNodeMetaData)
+	if err != nil {
+		klog.Errorf("Failed to marshal node metadata: %v", err)
+		return err
+	}
+
+	for i := 0; i < RetryUpdateCount; i++ {
+		if _, err = ki.PatchNode(nodeUpdateMetaData); err == nil {
+			return nil
+		}
+
+		if errors.IsNotFound(err) {
+			return err
+		}
+
+		klog.Warningf("patch node annotation failed: %v, try again", err)
+		time.Sleep(PatchWaitTime * time.Millisecond)
+	}
+
+	return fmt.Errorf("patch node annotation failed, exceeded max number of retries")
+}
+
+// GetNodeCondition returns the condition of type conditionType of the node the
+// plugin runs on, nil if it is not set.
+func (ki *KubeClient) GetNodeCondition(conditionType v1.NodeConditionType) (*v1.NodeCondition, error) {
+	node, err := ki.Client.CoreV1().Nodes().Get(context.Background(), ki.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range node.Status.Conditions {
+		if c.Type == conditionType {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// TryUpdateNodeCondition sets a condition in the status of the node the plugin
+// runs on, conditions are merged by type.
+func (ki *KubeClient) TryUpdateNodeCondition(condition v1.NodeCondition) error {
+	newNodeStatus := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{condition},
+		},
+	}
+	nodeUpdateStatus, err := json.Marshal(newNodeStatus)
+	if err != nil {
+		klog.Errorf("Failed to marshal node status: %v", err)
+		return err
+	}
+
+	for i := 0; i < RetryUpdateCount; i++ {
+		if _, err = ki.Client.CoreV1().Nodes().PatchStatus(context.Background(),
+			ki.NodeName, nodeUpdateStatus); err == nil {
+			return nil
+		}
+
+		if errors.IsNotFound(err) {
+			return err
+		}
+
+		klog.Warningf("patch node condition failed: %v, try again", err)
+		time.Sleep(PatchWaitTime * time.Millisecond)
+	}
+
+	return fmt.Errorf("patch node condition failed, exceeded max number of retries")
+}
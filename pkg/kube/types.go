@@ -4,6 +4,7 @@ import (
 	"gitee.com/deep-spark/ix-device-plugin/pkg/gpuallocator"
 	"google.golang.org/grpc"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
 )
 
@@ -20,6 +21,8 @@ const (
 )
 
 type metaData struct {
+	// UID makes the api server reject the patch if the pod was recreated
+	UID        types.UID         `json:"uid,omitempty"`
 	Annotation map[string]string `json:"annotations"`
 }
 
@@ -50,6 +53,8 @@ type DeviceInfo struct {
 	Name  string
 	UUID  string
 	Links map[string][]P2PLink
+	// ExcludeReason tells why the device is administratively excluded
+	ExcludeReason string `json:",omitempty"`
 }
 
 type NodeDeviceInfo struct {
@@ -62,6 +67,14 @@ type NodeDeviceList struct {
 	UpdateTime int64
 }
 
+// GpuMaintenanceStatus is the per-uuid result written back to the node
+// after an operator requested reset.
+type GpuMaintenanceStatus struct {
+	Phase      string `json:"phase"`
+	Message    string `json:"message,omitempty"`
+	UpdateTime int64  `json:"updateTime"`
+}
+
 type NodeDeviceInfoCache struct {
 	DeviceInfo NodeDeviceInfo
 }
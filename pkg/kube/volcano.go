@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package kube
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// VolcanoBinding is the container of a Volcano scheduled pod an allocation
+// request was matched to.
+type VolcanoBinding struct {
+	Pod       *v1.Pod
+	Container string
+	// Devices chosen by Volcano for the container
+	Devices []string
+	// Last is true if the container is the last one of the pod to be bound
+	Last bool
+}
+
+// volcanoContainer is a container of a Volcano scheduled pod requesting gpus.
+type volcanoContainer struct {
+	name    string
+	devices []string
+}
+
+// volcanoContainers splits the devices Volcano chose for pod across the
+// containers requesting resourceName, in the order kubelet allocates them:
+// init containers first, then the others, each in spec order.
+func volcanoContainers(pod *v1.Pod, resourceName v1.ResourceName) ([]volcanoContainer, error) {
+	devStr, exist := pod.Annotations[ResourceNamePrefix+PodDevVolcano]
+	if !exist || devStr == "" {
+		return nil, fmt.Errorf("pod %s/%s has no volcano devices", pod.Namespace, pod.Name)
+	}
+	devices := strings.Split(devStr, CommaSepDev)
+
+	var containers []volcanoContainer
+	next := 0
+	for _, c := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		limit, ok := c.Resources.Limits[resourceName]
+		if !ok || limit.Value() == 0 {
+			continue
+		}
+		count := int(limit.Value())
+		if next+count > len(devices) {
+			return nil, fmt.Errorf("pod %s/%s requests more than the %d volcano devices", pod.Namespace, pod.Name,
+				len(devices))
+		}
+		containers = append(containers, volcanoContainer{name: c.Name, devices: devices[next : next+count]})
+		next += count
+	}
+	if next != len(devices) {
+		return nil, fmt.Errorf("pod %s/%s requests %d devices, volcano assigned %d", pod.Namespace, pod.Name,
+			next, len(devices))
+	}
+	return containers, nil
+}
+
+func boundContainers(pod *v1.Pod) map[string]bool {
+	bound := map[string]bool{}
+	for _, name := range strings.Split(pod.Annotations[ResourceNamePrefix+PodDevVolcanoBound], CommaSepDev) {
+		if name != "" {
+			bound[name] = true
+		}
+	}
+	return bound
+}
+
+func isVolcanoBound(pod *v1.Pod) bool {
+	return pod.Annotations[PodPredicateTime] == strconv.FormatUint(math.MaxUint64, 10)
+}
+
+func sameDevices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitsForDevices reports whether pod is pending with a container requesting
+// count devices of resourceName, which may be the one kubelet is admitting.
+func waitsForDevices(pod *v1.Pod, resourceName v1.ResourceName, count int) bool {
+	if pod.Status.Phase != v1.PodPending {
+		return false
+	}
+	for _, c := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if limit, ok := c.Resources.Limits[resourceName]; ok && int(limit.Value()) == count {
+			return true
+		}
+	}
+	return false
+}
+
+// nextVolcanoContainers returns the next container to be bound of every
+// Volcano pod of pods which is not bound yet.
+func nextVolcanoContainers(pods []v1.Pod, resourceName v1.ResourceName) []*VolcanoBinding {
+	var ret []*VolcanoBinding
+	for i := range pods {
+		pod := &pods[i]
+		if isShouldDeletePod(pod) {
+			continue
+		}
+		if _, ok := pod.Annotations[ResourceNamePrefix+PodDevVolcano]; !ok || isVolcanoBound(pod) {
+			continue
+		}
+
+		containers, err := volcanoContainers(pod, resourceName)
+		if err != nil {
+			klog.Warningf("Skip volcano pod: %v", err)
+			continue
+		}
+		bound := boundContainers(pod)
+		for j, c := range containers {
+			if !bound[c.name] {
+				ret = append(ret, &VolcanoBinding{Pod: pod, Container: c.name, Devices: c.devices,
+					Last: j == len(containers)-1})
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// PreferredVolcanoDevices returns the devices Volcano chose for the only next
+// container to be bound which requests size devices, all of them available,
+// so that kubelet asks for them. It returns nil if there is no such container
+// or several.
+func PreferredVolcanoDevices(pods []v1.Pod, resourceName v1.ResourceName, available []string, size int) []string {
+	free := map[string]bool{}
+	for _, id := range available {
+		free[id] = true
+	}
+
+	var ret []string
+	found := 0
+	for _, b := range nextVolcanoContainers(pods, resourceName) {
+		all := len(b.Devices) == size
+		for _, id := range b.Devices {
+			all = all && free[id]
+		}
+		if all {
+			ret = b.Devices
+			found++
+		}
+	}
+	if found != 1 {
+		return nil
+	}
+	return append([]string(nil), ret...)
+}
+
+// MatchVolcanoContainer finds the container an allocation of the kubelet
+// assigned devices request is for, among the pods of the node. Only the next
+// container to be bound of every Volcano pod is a candidate, and only one
+// whose Volcano devices are the requested ones: kubelet is steered to them by
+// PreferredVolcanoDevices. Anything else fails, rather than risking to give
+// the devices of one pod to another:
+//   - several candidates with the requested devices are ambiguous,
+//   - a candidate requesting as many devices but other ones may be another
+//     pod than the requester,
+//   - a pending pod not scheduled by Volcano can not be given its devices.
+func MatchVolcanoContainer(pods []v1.Pod, resourceName v1.ResourceName, request []string) (*VolcanoBinding, error) {
+	var exact, sized []*VolcanoBinding
+	for _, binding := range nextVolcanoContainers(pods, resourceName) {
+		if sameDevices(binding.Devices, request) {
+			exact = append(exact, binding)
+		} else if len(binding.Devices) == len(request) {
+			sized = append(sized, binding)
+		}
+	}
+
+	otherRequester := false
+	for i := range pods {
+		pod := &pods[i]
+		if _, ok := pod.Annotations[ResourceNamePrefix+PodDevVolcano]; !ok && !isShouldDeletePod(pod) {
+			otherRequester = otherRequester || waitsForDevices(pod, resourceName, len(request))
+		}
+	}
+
+	describe := func(bindings []*VolcanoBinding) string {
+		var names []string
+		for _, b := range bindings {
+			names = append(names, fmt.Sprintf("%s/%s[%s]", b.Pod.Namespace, b.Pod.Name, b.Container))
+		}
+		sort.Strings(names)
+		return strings.Join(names, ", ")
+	}
+
+	switch {
+	case len(exact) == 1:
+		return exact[0], nil
+	case len(exact) > 1:
+		return nil, fmt.Errorf("devices %v match several volcano pods: %s", request, describe(exact))
+	case len(sized) > 0:
+		return nil, fmt.Errorf("devices %v are not the ones volcano chose for %s", request, describe(sized))
+	case otherRequester:
+		return nil, fmt.Errorf("devices %v are requested by a pod not scheduled by volcano", request)
+	}
+	return nil, fmt.Errorf("no volcano pod waits for %d devices", len(request))
+}
+
+// MatchVolcanoPod matches request against the pods of the node, see
+// MatchVolcanoContainer. The pod cache may lag behind the scheduler, so the
+// last attempt lists the pods from the api server.
+func (ki *KubeClient) MatchVolcanoPod(resourceName v1.ResourceName, request []string) (*VolcanoBinding, error) {
+	var binding *VolcanoBinding
+	var err error
+	for i := 0; i < GetPodFromInformerTime; i++ {
+		var pods []v1.Pod
+		if i == GetPodFromInformerTime-1 {
+			if pods, err = ki.GetActivePodList(); err != nil {
+				klog.Errorf("get active pod from api server failed")
+				return nil, err
+			}
+		} else {
+			pods = ki.GetActivePodListCache()
+		}
+
+		binding, err = MatchVolcanoContainer(pods, resourceName, request)
+		if err == nil {
+			return binding, nil
+		}
+		klog.Warningf("no volcano pod matched, request device: %v, retry: %d, err: %v", request, i, err)
+		time.Sleep(time.Second)
+	}
+	return nil, err
+}
+
+// BindVolcanoContainer records that the container of binding is allocated,
+// the pod is marked bound once all of its containers are.
+func (ki *KubeClient) BindVolcanoContainer(binding *VolcanoBinding) error {
+	bound := []string{}
+	for name := range boundContainers(binding.Pod) {
+		bound = append(bound, name)
+	}
+	bound = append(bound, binding.Container)
+	sort.Strings(bound)
+
+	annotations := map[string]string{
+		ResourceNamePrefix + PodDevVolcanoBound: strings.Join(bound, CommaSepDev),
+	}
+	if binding.Last {
+		annotations[PodPredicateTime] = strconv.FormatUint(math.MaxUint64, 10)
+	}
+	return ki.TryUpdatePodCacheAnnotation(binding.Pod, annotations)
+}
@@ -0,0 +1,226 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/clock"
+)
+
+const testResource v1.ResourceName = "iluvatar.com/gpu"
+
+// volcanoPod returns a pending pod of node-1 with one container per entry of
+// counts requesting that many gpus, and the devices Volcano chose for it.
+func volcanoPod(name string, devices []string, counts ...int64) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			UID:         types.UID(name + "-uid"),
+			Annotations: map[string]string{},
+		},
+		Spec:   v1.PodSpec{NodeName: "node-1"},
+		Status: v1.PodStatus{Phase: v1.PodPending},
+	}
+	if devices != nil {
+		pod.Annotations[ResourceNamePrefix+PodDevVolcano] = strings.Join(devices, CommaSepDev)
+	}
+	for i, count := range counts {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+			Name: "c" + strconv.Itoa(i),
+			Resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{testResource: *resource.NewQuantity(count, resource.DecimalSI)},
+			},
+		})
+	}
+	return pod
+}
+
+// newTestClient returns a client whose api server and pod cache hold pods.
+func newTestClient(pods ...*v1.Pod) *KubeClient {
+	client := fake.NewSimpleClientset()
+	ki := NewKubeClientFor(client, "node-1", DefaultNameSpace, clock.RealClock{})
+	for _, pod := range pods {
+		if _, err := client.CoreV1().Pods(pod.Namespace).Create(context.Background(), pod,
+			metav1.CreateOptions{}); err != nil {
+			panic(err)
+		}
+		ki.UpdatePodList(nil, pod.DeepCopy(), EventTypeAdd)
+	}
+	return ki
+}
+
+func TestMatchVolcanoPodExact(t *testing.T) {
+	ki := newTestClient(
+		volcanoPod("a", []string{"gpu-0", "gpu-1"}, 2),
+		volcanoPod("b", []string{"gpu-2", "gpu-3"}, 2),
+	)
+
+	binding, err := ki.MatchVolcanoPod(testResource, []string{"gpu-3", "gpu-2"})
+	if err != nil {
+		t.Fatalf("MatchVolcanoPod failed: %v", err)
+	}
+	if binding.Pod.Name != "b" || binding.Container != "c0" || !binding.Last {
+		t.Errorf("matched %s[%s] last %v, want b[c0] last true", binding.Pod.Name, binding.Container, binding.Last)
+	}
+	if !reflect.DeepEqual(binding.Devices, []string{"gpu-2", "gpu-3"}) {
+		t.Errorf("devices %v, want the volcano ones", binding.Devices)
+	}
+}
+
+func TestMatchVolcanoContainerFailsClosed(t *testing.T) {
+	tests := []struct {
+		name    string
+		pods    []*v1.Pod
+		request []string
+	}{
+		{
+			name: "ambiguous",
+			pods: []*v1.Pod{
+				volcanoPod("a", []string{"gpu-0"}, 1),
+				volcanoPod("b", []string{"gpu-0"}, 1),
+			},
+			request: []string{"gpu-0"},
+		},
+		{
+			name:    "only the size matches",
+			pods:    []*v1.Pod{volcanoPod("a", []string{"gpu-0"}, 1)},
+			request: []string{"gpu-1"},
+		},
+		{
+			name: "pod not scheduled by volcano",
+			pods: []*v1.Pod{
+				volcanoPod("a", []string{"gpu-0", "gpu-1"}, 2),
+				volcanoPod("other", nil, 1),
+			},
+			request: []string{"gpu-2"},
+		},
+		{
+			name:    "no pod waits",
+			pods:    []*v1.Pod{volcanoPod("a", []string{"gpu-0", "gpu-1"}, 2)},
+			request: []string{"gpu-2"},
+		},
+		{
+			name: "pod already bound",
+			pods: func() []*v1.Pod {
+				pod := volcanoPod("a", []string{"gpu-0"}, 1)
+				pod.Annotations[PodPredicateTime] = strconv.FormatUint(math.MaxUint64, 10)
+				return []*v1.Pod{pod}
+			}(),
+			request: []string{"gpu-0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pods []v1.Pod
+			for _, pod := range tt.pods {
+				pods = append(pods, *pod)
+			}
+			binding, err := MatchVolcanoContainer(pods, testResource, tt.request)
+			if err == nil {
+				t.Fatalf("matched %s[%s], want an error", binding.Pod.Name, binding.Container)
+			}
+		})
+	}
+}
+
+func TestBindVolcanoContainers(t *testing.T) {
+	pod := volcanoPod("a", []string{"gpu-0", "gpu-1", "gpu-2"}, 1, 2)
+	ki := newTestClient(pod)
+
+	for _, step := range []struct {
+		request   []string
+		container string
+		bound     string
+		last      bool
+	}{
+		{request: []string{"gpu-0"}, container: "c0", bound: "c0"},
+		{request: []string{"gpu-2", "gpu-1"}, container: "c1", bound: "c0,c1", last: true},
+	} {
+		binding, err := ki.MatchVolcanoPod(testResource, step.request)
+		if err != nil {
+			t.Fatalf("MatchVolcanoPod(%v) failed: %v", step.request, err)
+		}
+		if binding.Container != step.container || binding.Last != step.last {
+			t.Fatalf("MatchVolcanoPod(%v) matched %s last %v, want %s last %v", step.request,
+				binding.Container, binding.Last, step.container, step.last)
+		}
+		if err := ki.BindVolcanoContainer(binding); err != nil {
+			t.Fatalf("BindVolcanoContainer failed: %v", err)
+		}
+
+		got, err := ki.Client.CoreV1().Pods("default").Get(context.Background(), "a", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get pod failed: %v", err)
+		}
+		if bound := got.Annotations[ResourceNamePrefix+PodDevVolcanoBound]; bound != step.bound {
+			t.Errorf("bound containers %q, want %q", bound, step.bound)
+		}
+		if _, ok := got.Annotations[PodPredicateTime]; ok != step.last {
+			t.Errorf("predicate time set %v, want %v", ok, step.last)
+		}
+	}
+
+	if _, err := MatchVolcanoContainer(ki.GetActivePodListCache(), testResource, []string{"gpu-0"}); err == nil {
+		t.Error("a bound pod matched again")
+	}
+}
+
+func TestPreferredVolcanoDevices(t *testing.T) {
+	pods := []v1.Pod{
+		*volcanoPod("a", []string{"gpu-0"}, 1),
+		*volcanoPod("b", []string{"gpu-1", "gpu-2"}, 2),
+	}
+
+	tests := []struct {
+		name      string
+		available []string
+		size      int
+		want      []string
+	}{
+		{name: "single candidate", available: []string{"gpu-0", "gpu-1", "gpu-2", "gpu-3"}, size: 2,
+			want: []string{"gpu-1", "gpu-2"}},
+		{name: "devices not available", available: []string{"gpu-0", "gpu-1", "gpu-3"}, size: 2},
+		{name: "no candidate of the size", available: []string{"gpu-0", "gpu-1", "gpu-2"}, size: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PreferredVolcanoDevices(pods, testResource, tt.available, tt.size)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PreferredVolcanoDevices = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	ambiguous := append(pods, *volcanoPod("c", []string{"gpu-3"}, 1))
+	if got := PreferredVolcanoDevices(ambiguous, testResource, []string{"gpu-0", "gpu-3"}, 1); got != nil {
+		t.Errorf("PreferredVolcanoDevices of several candidates = %v, want nil", got)
+	}
+}
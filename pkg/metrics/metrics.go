@@ -0,0 +1,186 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics keeps the gauges and counters of the plugin, and writes them
+// in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prefix is prepended to the name of every metric.
+const Prefix = "ix_device_plugin_"
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type kind string
+
+const (
+	gauge   kind = "gauge"
+	counter kind = "counter"
+)
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// Vec is a metric with a value for each combination of its labels.
+type Vec struct {
+	name   string
+	help   string
+	kind   kind
+	labels []string
+
+	lk      sync.Mutex
+	samples map[string]*sample
+}
+
+// Registry holds the metrics written by Write.
+type Registry struct {
+	lk   sync.Mutex
+	vecs map[string]*Vec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{vecs: map[string]*Vec{}}
+}
+
+// Gauge registers a metric set to the current value, or returns the one
+// registered under the name.
+func (r *Registry) Gauge(name, help string, labels ...string) *Vec {
+	return r.register(name, help, gauge, labels)
+}
+
+// Counter registers a metric which only grows, or returns the one registered
+// under the name.
+func (r *Registry) Counter(name, help string, labels ...string) *Vec {
+	return r.register(name, help, counter, labels)
+}
+
+func (r *Registry) register(name, help string, k kind, labels []string) *Vec {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	name = Prefix + name
+	if v, ok := r.vecs[name]; ok {
+		return v
+	}
+	v := &Vec{name: name, help: help, kind: k, labels: labels, samples: map[string]*sample{}}
+	r.vecs[name] = v
+	return v
+}
+
+func (v *Vec) sample(values []string) *sample {
+	if len(values) != len(v.labels) {
+		panic(fmt.Errorf("metric %s has labels %v, got values %v", v.name, v.labels, values))
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := v.samples[key]
+	if !ok {
+		s = &sample{labels: append([]string(nil), values...)}
+		v.samples[key] = s
+	}
+	return s
+}
+
+// Set sets the value for the label values, given in the order of the labels.
+func (v *Vec) Set(value float64, values ...string) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	v.sample(values).value = value
+}
+
+// Add adds delta to the value for the label values.
+func (v *Vec) Add(delta float64, values ...string) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	v.sample(values).value += delta
+}
+
+// Delete removes the value for the label values.
+func (v *Vec) Delete(values ...string) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	delete(v.samples, strings.Join(values, "\x00"))
+}
+
+// Reset removes all the values, for the gauges which are set again as a
+// whole.
+func (v *Vec) Reset() {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	v.samples = map[string]*sample{}
+}
+
+func (v *Vec) write(w io.Writer) error {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind); err != nil {
+		return err
+	}
+	var lines []string
+	for _, s := range v.samples {
+		var pairs []string
+		for i, label := range v.labels {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escaper.Replace(s.labels[i])))
+		}
+		line := v.name
+		if len(pairs) > 0 {
+			line += "{" + strings.Join(pairs, ",") + "}"
+		}
+		lines = append(lines, line+" "+strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes the metrics ordered by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.lk.Lock()
+	var vecs []*Vec
+	for _, v := range r.vecs {
+		vecs = append(vecs, v)
+	}
+	r.lk.Unlock()
+
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].name < vecs[j].name })
+	for _, v := range vecs {
+		if err := v.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}